@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/blacklister"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi"
+	"github.com/darkspot-org/bathyscaphe/internal/crawler"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/darkspot-org/bathyscaphe/internal/scheduler"
+	"github.com/darkspot-org/bathyscaphe/internal/seeder"
+	"github.com/urfave/cli/v2"
+	"os"
+)
+
+func main() {
+	// The ConfigAPI should be started first since the others processes depend on it
+	processes := []process.Process{
+		&configapi.State{},
+		&crawler.State{},
+		&scheduler.State{},
+		&indexer.State{},
+		&blacklister.State{},
+		&seeder.State{},
+	}
+
+	// Plug the processes together without requiring any external dependency
+	overrides := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "event-srv",
+			Usage: "URI to the event server",
+			Value: "memory://",
+		},
+		&cli.StringFlag{
+			Name:  "cache-srv",
+			Usage: "URI to the cache server",
+			Value: "memory://",
+		},
+		&cli.StringFlag{
+			Name:  "config-api",
+			Usage: "URI to the ConfigAPI server",
+			Value: "http://127.0.0.1:8080",
+		},
+		&cli.StringFlag{
+			Name:  "index-driver",
+			Usage: "Name of the storage driver",
+			Value: index.Local,
+		},
+		&cli.StringFlag{
+			Name:  "index-dest",
+			Usage: "Destination (config) passed to the driver",
+			Value: "archive",
+		},
+		&cli.StringSliceFlag{
+			Name:  "default-value",
+			Usage: "Set default value of key. (format key=value)",
+			Value: cli.NewStringSlice(
+				`forbidden-hostnames=[]`,
+				`allowed-mime-types=[{"content-type":"text/","extensions":["html","php","aspx","htm"]}]`,
+				`refresh-delay={"delay": 0}`,
+				`blacklist-config={"threshold": 5, "ttl": 1200}`,
+				`robots-txt={"mode": "obey", "ttl": 86400}`,
+				`rate-limit={"default": {"interval": 1, "burst": 1}, "hostnames": {}}`,
+				`crawl-limits={"max-depth": 10, "hostname-budget": 1000, "budget-period": 86400}`,
+			),
+		},
+	}
+
+	app := process.MakeAllInOneApp(processes, overrides)
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/darkspot-org/bathyscaphe/internal/seeder"
+	"os"
+)
+
+func main() {
+	app := process.MakeApp(&seeder.State{})
+	app.Commands = append(app.Commands, seeder.ImportCommand())
+	if err := app.Run(os.Args); err != nil {
+		os.Exit(1)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 var errAlreadyBlacklisted = fmt.Errorf("hostname is already blacklisted")
@@ -35,7 +36,8 @@ crawl the hostname index page to determinate if the whole hostname does not
 respond. If the hostname does not respond after a retry policy, it will
 be blacklisted by the process and further crawling event involving the hostname
 will be discarded by the crawling process. This allow us to not waste time
-crawling for nothing.
+crawling for nothing. The timeouts of a hostname are counted until it doesn't
+time out for the blacklist TTL.
 
 This process consumes the 'url.timeout' event.`
 }
@@ -76,7 +78,17 @@ func (state *State) Initialize(provider process.Provider) error {
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.TimeoutURLExchange, Queue: "blacklistingQueue", Handler: state.handleTimeoutURLEvent},
+		{
+			Exchange: event.TimeoutURLExchange,
+			Queue:    "blacklistingQueue",
+			Handler:  state.handleTimeoutURLEvent,
+			RetryPolicy: &event.RetryPolicy{
+				MaxAttempts: 3,
+				Backoff:     5 * time.Second,
+				Ignore:      []error{errAlreadyBlacklisted},
+			},
+			Errors: []error{errAlreadyBlacklisted},
+		},
 	}
 }
 
@@ -85,6 +97,11 @@ func (state *State) HTTPHandler() http.Handler {
 	return nil
 }
 
+// Shutdown the process, the dependencies are released by the provider
+func (state *State) Shutdown() error {
+	return nil
+}
+
 func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event.RawMessage) error {
 	var evt event.TimeoutURLEvent
 	if err := subscriber.Read(&msg, &evt); err != nil {
@@ -124,6 +141,8 @@ func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event
 	cacheKey := u.Hostname()
 
 	if err == nil {
+		checkedHostnames.WithLabelValues("up").Inc()
+
 		log.Debug().
 			Str("hostname", u.Hostname()).
 			Msg("Response received.")
@@ -136,6 +155,8 @@ func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event
 		return nil
 	}
 
+	checkedHostnames.WithLabelValues("timeout").Inc()
+
 	log.Debug().
 		Str("hostname", u.Hostname()).
 		Msg("Timeout confirmed")
@@ -145,46 +166,50 @@ func (state *State) handleTimeoutURLEvent(subscriber event.Subscriber, msg event
 		return err
 	}
 
-	count, err := state.hostnameCache.GetInt64(cacheKey)
+	// The timeouts are counted atomically since shared by the replicas, the count
+	// being kept while the hostname keeps timing out within the TTL
+	count, err := state.hostnameCache.IncrExtend(cacheKey, blackListConfig.TTL)
 	if err != nil {
 		return err
 	}
-	count++
 
+	// The timeout is counted: do not retry the event on failure, it would be counted again.
+	// The hostname is blacklisted with the next timeout instead
 	if count >= blackListConfig.Threshold {
-		forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
-		if err != nil {
-			return err
+		if err := state.blacklist(u.Hostname(), count); err != nil {
+			log.Err(err).Str("hostname", u.Hostname()).Msg("error while blacklisting hostname")
 		}
+	}
 
-		// prevent duplicates
-		found := false
-		for _, hostname := range forbiddenHostnames {
-			if hostname.Hostname == u.Hostname() {
-				found = true
-				break
-			}
-		}
+	return nil
+}
 
-		if found {
-			log.Trace().Str("hostname", u.Hostname()).Msg("Skipping duplicate hostname")
-		} else {
-			log.Info().
-				Str("hostname", u.Hostname()).
-				Int64("count", count).
-				Msg("Blacklisting hostname")
-
-			forbiddenHostnames = append(forbiddenHostnames, configapi.ForbiddenHostname{Hostname: u.Hostname()})
-			if err := state.configClient.Set(configapi.ForbiddenHostnamesKey, forbiddenHostnames); err != nil {
-				return err
-			}
+// blacklist add given hostname to the forbidden hostnames, unless already forbidden
+func (state *State) blacklist(hostname string, count int64) error {
+	forbiddenHostnames, err := state.configClient.GetForbiddenHostnames()
+	if err != nil {
+		return err
+	}
+
+	// prevent duplicates
+	for _, forbidden := range forbiddenHostnames {
+		if forbidden.Hostname == hostname {
+			log.Trace().Str("hostname", hostname).Msg("Skipping duplicate hostname")
+			return nil
 		}
 	}
 
-	// Update count
-	if err := state.hostnameCache.SetInt64(cacheKey, count, blackListConfig.TTL); err != nil {
+	log.Info().
+		Str("hostname", hostname).
+		Int64("count", count).
+		Msg("Blacklisting hostname")
+
+	forbiddenHostnames = append(forbiddenHostnames, configapi.ForbiddenHostname{Hostname: hostname})
+	if err := state.configClient.Set(configapi.ForbiddenHostnamesKey, forbiddenHostnames); err != nil {
 		return err
 	}
 
+	blacklistedHostnames.Inc()
+
 	return nil
 }
@@ -2,6 +2,7 @@ package blacklister
 
 import (
 	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
@@ -101,8 +102,7 @@ func TestHandleTimeoutURLEventNoDispatch(t *testing.T) {
 		TTL:       5,
 	}, nil)
 
-	hostnameCacheMock.EXPECT().GetInt64("down-example.onion").Return(int64(0), nil)
-	hostnameCacheMock.EXPECT().SetInt64("down-example.onion", int64(1), time.Duration(5)).Return(nil)
+	hostnameCacheMock.EXPECT().IncrExtend("down-example.onion", time.Duration(5)).Return(int64(1), nil)
 
 	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
 	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
@@ -134,7 +134,7 @@ func TestHandleTimeoutURLEvent(t *testing.T) {
 		TTL:       5,
 	}, nil)
 
-	hostnameCacheMock.EXPECT().GetInt64("down-example.onion").Return(int64(9), nil)
+	hostnameCacheMock.EXPECT().IncrExtend("down-example.onion", time.Duration(5)).Return(int64(10), nil)
 
 	configClientMock.EXPECT().
 		GetForbiddenHostnames().
@@ -146,13 +146,79 @@ func TestHandleTimeoutURLEvent(t *testing.T) {
 		}).
 		Return(nil)
 
-	hostnameCacheMock.EXPECT().
-		SetInt64("down-example.onion", int64(10), time.Duration(5)).
+	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleTimeoutURLEvent_SlidingWindow(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		AnyTimes().
+		SetArg(1, event.TimeoutURLEvent{URL: "https://down-example.onion/test.html"}).
+		Return(nil)
+	httpClientMock.EXPECT().Get("https://down-example.onion").AnyTimes().Return(nil, http.ErrTimeout)
+	configClientMock.EXPECT().GetForbiddenHostnames().AnyTimes().Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlackListConfig().AnyTimes().Return(configapi.BlackListConfig{
+		Threshold: 3,
+		TTL:       60 * time.Millisecond,
+	}, nil)
+
+	s := State{configClient: configClientMock, hostnameCache: cache.NewMemoryCache(t.Name(), "down-hostname"), httpClient: httpClientMock}
+
+	// The timeouts are spaced by less than the TTL, but their total duration exceeds it:
+	// the count is kept while the hostname keeps timing out
+	for i := 0; i < 2; i++ {
+		if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+
+	configClientMock.EXPECT().
+		Set(configapi.ForbiddenHostnamesKey, []configapi.ForbiddenHostname{{Hostname: "down-example.onion"}}).
 		Return(nil)
+	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
+		t.Fatal(err)
+	}
+}
 
+func TestHandleTimeoutURLEvent_BlacklistFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.TimeoutURLEvent{}).
+		SetArg(1, event.TimeoutURLEvent{URL: "https://down-example.onion/test.html"}).
+		Return(nil)
+
+	httpClientMock.EXPECT().Get("https://down-example.onion").Return(nil, http.ErrTimeout)
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return([]configapi.ForbiddenHostname{}, nil)
+	configClientMock.EXPECT().GetBlackListConfig().Return(configapi.BlackListConfig{Threshold: 1, TTL: 5}, nil)
+	hostnameCacheMock.EXPECT().IncrExtend("down-example.onion", time.Duration(5)).Return(int64(1), nil)
+	configClientMock.EXPECT().
+		Set(configapi.ForbiddenHostnamesKey, []configapi.ForbiddenHostname{{Hostname: "down-example.onion"}}).
+		Return(errors.New("config unavailable"))
+
+	// The timeout is counted already: the event must not be retried
 	s := State{configClient: configClientMock, hostnameCache: hostnameCacheMock, httpClient: httpClientMock}
 	if err := s.handleTimeoutURLEvent(subscriberMock, msg); err != nil {
-		t.Fail()
+		t.Errorf("event should not be retried: %s", err)
 	}
 }
 
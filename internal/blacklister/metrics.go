@@ -0,0 +1,22 @@
+package blacklister
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	checkedHostnames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "blacklister",
+		Name:      "checked_hostnames_total",
+		Help:      "The number of hostnames checked after a timeout, per result ('up' or 'timeout')",
+	}, []string{"result"})
+	blacklistedHostnames = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "blacklister",
+		Name:      "blacklisted_hostnames_total",
+		Help:      "The number of hostnames blacklisted",
+	})
+)
@@ -0,0 +1,116 @@
+// Package bloom implements the Bloom filters used to remember a large number of items in a bounded memory,
+// at the cost of false positives (an item may be reported as added while it is not)
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter is a Bloom filter sized for a number of items and a false positive rate
+type Filter struct {
+	bits []uint64
+	// m is the number of bits, k the number of hash functions
+	m, k     uint64
+	capacity uint64
+	fpRate   float64
+	count    uint64
+	ones     uint64
+}
+
+// New returns a Filter holding up to capacity items with given false positive rate
+func New(capacity uint64, fpRate float64) *Filter {
+	if capacity == 0 {
+		capacity = 1
+	}
+
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m == 0 {
+		m = 1
+	}
+
+	k := uint64(math.Round(float64(m) / float64(capacity) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	return &Filter{
+		bits:     make([]uint64, (m+63)/64),
+		m:        m,
+		k:        k,
+		capacity: capacity,
+		fpRate:   fpRate,
+	}
+}
+
+// Add adds given key to the filter, and returns true if it was (probably) already added
+func (f *Filter) Add(key []byte) bool {
+	h1, h2 := hashes(key)
+
+	present := true
+	for i := uint64(0); i < f.k; i++ {
+		word, mask := f.position(h1, h2, i)
+		if f.bits[word]&mask == 0 {
+			present = false
+			f.bits[word] |= mask
+			f.ones++
+		}
+	}
+
+	if !present {
+		f.count++
+	}
+
+	return present
+}
+
+// Contains returns true if given key has (probably) been added
+func (f *Filter) Contains(key []byte) bool {
+	h1, h2 := hashes(key)
+
+	for i := uint64(0); i < f.k; i++ {
+		word, mask := f.position(h1, h2, i)
+		if f.bits[word]&mask == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Count returns the number of items added
+func (f *Filter) Count() uint64 {
+	return f.count
+}
+
+// Full returns true once the filter holds its capacity, the false positive rate being exceeded past it
+func (f *Filter) Full() bool {
+	return f.count >= f.capacity
+}
+
+// FillRatio returns the ratio of bits set
+func (f *Filter) FillRatio() float64 {
+	return float64(f.ones) / float64(f.m)
+}
+
+// position returns the word and bit mask of the i-th hash function (double hashing)
+func (f *Filter) position(h1, h2, i uint64) (uint64, uint64) {
+	pos := (h1 + i*h2) % f.m
+	return pos / 64, 1 << (pos % 64)
+}
+
+// hashes returns the two independent hashes of given key from which the k positions are derived
+func hashes(key []byte) (uint64, uint64) {
+	h := fnv.New128a()
+	_, _ = h.Write(key)
+	sum := h.Sum(nil)
+
+	var h1, h2 uint64
+	for i := 0; i < 8; i++ {
+		h1 = h1<<8 | uint64(sum[i])
+		h2 = h2<<8 | uint64(sum[8+i])
+	}
+
+	// An odd step visits distinct positions
+	return h1, h2 | 1
+}
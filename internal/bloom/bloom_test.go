@@ -0,0 +1,106 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+)
+
+// falsePositiveRate returns the ratio of the n keys never added reported as added
+func falsePositiveRate(n int, contains func(key []byte) bool) float64 {
+	positives := 0
+	for i := 0; i < n; i++ {
+		if contains([]byte("missing-" + strconv.Itoa(i))) {
+			positives++
+		}
+	}
+
+	return float64(positives) / float64(n)
+}
+
+func TestFilter(t *testing.T) {
+	f := New(10000, 0.01)
+
+	for i := 0; i < 10000; i++ {
+		if f.Add([]byte(strconv.Itoa(i))) && i < 10 {
+			t.Errorf("%d reported as already added", i)
+		}
+	}
+
+	// No false negatives
+	for i := 0; i < 10000; i++ {
+		if !f.Contains([]byte(strconv.Itoa(i))) {
+			t.Fatalf("%d not found", i)
+		}
+		if !f.Add([]byte(strconv.Itoa(i))) {
+			t.Fatalf("%d should be already added", i)
+		}
+	}
+
+	// The false positives are not counted
+	if count := f.Count(); count < 9800 || count > 10000 {
+		t.Errorf("unexpected count: %d", count)
+	}
+	if ratio := f.FillRatio(); ratio < 0.4 || ratio > 0.6 {
+		t.Errorf("unexpected fill ratio: %f", ratio)
+	}
+	if rate := falsePositiveRate(100000, f.Contains); rate > 0.015 {
+		t.Errorf("false positive rate too high: %f", rate)
+	}
+}
+
+func TestScalable(t *testing.T) {
+	s := NewScalable(1000, 0.01)
+
+	// Add way more items than the initial capacity
+	for i := 0; i < 20000; i++ {
+		s.Add([]byte(strconv.Itoa(i)))
+	}
+
+	for i := 0; i < 20000; i++ {
+		if !s.Contains([]byte(strconv.Itoa(i))) {
+			t.Fatalf("%d not found", i)
+		}
+	}
+
+	if len(s.filters) < 2 {
+		t.Errorf("filter should have grown: %d", len(s.filters))
+	}
+	if count := s.Count(); count < 19800 || count > 20000 {
+		t.Errorf("unexpected count: %d", count)
+	}
+	if rate := falsePositiveRate(100000, s.Contains); rate > 0.015 {
+		t.Errorf("false positive rate too high: %f", rate)
+	}
+}
+
+func TestRotating(t *testing.T) {
+	r := NewRotating(3, 1000, 0.01)
+
+	if r.TestAndAdd([]byte("a")) {
+		t.Error("a should not be added yet")
+	}
+	if !r.TestAndAdd([]byte("a")) {
+		t.Error("a should be added")
+	}
+
+	// The items are kept until their generation is dropped
+	r.Rotate()
+	r.Rotate()
+	if !r.TestAndAdd([]byte("a")) {
+		t.Error("a should be added")
+	}
+
+	// Re-adding an item moves it to the current generation
+	r.Add([]byte("b"))
+	r.Rotate()
+	if r.TestAndAdd([]byte("a")) {
+		t.Error("a should have been forgotten")
+	}
+	if !r.TestAndAdd([]byte("b")) {
+		t.Error("b should be added")
+	}
+
+	if stats := r.Stats(); stats.Items != 2 || stats.FillRatio <= 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,82 @@
+package bloom
+
+import "sync"
+
+// Rotating is a time partitioned Bloom filter: the items are added to the current generation,
+// and forgotten once their generation is dropped by a rotation. It is safe for concurrent use
+type Rotating struct {
+	mutex sync.Mutex
+	// generations are ordered from the newest (the current one) to the oldest
+	generations []*Scalable
+	capacity    uint64
+	fpRate      float64
+}
+
+// Stats are the statistics of a Rotating filter
+type Stats struct {
+	// Items is the number of items of every generation
+	Items uint64
+	// FillRatio is the ratio of bits set of the current generation
+	FillRatio float64
+}
+
+// NewRotating returns a Rotating of given number of generations (at least two), each one sized for
+// capacity items before growing, with given false positive rate
+func NewRotating(generations int, capacity uint64, fpRate float64) *Rotating {
+	if generations < 2 {
+		generations = 2
+	}
+
+	// Split the false positive rate between the generations, since an item is looked up in each of them
+	r := &Rotating{capacity: capacity, fpRate: fpRate / float64(generations)}
+	for i := 0; i < generations; i++ {
+		r.generations = append(r.generations, NewScalable(r.capacity, r.fpRate))
+	}
+
+	return r
+}
+
+// Add adds given key to the current generation
+func (r *Rotating) Add(key []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.generations[0].Add(key)
+}
+
+// TestAndAdd returns true if given key has (probably) been added to any generation,
+// and adds it to the current generation otherwise
+func (r *Rotating) TestAndAdd(key []byte) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, generation := range r.generations[1:] {
+		if generation.Contains(key) {
+			return true
+		}
+	}
+
+	return r.generations[0].Add(key)
+}
+
+// Rotate starts a new generation, dropping the oldest one
+func (r *Rotating) Rotate() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	copy(r.generations[1:], r.generations[:len(r.generations)-1])
+	r.generations[0] = NewScalable(r.capacity, r.fpRate)
+}
+
+// Stats returns the statistics of the filter
+func (r *Rotating) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := Stats{FillRatio: r.generations[0].FillRatio()}
+	for _, generation := range r.generations {
+		stats.Items += generation.Count()
+	}
+
+	return stats
+}
@@ -0,0 +1,62 @@
+package bloom
+
+const (
+	// growthFactor is the capacity ratio between two successive filters of a Scalable
+	growthFactor = 2
+	// tighteningRatio is the false positive rate ratio between two successive filters of a Scalable
+	tighteningRatio = 0.5
+)
+
+// Scalable is a Bloom filter growing as items are added, while keeping its false positive rate bounded:
+// once full, a new filter of larger capacity and lower false positive rate is added.
+// See: Almeida et al., Scalable Bloom Filters (2007)
+type Scalable struct {
+	filters []*Filter
+}
+
+// NewScalable returns a Scalable sized for capacity items before growing, with given false positive rate
+func NewScalable(capacity uint64, fpRate float64) *Scalable {
+	// The false positive rates of the filters are a geometric series summing up to fpRate
+	return &Scalable{filters: []*Filter{New(capacity, fpRate*(1-tighteningRatio))}}
+}
+
+// Add adds given key to the filter, and returns true if it was (probably) already added
+func (s *Scalable) Add(key []byte) bool {
+	if s.Contains(key) {
+		return true
+	}
+
+	current := s.filters[len(s.filters)-1]
+	if current.Full() {
+		current = New(current.capacity*growthFactor, current.fpRate*tighteningRatio)
+		s.filters = append(s.filters, current)
+	}
+
+	return current.Add(key)
+}
+
+// Contains returns true if given key has (probably) been added
+func (s *Scalable) Contains(key []byte) bool {
+	for _, f := range s.filters {
+		if f.Contains(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Count returns the number of items added
+func (s *Scalable) Count() uint64 {
+	var count uint64
+	for _, f := range s.filters {
+		count += f.count
+	}
+
+	return count
+}
+
+// FillRatio returns the ratio of bits set of the filter being filled
+func (s *Scalable) FillRatio() float64 {
+	return s.filters[len(s.filters)-1].FillRatio()
+}
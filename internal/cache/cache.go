@@ -3,9 +3,17 @@ package cache
 //go:generate mockgen -destination=../cache_mock/cache_mock.go -package=cache_mock . Cache
 
 import (
+	"net/url"
 	"time"
 )
 
+const (
+	// MemoryScheme is the URI scheme used to select the in-process cache
+	MemoryScheme = "memory"
+	// FileScheme is the URI scheme used to select the embedded on-disk cache
+	FileScheme = "file"
+)
+
 var (
 	// NoTTL define an entry that lives forever
 	NoTTL = time.Duration(0)
@@ -15,6 +23,9 @@ var (
 type Cache interface {
 	GetBytes(key string) ([]byte, error)
 	SetBytes(key string, value []byte, TTL time.Duration) error
+	// SetManyBytes atomically set the values of given keys, a nil value removing the key.
+	// With a Redis Cluster, the update is only atomic for the keys of a same hash slot
+	SetManyBytes(values map[string][]byte, TTL time.Duration) error
 
 	GetInt64(key string) (int64, error)
 	SetInt64(key string, value int64, TTL time.Duration) error
@@ -22,5 +33,56 @@ type Cache interface {
 	GetManyInt64(keys []string) (map[string]int64, error)
 	SetManyInt64(values map[string]int64, TTL time.Duration) error
 
+	// Incr atomically increments the value of given key by one, see IncrBy
+	Incr(key string, TTL time.Duration) (int64, error)
+	// IncrBy atomically increments the value of given key and returns the new value.
+	// A missing key is created with given TTL, the TTL of an existing key is kept
+	IncrBy(key string, value int64, TTL time.Duration) (int64, error)
+	// IncrExtend atomically increments the value of given key by one and returns the new value.
+	// The TTL is set at each increment: the key expires TTL after its last increment
+	IncrExtend(key string, TTL time.Duration) (int64, error)
+	// SetManyNX set the values of the keys not existing yet, and returns which keys have been set
+	SetManyNX(values map[string]int64, TTL time.Duration) (map[string]bool, error)
+	// Throttle atomically applies the GCRA rate limiting on given key, the requests being spaced by interval
+	// and up to burst requests being allowed at once. It accounts the request and returns zero if allowed at now,
+	// or returns how long to wait before the next request is allowed
+	Throttle(key string, now time.Time, interval time.Duration, burst int64) (time.Duration, error)
+
 	Remove(key string) error
+	// Keys returns the keys of the entries (not the sorted sets), without the key prefix
+	Keys() ([]string, error)
+
+	// SetScores add given members to the sorted set, or update their score
+	SetScores(set string, scores map[string]int64) error
+	// RemoveScores removes given members from the sorted set
+	RemoveScores(set string, members []string) error
+	// LeaseByScore returns up to count members of the sorted set whose score is lower than or equal to max
+	// (lowest first), and set their score to lease so that they are not returned again until then
+	LeaseByScore(set string, max int64, lease int64, count int) ([]string, error)
+
+	// Ping returns an error if the cache is not reachable
+	Ping() error
+	// Close release the connection to the cache
+	Close() error
+}
+
+// NewCache return a new Cache using the backend matching given URI scheme.
+// Supported URIs are redis://host:port/db, redis-sentinel://host:port,host:port/master/db,
+// redis-cluster://host:port,host:port, memory://name and file:///path/to/cache.db
+func NewCache(URI string, keyPrefix string) (Cache, error) {
+	u, err := url.Parse(URI)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == MemoryScheme {
+		return NewMemoryCache(u.Host, keyPrefix), nil
+	}
+
+	if u.Scheme == FileScheme {
+		// Allow relative paths such as file://cache.db
+		return NewFileCache(u.Host+u.Path, keyPrefix)
+	}
+
+	return NewRedisCache(URI, keyPrefix)
 }
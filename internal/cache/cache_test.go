@@ -0,0 +1,341 @@
+package cache
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCache runs the conformance tests that every Cache implementation must pass.
+// The caches returned by newCache for a same test must share the same backend
+func testCache(t *testing.T, newCache func(keyPrefix string) Cache) {
+	open := func(t *testing.T, keyPrefix string) Cache {
+		c := newCache(keyPrefix)
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	}
+
+	t.Run("Ping", func(t *testing.T) {
+		if err := open(t, "").Ping(); err != nil {
+			t.Errorf("error while pinging cache: %s", err)
+		}
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		c := open(t, "config")
+
+		if val, err := c.GetBytes("user"); err != nil || val != nil {
+			t.Errorf("unexpected value for missing key: %v (%v)", val, err)
+		}
+
+		if err := c.SetBytes("user", []byte("creekorful"), NoTTL); err != nil {
+			t.FailNow()
+		}
+
+		if val, err := c.GetBytes("user"); err != nil || string(val) != "creekorful" {
+			t.Errorf("wrong value: (got: %s, want: %s)", val, "creekorful")
+		}
+
+		// Caches are sharing the backend, but not the keys
+		if val, _ := open(t, "").GetBytes("config:user"); string(val) != "creekorful" {
+			t.Errorf("wrong value: (got: %s, want: %s)", val, "creekorful")
+		}
+		if val, _ := open(t, "url").GetBytes("user"); val != nil {
+			t.Errorf("wrong value: (got: %s, want: nil)", val)
+		}
+
+		if err := c.Remove("user"); err != nil {
+			t.FailNow()
+		}
+		if val, _ := c.GetBytes("user"); val != nil {
+			t.Errorf("removed key still exist: %s", val)
+		}
+	})
+
+	t.Run("ManyBytes", func(t *testing.T) {
+		c := open(t, "many-bytes")
+
+		if err := c.SetBytes("removed", []byte("value"), NoTTL); err != nil {
+			t.FailNow()
+		}
+
+		// A nil value removes the key
+		if err := c.SetManyBytes(map[string][]byte{"a": []byte("1"), "b": []byte("2"), "removed": nil}, NoTTL); err != nil {
+			t.FailNow()
+		}
+
+		if val, _ := c.GetBytes("a"); string(val) != "1" {
+			t.Errorf("wrong value: (got: %s, want: %s)", val, "1")
+		}
+		if val, _ := c.GetBytes("b"); string(val) != "2" {
+			t.Errorf("wrong value: (got: %s, want: %s)", val, "2")
+		}
+		if val, _ := c.GetBytes("removed"); val != nil {
+			t.Errorf("removed key still exist: %s", val)
+		}
+	})
+
+	t.Run("Keys", func(t *testing.T) {
+		c := open(t, "keys")
+
+		if keys, err := c.Keys(); err != nil || len(keys) != 0 {
+			t.Errorf("unexpected keys: %v (%v)", keys, err)
+		}
+
+		if err := c.SetManyInt64(map[string]int64{"a": 1, "b:c": 2}, NoTTL); err != nil {
+			t.FailNow()
+		}
+		if err := c.SetBytes("expiring", []byte("value"), 10*time.Millisecond); err != nil {
+			t.FailNow()
+		}
+		if err := c.SetScores("set", map[string]int64{"member": 1}); err != nil {
+			t.FailNow()
+		}
+		if err := open(t, "other").SetInt64("d", 1, NoTTL); err != nil {
+			t.FailNow()
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		// Only the (not expired) entries of the prefix are returned
+		keys, err := c.Keys()
+		if err != nil {
+			t.FailNow()
+		}
+		sort.Strings(keys)
+		if !reflect.DeepEqual(keys, []string{"a", "b:c"}) {
+			t.Errorf("wrong keys: %v", keys)
+		}
+	})
+
+	t.Run("Int64", func(t *testing.T) {
+		c := open(t, "int64")
+
+		if val, err := c.GetInt64("count"); err != nil || val != 0 {
+			t.Errorf("unexpected value for missing key: %d (%v)", val, err)
+		}
+
+		if err := c.SetInt64("count", 42, NoTTL); err != nil {
+			t.FailNow()
+		}
+		if val, err := c.GetInt64("count"); err != nil || val != 42 {
+			t.Errorf("wrong value: (got: %d, want: %d)", val, 42)
+		}
+
+		if err := c.SetManyInt64(map[string]int64{"a": 1, "b": -2}, NoTTL); err != nil {
+			t.FailNow()
+		}
+
+		values, err := c.GetManyInt64([]string{"a", "b", "c"})
+		if err != nil {
+			t.FailNow()
+		}
+		if len(values) != 2 || values["a"] != 1 || values["b"] != -2 {
+			t.Errorf("wrong values: %v", values)
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		c := open(t, "ttl")
+
+		if err := c.SetInt64("count", 1, 10*time.Millisecond); err != nil {
+			t.FailNow()
+		}
+		if err := c.SetManyInt64(map[string]int64{"a": 1}, 10*time.Millisecond); err != nil {
+			t.FailNow()
+		}
+		if err := c.SetBytes("forever", []byte("value"), NoTTL); err != nil {
+			t.FailNow()
+		}
+		if val, _ := c.GetInt64("count"); val != 1 {
+			t.Errorf("wrong value: (got: %d, want: %d)", val, 1)
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		if val, _ := c.GetInt64("count"); val != 0 {
+			t.Errorf("expired value still exist: %d", val)
+		}
+		if values, _ := c.GetManyInt64([]string{"count", "a"}); len(values) != 0 {
+			t.Errorf("expired value still exist: %v", values)
+		}
+		if val, _ := c.GetBytes("forever"); string(val) != "value" {
+			t.Errorf("wrong value: (got: %s, want: %s)", val, "value")
+		}
+	})
+
+	t.Run("Incr", func(t *testing.T) {
+		c := open(t, "incr")
+
+		if val, err := c.Incr("count", 30*time.Millisecond); err != nil || val != 1 {
+			t.Errorf("wrong value: %d %v", val, err)
+		}
+		if val, err := c.IncrBy("count", 5, time.Hour); err != nil || val != 6 {
+			t.Errorf("wrong value: %d %v", val, err)
+		}
+
+		// The TTL is set on creation only
+		time.Sleep(40 * time.Millisecond)
+
+		if val, _ := c.GetInt64("count"); val != 0 {
+			t.Errorf("expired value still exist: %d", val)
+		}
+
+		// Concurrent increments are not lost
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = c.Incr("concurrent", NoTTL)
+			}()
+		}
+		wg.Wait()
+
+		if val, _ := c.GetInt64("concurrent"); val != 10 {
+			t.Errorf("wrong value: %d", val)
+		}
+	})
+
+	t.Run("IncrExtend", func(t *testing.T) {
+		c := open(t, "incr-extend")
+
+		// The TTL is extended at each increment
+		for i := int64(1); i <= 3; i++ {
+			if val, err := c.IncrExtend("count", 40*time.Millisecond); err != nil || val != i {
+				t.Errorf("wrong value: %d %v", val, err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		if val, _ := c.GetInt64("count"); val != 3 {
+			t.Errorf("value should not be expired: %d", val)
+		}
+
+		time.Sleep(40 * time.Millisecond)
+
+		if val, _ := c.GetInt64("count"); val != 0 {
+			t.Errorf("expired value still exist: %d", val)
+		}
+	})
+
+	t.Run("SetManyNX", func(t *testing.T) {
+		c := open(t, "set-nx")
+
+		if err := c.SetInt64("a", 5, NoTTL); err != nil {
+			t.FailNow()
+		}
+
+		set, err := c.SetManyNX(map[string]int64{"a": 1, "b": 1}, NoTTL)
+		if err != nil {
+			t.FailNow()
+		}
+		if len(set) != 2 || set["a"] || !set["b"] {
+			t.Errorf("wrong set keys: %v", set)
+		}
+
+		if values, _ := c.GetManyInt64([]string{"a", "b"}); values["a"] != 5 || values["b"] != 1 {
+			t.Errorf("wrong values: %v", values)
+		}
+
+		// The expired keys may be set again
+		if _, err := c.SetManyNX(map[string]int64{"c": 1}, 10*time.Millisecond); err != nil {
+			t.FailNow()
+		}
+
+		time.Sleep(20 * time.Millisecond)
+
+		if set, _ := c.SetManyNX(map[string]int64{"c": 2}, NoTTL); !set["c"] {
+			t.Errorf("wrong set keys: %v", set)
+		}
+	})
+
+	t.Run("Throttle", func(t *testing.T) {
+		c := open(t, "rate-limit")
+		now := time.Now()
+
+		// Burst of two requests
+		for i := 0; i < 2; i++ {
+			if wait, err := c.Throttle("example.onion", now, 10*time.Second, 2); err != nil || wait != 0 {
+				t.Errorf("request %d should have been allowed: %s %v", i, wait, err)
+			}
+		}
+
+		// Bucket is empty: wait for a token
+		if wait, _ := c.Throttle("example.onion", now.Add(4*time.Second), 10*time.Second, 2); wait != 6*time.Second {
+			t.Errorf("wrong wait: (got: %s, want: %s)", wait, 6*time.Second)
+		}
+
+		// Token is available again
+		if wait, _ := c.Throttle("example.onion", now.Add(10*time.Second), 10*time.Second, 2); wait != 0 {
+			t.Errorf("request should have been allowed: %s", wait)
+		}
+
+		// Concurrent requests are not allowed more than the burst
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		allowed := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if wait, err := c.Throttle("concurrent.onion", now, time.Minute, 3); err == nil && wait == 0 {
+					mutex.Lock()
+					allowed++
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if allowed != 3 {
+			t.Errorf("wrong allowed requests: (got: %d, want: %d)", allowed, 3)
+		}
+	})
+
+	t.Run("SortedSet", func(t *testing.T) {
+		c := open(t, "frontier")
+
+		if err := c.SetScores("due", map[string]int64{"a": 30, "b": 10, "c": 20, "d": 50, "e": -5}); err != nil {
+			t.FailNow()
+		}
+		// Update a score
+		if err := c.SetScores("due", map[string]int64{"c": 40}); err != nil {
+			t.FailNow()
+		}
+
+		members, err := c.LeaseByScore("due", 40, 100, 3)
+		if err != nil {
+			t.FailNow()
+		}
+		if len(members) != 3 || members[0] != "e" || members[1] != "b" || members[2] != "a" {
+			t.Errorf("wrong members: %v", members)
+		}
+
+		// The leased members are not returned again
+		if members, _ := c.LeaseByScore("due", 40, 100, 10); len(members) != 1 || members[0] != "c" {
+			t.Errorf("wrong members: %v", members)
+		}
+		if members, _ := c.LeaseByScore("due", 99, 100, 10); len(members) != 1 || members[0] != "d" {
+			t.Errorf("wrong members: %v", members)
+		}
+		if members, _ := c.LeaseByScore("due", 100, 200, 10); len(members) != 5 {
+			t.Errorf("wrong members: %v", members)
+		}
+
+		// Removed members are not returned anymore
+		if err := c.RemoveScores("due", []string{"a", "c", "missing"}); err != nil {
+			t.FailNow()
+		}
+		if members, _ := c.LeaseByScore("due", 200, 300, 10); len(members) != 3 || members[0] != "b" || members[1] != "d" || members[2] != "e" {
+			t.Errorf("wrong members: %v", members)
+		}
+
+		// Sets are not shared between prefixes
+		if members, _ := open(t, "other").LeaseByScore("due", 200, 300, 10); len(members) != 0 {
+			t.Errorf("wrong members: %v", members)
+		}
+	})
+}
@@ -0,0 +1,580 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	entriesBucket = []byte("entries")
+	setsBucket    = []byte("sets")
+	membersBucket = []byte("members")
+	indexBucket   = []byte("index")
+)
+
+// fileSweepInterval is the interval at which the expired entries are purged from the database
+const fileSweepInterval = time.Minute
+
+var (
+	fileStoresMutex sync.Mutex
+	fileStores      = map[string]*fileStore{}
+)
+
+// fileStore is an on-disk database, shared by the caches of the process using the same file
+// since the database file is locked while opened
+type fileStore struct {
+	db   *bolt.DB
+	path string
+	refs int
+
+	// sweepStop stop the periodic purge of the expired entries, sweepDone is closed once stopped
+	sweepStop chan struct{}
+	sweepDone chan struct{}
+}
+
+// openFileStore returns the on-disk store at given path, opening (or creating) it if needed.
+// The store must be released once not used anymore.
+func openFileStore(path string) (*fileStore, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileStoresMutex.Lock()
+	defer fileStoresMutex.Unlock()
+
+	if store, exist := fileStores[path]; exist {
+		store.refs++
+		return store, nil
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error while opening %s: %s", path, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(setsBucket); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists(entriesBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("error while initializing %s: %s", path, err)
+	}
+
+	store := &fileStore{db: db, path: path, refs: 1, sweepStop: make(chan struct{}), sweepDone: make(chan struct{})}
+
+	// The expired entries are ignored on read, and purged periodically: purge the ones expired while stopped
+	if err := store.purge(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("error while purging %s: %s", path, err)
+	}
+
+	go store.sweep(fileSweepInterval)
+	fileStores[path] = store
+
+	return store, nil
+}
+
+// sweep purge the expired entries at given interval, until the store is closed
+func (s *fileStore) sweep(interval time.Duration) {
+	defer close(s.sweepDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.sweepStop:
+			return
+		case <-ticker.C:
+			if err := s.purge(); err != nil {
+				log.Err(err).Str("path", s.path).Msg("error while purging expired cache entries")
+			}
+		}
+	}
+}
+
+// purge removes the expired entries from the database
+func (s *fileStore) purge() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return purgeExpired(tx.Bucket(entriesBucket), time.Now())
+	})
+}
+
+// release close the store once released by every cache
+func (s *fileStore) release() error {
+	fileStoresMutex.Lock()
+	defer fileStoresMutex.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+
+	delete(fileStores, s.path)
+
+	close(s.sweepStop)
+	<-s.sweepDone
+
+	return s.db.Close()
+}
+
+type fileCache struct {
+	store     *fileStore
+	keyPrefix string
+	closeOnce sync.Once
+}
+
+// NewFileCache return a new Cache using an embedded on-disk database as backend,
+// its entries surviving restarts. Caches created with the same path share the same database.
+func NewFileCache(path string, keyPrefix string) (Cache, error) {
+	store, err := openFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileCache{
+		store:     store,
+		keyPrefix: keyPrefix,
+	}, nil
+}
+
+func (fc *fileCache) GetBytes(key string) ([]byte, error) {
+	var val []byte
+	err := fc.store.db.View(func(tx *bolt.Tx) error {
+		// Copy value since only valid during the transaction
+		if v, exist := getEntry(tx.Bucket(entriesBucket), fc.getKey(key), time.Now()); exist {
+			val = append([]byte{}, v...)
+		}
+		return nil
+	})
+
+	return val, err
+}
+
+func (fc *fileCache) SetBytes(key string, value []byte, TTL time.Duration) error {
+	return fc.store.db.Update(func(tx *bolt.Tx) error {
+		return putEntry(tx.Bucket(entriesBucket), fc.getKey(key), value, expiresAt(TTL))
+	})
+}
+
+func (fc *fileCache) SetManyBytes(values map[string][]byte, TTL time.Duration) error {
+	return fc.store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		for key, value := range values {
+			if value == nil {
+				if err := entries.Delete([]byte(fc.getKey(key))); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if err := putEntry(entries, fc.getKey(key), value, expiresAt(TTL)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (fc *fileCache) GetInt64(key string) (int64, error) {
+	var val int64
+	err := fc.store.db.View(func(tx *bolt.Tx) error {
+		v, err := getInt64(tx.Bucket(entriesBucket), fc.getKey(key), time.Now())
+		val = v
+		return err
+	})
+
+	return val, err
+}
+
+func (fc *fileCache) SetInt64(key string, value int64, TTL time.Duration) error {
+	return fc.SetBytes(key, []byte(strconv.FormatInt(value, 10)), TTL)
+}
+
+func (fc *fileCache) GetManyInt64(keys []string) (map[string]int64, error) {
+	values := map[string]int64{}
+	err := fc.store.db.View(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		now := time.Now()
+
+		for _, key := range keys {
+			if _, exist := getEntry(entries, fc.getKey(key), now); !exist {
+				continue
+			}
+
+			val, err := getInt64(entries, fc.getKey(key), now)
+			if err != nil {
+				return err
+			}
+
+			// Only returns entry if there's one
+			values[key] = val
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (fc *fileCache) SetManyInt64(values map[string]int64, TTL time.Duration) error {
+	return fc.store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		for key, value := range values {
+			if err := putEntry(entries, fc.getKey(key), []byte(strconv.FormatInt(value, 10)), expiresAt(TTL)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (fc *fileCache) Incr(key string, TTL time.Duration) (int64, error) {
+	return fc.IncrBy(key, 1, TTL)
+}
+
+func (fc *fileCache) IncrBy(key string, value int64, TTL time.Duration) (int64, error) {
+	var current int64
+	err := fc.store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		k := fc.getKey(key)
+		now := time.Now()
+
+		val, err := getInt64(entries, k, now)
+		if err != nil {
+			return err
+		}
+		current = val + value
+
+		// Keep the expiration of the existing entry
+		expiration := expiresAt(TTL)
+		if b := entries.Get([]byte(k)); b != nil && !expired(b, now) {
+			expiration = int64(binary.BigEndian.Uint64(b))
+		}
+
+		return putEntry(entries, k, []byte(strconv.FormatInt(current, 10)), expiration)
+	})
+
+	return current, err
+}
+
+func (fc *fileCache) IncrExtend(key string, TTL time.Duration) (int64, error) {
+	var current int64
+	err := fc.store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		k := fc.getKey(key)
+
+		val, err := getInt64(entries, k, time.Now())
+		if err != nil {
+			return err
+		}
+		current = val + 1
+
+		return putEntry(entries, k, []byte(strconv.FormatInt(current, 10)), expiresAt(TTL))
+	})
+
+	return current, err
+}
+
+func (fc *fileCache) SetManyNX(values map[string]int64, TTL time.Duration) (map[string]bool, error) {
+	set := map[string]bool{}
+	err := fc.store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		now := time.Now()
+
+		for key, value := range values {
+			if _, exist := getEntry(entries, fc.getKey(key), now); exist {
+				set[key] = false
+				continue
+			}
+
+			if err := putEntry(entries, fc.getKey(key), []byte(strconv.FormatInt(value, 10)), expiresAt(TTL)); err != nil {
+				return err
+			}
+			set[key] = true
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+func (fc *fileCache) Throttle(key string, now time.Time, interval time.Duration, burst int64) (time.Duration, error) {
+	var wait time.Duration
+	err := fc.store.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(entriesBucket)
+		k := fc.getKey(key)
+
+		tat, err := getInt64(entries, k, time.Now())
+		if err != nil {
+			return err
+		}
+
+		tat, wait = gcra(tat, now, interval, burst)
+		if wait > 0 {
+			return nil
+		}
+
+		return putEntry(entries, k, []byte(strconv.FormatInt(tat, 10)), expiresAt(time.Unix(0, tat).Sub(now)))
+	})
+
+	return wait, err
+}
+
+func (fc *fileCache) Remove(key string) error {
+	return fc.store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).Delete([]byte(fc.getKey(key)))
+	})
+}
+
+func (fc *fileCache) Keys() ([]string, error) {
+	var keys []string
+	err := fc.store.db.View(func(tx *bolt.Tx) error {
+		prefix := fc.getKey("")
+		now := time.Now()
+
+		// The keys are sorted, the ones of the cache are contiguous
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			if !expired(v, now) {
+				keys = append(keys, strings.TrimPrefix(string(k), prefix))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (fc *fileCache) SetScores(set string, scores map[string]int64) error {
+	return fc.store.db.Update(func(tx *bolt.Tx) error {
+		members, index, err := fc.sortedSet(tx, set)
+		if err != nil {
+			return err
+		}
+
+		for member, score := range scores {
+			if err := setScore(members, index, member, score); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (fc *fileCache) RemoveScores(set string, members []string) error {
+	return fc.store.db.Update(func(tx *bolt.Tx) error {
+		scores, index, err := fc.sortedSet(tx, set)
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			previous := scores.Get([]byte(member))
+			if previous == nil {
+				continue
+			}
+
+			if err := index.Delete(indexKey(decodeScore(previous), member)); err != nil {
+				return err
+			}
+			if err := scores.Delete([]byte(member)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (fc *fileCache) LeaseByScore(set string, max int64, lease int64, count int) ([]string, error) {
+	var due []string
+	err := fc.store.db.Update(func(tx *bolt.Tx) error {
+		members, index, err := fc.sortedSet(tx, set)
+		if err != nil {
+			return err
+		}
+
+		// The index is ordered by score then member, like redis
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil && len(due) < count; k, _ = c.Next() {
+			if decodeScore(k[:8]) > max {
+				break
+			}
+			due = append(due, string(k[8:]))
+		}
+
+		for _, member := range due {
+			if err := setScore(members, index, member, lease); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return due, nil
+}
+
+func (fc *fileCache) Ping() error {
+	return fc.store.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+// Close release the database, closed once released by every cache using it
+func (fc *fileCache) Close() error {
+	var err error
+	fc.closeOnce.Do(func() {
+		err = fc.store.release()
+	})
+
+	return err
+}
+
+// sortedSet returns the buckets of given sorted set: the score of the members, and the members indexed by score
+func (fc *fileCache) sortedSet(tx *bolt.Tx, set string) (*bolt.Bucket, *bolt.Bucket, error) {
+	bucket, err := tx.Bucket(setsBucket).CreateBucketIfNotExists([]byte(fc.getKey(set)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members, err := bucket.CreateBucketIfNotExists(membersBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index, err := bucket.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return members, index, nil
+}
+
+func (fc *fileCache) getKey(key string) string {
+	if fc.keyPrefix == "" {
+		return key
+	}
+
+	return fmt.Sprintf("%s:%s", fc.keyPrefix, key)
+}
+
+// setScore set the score of given member, updating the score index
+func setScore(members, index *bolt.Bucket, member string, score int64) error {
+	if previous := members.Get([]byte(member)); previous != nil {
+		if err := index.Delete(indexKey(decodeScore(previous), member)); err != nil {
+			return err
+		}
+	}
+
+	if err := members.Put([]byte(member), encodeScore(score)); err != nil {
+		return err
+	}
+
+	return index.Put(indexKey(score, member), []byte{})
+}
+
+func indexKey(score int64, member string) []byte {
+	return append(encodeScore(score), member...)
+}
+
+// encodeScore returns the big endian representation of given score, the sign bit flipped
+// so that the negative scores are ordered first
+func encodeScore(score int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(score)^(1<<63))
+	return b
+}
+
+func decodeScore(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+// The entries are stored as their expiration time (unix nano, zero if none) followed by their value
+
+func expiresAt(TTL time.Duration) int64 {
+	if TTL <= 0 {
+		return 0
+	}
+
+	return time.Now().Add(TTL).UnixNano()
+}
+
+func expired(entry []byte, now time.Time) bool {
+	expiration := int64(binary.BigEndian.Uint64(entry))
+	return expiration != 0 && expiration <= now.UnixNano()
+}
+
+func getEntry(entries *bolt.Bucket, key string, now time.Time) ([]byte, bool) {
+	entry := entries.Get([]byte(key))
+	if entry == nil || expired(entry, now) {
+		return nil, false
+	}
+
+	return entry[8:], true
+}
+
+func putEntry(entries *bolt.Bucket, key string, value []byte, expiration int64) error {
+	entry := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(entry, uint64(expiration))
+	copy(entry[8:], value)
+
+	return entries.Put([]byte(key), entry)
+}
+
+func getInt64(entries *bolt.Bucket, key string, now time.Time) (int64, error) {
+	val, exist := getEntry(entries, key, now)
+	if !exist {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+func purgeExpired(entries *bolt.Bucket, now time.Time) error {
+	var keys [][]byte
+	if err := entries.ForEach(func(k, v []byte) error {
+		if expired(v, now) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := entries.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
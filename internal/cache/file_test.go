@@ -0,0 +1,143 @@
+package cache
+
+import (
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileCache(t *testing.T) {
+	path := tempCachePath(t)
+
+	testCache(t, func(keyPrefix string) Cache {
+		c, err := NewFileCache(path, keyPrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
+
+func TestFileCache_Persistence(t *testing.T) {
+	path := tempCachePath(t)
+
+	c, err := NewFileCache(path, "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.SetManyInt64(map[string]int64{"a": 1, "b": 2}, NoTTL); err != nil {
+		t.FailNow()
+	}
+	if err := c.SetInt64("expiring", 1, 10*time.Millisecond); err != nil {
+		t.FailNow()
+	}
+	if err := c.SetScores("due", map[string]int64{"a": 10, "b": 20}); err != nil {
+		t.FailNow()
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The entries survive a restart, except the expired ones
+	c, err = NewFileCache(path, "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	values, err := c.GetManyInt64([]string{"a", "b", "expiring"})
+	if err != nil {
+		t.FailNow()
+	}
+	if len(values) != 2 || values["a"] != 1 || values["b"] != 2 {
+		t.Errorf("wrong values: %v", values)
+	}
+
+	if members, _ := c.LeaseByScore("due", 15, 100, 10); len(members) != 1 || members[0] != "a" {
+		t.Errorf("wrong members: %v", members)
+	}
+}
+
+func TestFileCache_SharedStore(t *testing.T) {
+	path := tempCachePath(t)
+
+	c1, err := NewFileCache(path, "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := NewFileCache(path, "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	if err := c1.SetInt64("count", 42, NoTTL); err != nil {
+		t.FailNow()
+	}
+
+	// Closing a cache does not close the database used by the others
+	if err := c1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c2.Ping(); err != nil {
+		t.Errorf("error while pinging cache: %s", err)
+	}
+	if val, err := c2.GetInt64("count"); err != nil || val != 42 {
+		t.Errorf("wrong value: %d %v", val, err)
+	}
+}
+
+func TestFileCache_Purge(t *testing.T) {
+	c, err := NewFileCache(tempCachePath(t), "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.SetInt64("expiring", 1, 10*time.Millisecond); err != nil {
+		t.FailNow()
+	}
+	if err := c.SetInt64("forever", 1, NoTTL); err != nil {
+		t.FailNow()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// The expired entries are removed from the database, not only ignored
+	store := c.(*fileCache).store
+	if err := store.purge(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	_ = store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	if len(keys) != 1 || keys[0] != "url:forever" {
+		t.Errorf("wrong keys: %v", keys)
+	}
+}
+
+// tempCachePath returns the path of a cache file in a temporary directory, removed once the test ends
+func tempCachePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "cache.db")
+}
@@ -0,0 +1,25 @@
+package cache
+
+import "time"
+
+// gcra applies the generic cell rate algorithm: the requests are spaced by interval, up to burst requests
+// being allowed at once. Given the theoretical arrival time of the next request (unix nano, zero if none),
+// it returns the new one and zero if a request is allowed at now, or how long to wait otherwise
+func gcra(tat int64, now time.Time, interval time.Duration, burst int64) (int64, time.Duration) {
+	if burst < 1 {
+		burst = 1
+	}
+	tolerance := interval * time.Duration(burst-1)
+
+	theoretical := time.Unix(0, tat)
+	if theoretical.Before(now) {
+		theoretical = now
+	}
+
+	// The bucket is empty
+	if allowAt := theoretical.Add(-tolerance); now.Before(allowAt) {
+		return tat, allowAt.Sub(now)
+	}
+
+	return theoretical.Add(interval).UnixNano(), 0
+}
@@ -0,0 +1,390 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expireSampleSize is the number of entries checked for expiration on each write
+const expireSampleSize = 20
+
+var (
+	memoryStoresMutex sync.Mutex
+	memoryStores      = map[string]*memoryStore{}
+)
+
+// getMemoryStore returns the in-process store with given name, creating it if needed.
+// Every cache using the same name share the same store.
+func getMemoryStore(name string) *memoryStore {
+	memoryStoresMutex.Lock()
+	defer memoryStoresMutex.Unlock()
+
+	store, exist := memoryStores[name]
+	if !exist {
+		store = &memoryStore{entries: map[string]memoryEntry{}, sets: map[string]map[string]int64{}}
+		memoryStores[name] = store
+	}
+
+	return store
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+type memoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]memoryEntry
+	// sets are the sorted sets: the score of the members, indexed by set name
+	sets map[string]map[string]int64
+}
+
+// get returns the value of given key, expired entries are removed lazily (see expireSample)
+func (s *memoryStore) get(key string) ([]byte, bool) {
+	entry, exist := s.entries[key]
+	if !exist {
+		return nil, false
+	}
+
+	if entry.expired(time.Now()) {
+		delete(s.entries, key)
+		return nil, false
+	}
+
+	return entry.value, true
+}
+
+func (s *memoryStore) set(key string, value []byte, TTL time.Duration) {
+	now := time.Now()
+
+	entry := memoryEntry{value: value}
+	if TTL > 0 {
+		entry.expiresAt = now.Add(TTL)
+	}
+
+	s.entries[key] = entry
+	s.expireSample(now)
+}
+
+// expireSample removes the expired entries among a few random ones (the map iteration order being random),
+// like redis does, so that the entries written once and never read again do not pile up
+func (s *memoryStore) expireSample(now time.Time) {
+	checked := 0
+	for key, entry := range s.entries {
+		if checked == expireSampleSize {
+			return
+		}
+		checked++
+
+		if entry.expired(now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+type memoryCache struct {
+	store     *memoryStore
+	keyPrefix string
+}
+
+// NewMemoryCache return a new Cache using an in-process store as backend.
+// Caches created with the same name share the same store.
+func NewMemoryCache(name string, keyPrefix string) Cache {
+	return &memoryCache{
+		store:     getMemoryStore(name),
+		keyPrefix: keyPrefix,
+	}
+}
+
+func (mc *memoryCache) GetBytes(key string) ([]byte, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	val, _ := mc.store.get(mc.getKey(key))
+	return val, nil
+}
+
+func (mc *memoryCache) SetBytes(key string, value []byte, TTL time.Duration) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	// Copy value to prevent caller from updating it
+	b := make([]byte, len(value))
+	copy(b, value)
+
+	mc.store.set(mc.getKey(key), b, TTL)
+	return nil
+}
+
+func (mc *memoryCache) SetManyBytes(values map[string][]byte, TTL time.Duration) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	for key, value := range values {
+		if value == nil {
+			delete(mc.store.entries, mc.getKey(key))
+			continue
+		}
+
+		b := make([]byte, len(value))
+		copy(b, value)
+
+		mc.store.set(mc.getKey(key), b, TTL)
+	}
+
+	return nil
+}
+
+func (mc *memoryCache) GetInt64(key string) (int64, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	return mc.getInt64(mc.getKey(key))
+}
+
+func (mc *memoryCache) SetInt64(key string, value int64, TTL time.Duration) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	mc.store.set(mc.getKey(key), []byte(strconv.FormatInt(value, 10)), TTL)
+	return nil
+}
+
+func (mc *memoryCache) GetManyInt64(keys []string) (map[string]int64, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	values := map[string]int64{}
+	for _, key := range keys {
+		if _, exist := mc.store.get(mc.getKey(key)); !exist {
+			continue
+		}
+
+		val, err := mc.getInt64(mc.getKey(key))
+		if err != nil {
+			return nil, err
+		}
+
+		// Only returns entry if there's one
+		values[key] = val
+	}
+
+	return values, nil
+}
+
+func (mc *memoryCache) SetManyInt64(values map[string]int64, TTL time.Duration) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	for key, value := range values {
+		mc.store.set(mc.getKey(key), []byte(strconv.FormatInt(value, 10)), TTL)
+	}
+
+	return nil
+}
+
+func (mc *memoryCache) Incr(key string, TTL time.Duration) (int64, error) {
+	return mc.IncrBy(key, 1, TTL)
+}
+
+func (mc *memoryCache) IncrBy(key string, value int64, TTL time.Duration) (int64, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	k := mc.getKey(key)
+
+	current, err := mc.getInt64(k)
+	if err != nil {
+		return 0, err
+	}
+	current += value
+
+	// Keep the expiration of the existing entry
+	if _, exist := mc.store.get(k); exist {
+		entry := mc.store.entries[k]
+		entry.value = []byte(strconv.FormatInt(current, 10))
+		mc.store.entries[k] = entry
+	} else {
+		mc.store.set(k, []byte(strconv.FormatInt(current, 10)), TTL)
+	}
+
+	return current, nil
+}
+
+func (mc *memoryCache) IncrExtend(key string, TTL time.Duration) (int64, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	k := mc.getKey(key)
+
+	current, err := mc.getInt64(k)
+	if err != nil {
+		return 0, err
+	}
+	current++
+
+	mc.store.set(k, []byte(strconv.FormatInt(current, 10)), TTL)
+
+	return current, nil
+}
+
+func (mc *memoryCache) SetManyNX(values map[string]int64, TTL time.Duration) (map[string]bool, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	set := map[string]bool{}
+	for key, value := range values {
+		if _, exist := mc.store.get(mc.getKey(key)); exist {
+			set[key] = false
+			continue
+		}
+
+		mc.store.set(mc.getKey(key), []byte(strconv.FormatInt(value, 10)), TTL)
+		set[key] = true
+	}
+
+	return set, nil
+}
+
+func (mc *memoryCache) Throttle(key string, now time.Time, interval time.Duration, burst int64) (time.Duration, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	k := mc.getKey(key)
+
+	tat, err := mc.getInt64(k)
+	if err != nil {
+		return 0, err
+	}
+
+	tat, wait := gcra(tat, now, interval, burst)
+	if wait > 0 {
+		return wait, nil
+	}
+
+	mc.store.set(k, []byte(strconv.FormatInt(tat, 10)), time.Unix(0, tat).Sub(now))
+	return 0, nil
+}
+
+func (mc *memoryCache) Remove(key string) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	delete(mc.store.entries, mc.getKey(key))
+	return nil
+}
+
+func (mc *memoryCache) Keys() ([]string, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	prefix := mc.getKey("")
+	now := time.Now()
+
+	var keys []string
+	for key, entry := range mc.store.entries {
+		if !strings.HasPrefix(key, prefix) || entry.expired(now) {
+			continue
+		}
+		keys = append(keys, strings.TrimPrefix(key, prefix))
+	}
+
+	return keys, nil
+}
+
+func (mc *memoryCache) SetScores(set string, scores map[string]int64) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	members, exist := mc.store.sets[mc.getKey(set)]
+	if !exist {
+		members = map[string]int64{}
+		mc.store.sets[mc.getKey(set)] = members
+	}
+
+	for member, score := range scores {
+		members[member] = score
+	}
+
+	return nil
+}
+
+func (mc *memoryCache) RemoveScores(set string, members []string) error {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	scores := mc.store.sets[mc.getKey(set)]
+	for _, member := range members {
+		delete(scores, member)
+	}
+
+	return nil
+}
+
+func (mc *memoryCache) LeaseByScore(set string, max int64, lease int64, count int) ([]string, error) {
+	mc.store.mutex.Lock()
+	defer mc.store.mutex.Unlock()
+
+	members := mc.store.sets[mc.getKey(set)]
+
+	var due []string
+	for member, score := range members {
+		if score <= max {
+			due = append(due, member)
+		}
+	}
+
+	// Lowest score first, like redis
+	sort.Slice(due, func(i, j int) bool {
+		if members[due[i]] != members[due[j]] {
+			return members[due[i]] < members[due[j]]
+		}
+		return due[i] < due[j]
+	})
+
+	if len(due) > count {
+		due = due[:count]
+	}
+
+	for _, member := range due {
+		members[member] = lease
+	}
+
+	return due, nil
+}
+
+func (mc *memoryCache) Ping() error {
+	return nil
+}
+
+// Close is a no-op: the store is shared by the caches of the process
+func (mc *memoryCache) Close() error {
+	return nil
+}
+
+// getInt64 must be called with the store mutex held
+func (mc *memoryCache) getInt64(key string) (int64, error) {
+	val, exist := mc.store.get(key)
+	if !exist {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+func (mc *memoryCache) getKey(key string) string {
+	if mc.keyPrefix == "" {
+		return key
+	}
+
+	return fmt.Sprintf("%s:%s", mc.keyPrefix, key)
+}
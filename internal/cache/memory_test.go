@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	// Use a new store for each run
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+
+	testCache(t, func(keyPrefix string) Cache {
+		return NewMemoryCache(name, keyPrefix)
+	})
+}
+
+func TestMemoryCache_SharedStore(t *testing.T) {
+	if err := NewMemoryCache("shared", "url").SetInt64("count", 42, NoTTL); err != nil {
+		t.FailNow()
+	}
+
+	if val, _ := NewMemoryCache("shared", "url").GetInt64("count"); val != 42 {
+		t.Errorf("wrong value: (got: %d, want: %d)", val, 42)
+	}
+	if val, _ := NewMemoryCache("other", "url").GetInt64("count"); val != 0 {
+		t.Errorf("stores should not be shared: %d", val)
+	}
+}
+
+func TestMemoryCache_ExpireSample(t *testing.T) {
+	name := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	c := NewMemoryCache(name, "url")
+
+	for i := 0; i < 1000; i++ {
+		if err := c.SetInt64(fmt.Sprintf("expiring-%d", i), 1, time.Millisecond); err != nil {
+			t.FailNow()
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	// The expired entries are removed while writing, even if never read again
+	for i := 0; i < 1000; i++ {
+		if err := c.SetInt64(fmt.Sprintf("kept-%d", i), 1, NoTTL); err != nil {
+			t.FailNow()
+		}
+	}
+
+	store := getMemoryStore(name)
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	if len(store.entries) > 1100 {
+		t.Errorf("expired entries have not been removed: %d entries", len(store.entries))
+	}
+}
+
+func TestNewCache(t *testing.T) {
+	c, err := NewCache("memory://test", "url")
+	if err != nil {
+		t.FailNow()
+	}
+	if _, ok := c.(*memoryCache); !ok {
+		t.Errorf("wrong cache type: %T", c)
+	}
+
+	c, err = NewCache("file://"+tempCachePath(t), "url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.(*fileCache); !ok {
+		t.Errorf("wrong cache type: %T", c)
+	}
+
+	for _, URI := range []string{"redis://redis:6379", "redis-sentinel://sentinel:26379/bathyscaphe", "redis-cluster://redis:6379"} {
+		c, err = NewCache(URI, "url")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.(*redisCache); !ok {
+			t.Errorf("wrong cache type: %T", c)
+		}
+		_ = c.Close()
+	}
+}
@@ -2,32 +2,126 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-redis/redis/v8"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+// leaseScript returns the members of the sorted set KEYS[1] with a score lower than or equal to ARGV[1]
+// (up to ARGV[3] members) and set their score to ARGV[2], atomically so that a member is leased only once
+var leaseScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, member in ipairs(members) do
+  redis.call('ZADD', KEYS[1], ARGV[2], member)
+end
+return members
+`)
+
+// incrScript increments the key KEYS[1] by ARGV[1] and set its TTL to ARGV[2] milliseconds if it has none,
+// atomically so that concurrent increments are not lost and the TTL is only set on creation
+var incrScript = redis.NewScript(`
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('PTTL', KEYS[1]) == -1 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return value
+`)
+
+// incrExtendScript increments the key KEYS[1] by one and set its TTL to ARGV[1] milliseconds, atomically
+// so that the key does not expire between the increment and the TTL update
+var incrExtendScript = redis.NewScript(`
+local value = redis.call('INCR', KEYS[1])
+if tonumber(ARGV[1]) > 0 then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return value
+`)
+
+// throttleScript applies the GCRA rate limiting on the key KEYS[1], holding the theoretical arrival time
+// of the next request. The current time ARGV[1] and the interval ARGV[2] are in milliseconds (exact in Lua numbers),
+// up to ARGV[3] requests are allowed at once. It returns 0 and accounts the request if allowed,
+// or the milliseconds to wait otherwise, atomically so that the replicas share the same bucket
+var throttleScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local tolerance = interval * (tonumber(ARGV[3]) - 1)
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+  tat = now
+end
+if now < tat - tolerance then
+  return tat - tolerance - now
+end
+redis.call('SET', KEYS[1], tat + interval, 'PX', math.max(tat + interval - now, 1))
+return 0
+`)
+
+const (
+	// RedisSentinelScheme is the URI scheme used to select a redis master monitored by sentinels:
+	// redis-sentinel://[user:password@]host:port[,host:port...]/master-name[/db][?sentinel-password=password]
+	RedisSentinelScheme = "redis-sentinel"
+	// RedisClusterScheme is the URI scheme used to select a redis cluster:
+	// redis-cluster://[user:password@]host:port[,host:port...]
+	RedisClusterScheme = "redis-cluster"
+)
+
+var (
+	errNoMasterName  = errors.New("missing sentinel master name")
+	errClusterDBPath = errors.New("redis cluster does not support database selection")
+)
+
 type redisCache struct {
-	client    *redis.Client
+	client    redis.UniversalClient
 	keyPrefix string
 }
 
-// NewRedisCache return a new Cache using redis as backend
+// NewRedisCache return a new Cache using redis as backend, either a single node (redis://),
+// a master monitored by sentinels (redis-sentinel://) or a cluster (redis-cluster://)
 func NewRedisCache(URI string, keyPrefix string) (Cache, error) {
-	opts, err := parseRedisOpts(URI)
+	client, err := newRedisClient(URI)
 	if err != nil {
 		return nil, err
 	}
 
 	return &redisCache{
-		client:    redis.NewClient(opts),
+		client:    client,
 		keyPrefix: keyPrefix,
 	}, nil
 }
 
+func newRedisClient(URI string) (redis.UniversalClient, error) {
+	u, err := url.Parse(URI)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case RedisSentinelScheme:
+		opts, err := parseRedisSentinelOpts(URI)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewFailoverClient(opts), nil
+	case RedisClusterScheme:
+		opts, err := parseRedisClusterOpts(URI)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClusterClient(opts), nil
+	default:
+		opts, err := parseRedisOpts(URI)
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewClient(opts), nil
+	}
+}
+
 func (rc *redisCache) GetBytes(key string) ([]byte, error) {
 	val, err := rc.client.Get(context.Background(), rc.getKey(key)).Bytes()
 	if err != nil && err != redis.Nil {
@@ -41,6 +135,22 @@ func (rc *redisCache) SetBytes(key string, value []byte, TTL time.Duration) erro
 	return rc.client.Set(context.Background(), rc.getKey(key), value, TTL).Err()
 }
 
+func (rc *redisCache) SetManyBytes(values map[string][]byte, TTL time.Duration) error {
+	// In a cluster, the transaction is only atomic for the keys of a same slot
+	pipeline := rc.client.TxPipeline()
+
+	for key, value := range values {
+		if value == nil {
+			pipeline.Del(context.Background(), rc.getKey(key))
+		} else {
+			pipeline.Set(context.Background(), rc.getKey(key), value, TTL)
+		}
+	}
+
+	_, err := pipeline.Exec(context.Background())
+	return err
+}
+
 func (rc *redisCache) GetInt64(key string) (int64, error) {
 	val, err := rc.client.Get(context.Background(), rc.getKey(key)).Int64()
 	if err != nil && err != redis.Nil {
@@ -87,7 +197,14 @@ func (rc *redisCache) GetManyInt64(keys []string) (map[string]int64, error) {
 }
 
 func (rc *redisCache) SetManyInt64(values map[string]int64, TTL time.Duration) error {
-	pipeline := rc.client.TxPipeline()
+	// In a cluster, a pipeline is sent at once to each node while a transaction is executed slot by slot,
+	// and only atomic for the keys of a same slot anyway
+	var pipeline redis.Pipeliner
+	if _, cluster := rc.client.(*redis.ClusterClient); cluster {
+		pipeline = rc.client.Pipeline()
+	} else {
+		pipeline = rc.client.TxPipeline()
+	}
 
 	for key, value := range values {
 		pipeline.Set(context.Background(), rc.getKey(key), value, TTL)
@@ -97,10 +214,178 @@ func (rc *redisCache) SetManyInt64(values map[string]int64, TTL time.Duration) e
 	return err
 }
 
+func (rc *redisCache) Incr(key string, TTL time.Duration) (int64, error) {
+	return rc.IncrBy(key, 1, TTL)
+}
+
+func (rc *redisCache) IncrBy(key string, value int64, TTL time.Duration) (int64, error) {
+	return incrScript.Run(context.Background(), rc.client, []string{rc.getKey(key)}, value, TTL.Milliseconds()).Int64()
+}
+
+func (rc *redisCache) IncrExtend(key string, TTL time.Duration) (int64, error) {
+	return incrExtendScript.Run(context.Background(), rc.client, []string{rc.getKey(key)}, TTL.Milliseconds()).Int64()
+}
+
+func (rc *redisCache) SetManyNX(values map[string]int64, TTL time.Duration) (map[string]bool, error) {
+	// Each SETNX is atomic by itself, no need for a transaction
+	pipeline := rc.client.Pipeline()
+
+	// Execute commands and keep pointer to them
+	commands := map[string]*redis.BoolCmd{}
+	for key, value := range values {
+		commands[key] = pipeline.SetNX(context.Background(), rc.getKey(key), value, TTL)
+	}
+
+	if _, err := pipeline.Exec(context.Background()); err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+	for key, cmd := range commands {
+		set[key] = cmd.Val()
+	}
+
+	return set, nil
+}
+
+func (rc *redisCache) Throttle(key string, now time.Time, interval time.Duration, burst int64) (time.Duration, error) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	wait, err := throttleScript.Run(context.Background(), rc.client, []string{rc.getKey(key)},
+		now.UnixNano()/int64(time.Millisecond), interval.Milliseconds(), burst).Int64()
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
 func (rc *redisCache) Remove(key string) error {
 	return rc.client.Del(context.Background(), rc.getKey(key)).Err()
 }
 
+func (rc *redisCache) Keys() ([]string, error) {
+	ctx := context.Background()
+	prefix := rc.getKey("")
+
+	var mutex sync.Mutex
+	var keys []string
+	scan := func(ctx context.Context, client *redis.Client) error {
+		var found []string
+		it := client.Scan(ctx, 0, escapePattern(prefix)+"*", 100).Iterator()
+		for it.Next(ctx) {
+			found = append(found, it.Val())
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+
+		mutex.Lock()
+		defer mutex.Unlock()
+		keys = append(keys, found...)
+
+		return nil
+	}
+
+	switch client := rc.client.(type) {
+	case *redis.ClusterClient:
+		// The keys of a cluster are spread across the masters
+		if err := client.ForEachMaster(ctx, scan); err != nil {
+			return nil, err
+		}
+	case *redis.Client:
+		if err := scan(ctx, client); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported redis client: %T", rc.client)
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	// Skip the sorted sets
+	pipeline := rc.client.Pipeline()
+	types := map[string]*redis.StatusCmd{}
+	for _, key := range keys {
+		types[key] = pipeline.Type(ctx, key)
+	}
+	if _, err := pipeline.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for _, key := range keys {
+		if types[key].Val() == "string" {
+			entries = append(entries, strings.TrimPrefix(key, prefix))
+		}
+	}
+
+	return entries, nil
+}
+
+func (rc *redisCache) SetScores(set string, scores map[string]int64) error {
+	if len(scores) == 0 {
+		return nil
+	}
+
+	var members []*redis.Z
+	for member, score := range scores {
+		members = append(members, &redis.Z{Score: float64(score), Member: member})
+	}
+
+	return rc.client.ZAdd(context.Background(), rc.getKey(set), members...).Err()
+}
+
+func (rc *redisCache) RemoveScores(set string, members []string) error {
+	if len(members) == 0 {
+		return nil
+	}
+
+	values := make([]interface{}, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+
+	return rc.client.ZRem(context.Background(), rc.getKey(set), values...).Err()
+}
+
+func (rc *redisCache) LeaseByScore(set string, max int64, lease int64, count int) ([]string, error) {
+	res, err := leaseScript.Run(context.Background(), rc.client, []string{rc.getKey(set)}, max, lease, count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := res.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected lease result: %v", res)
+	}
+
+	var members []string
+	for _, value := range values {
+		member, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected lease member: %v", value)
+		}
+		members = append(members, member)
+	}
+
+	return members, nil
+}
+
+func (rc *redisCache) Ping() error {
+	return rc.client.Ping(context.Background()).Err()
+}
+
+func (rc *redisCache) Close() error {
+	return rc.client.Close()
+}
+
+// getKey returns the key namespaced by the cache prefix. The prefix is not a hash tag, so that in a cluster
+// the keys of a same namespace are spread across the slots (the commands using several keys are split by node)
 func (rc *redisCache) getKey(key string) string {
 	if rc.keyPrefix == "" {
 		return key
@@ -109,22 +394,26 @@ func (rc *redisCache) getKey(key string) string {
 	return fmt.Sprintf("%s:%s", rc.keyPrefix, key)
 }
 
+// escapePattern escapes the glob-style special characters of given SCAN pattern
+func escapePattern(pattern string) string {
+	var b strings.Builder
+	for _, c := range pattern {
+		if strings.ContainsRune(`*?[]^\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
 func parseRedisOpts(URL string) (*redis.Options, error) {
 	u, err := url.Parse(URL)
 	if err != nil {
 		return nil, err
 	}
 
-	username := "default"
-	password := ""
-	if u := u.User; u != nil {
-		if u.Username() != "" {
-			username = u.Username()
-		}
-		if pass, exist := u.Password(); exist {
-			password = pass
-		}
-	}
+	username, password := parseRedisCredentials(u)
 
 	db := 0
 	if u.Path != "/" {
@@ -140,3 +429,68 @@ func parseRedisOpts(URL string) (*redis.Options, error) {
 		DB:       db,
 	}, nil
 }
+
+func parseRedisSentinelOpts(URL string) (*redis.FailoverOptions, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password := parseRedisCredentials(u)
+
+	// The path is /master-name[/db]
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if parts[0] == "" {
+		return nil, errNoMasterName
+	}
+
+	db := 0
+	if len(parts) > 1 {
+		if val, err := strconv.Atoi(parts[1]); err == nil {
+			db = val
+		}
+	}
+
+	return &redis.FailoverOptions{
+		MasterName:       parts[0],
+		SentinelAddrs:    strings.Split(u.Host, ","),
+		SentinelPassword: u.Query().Get("sentinel-password"),
+		Username:         username,
+		Password:         password,
+		DB:               db,
+	}, nil
+}
+
+func parseRedisClusterOpts(URL string) (*redis.ClusterOptions, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.Trim(u.Path, "/") != "" {
+		return nil, errClusterDBPath
+	}
+
+	username, password := parseRedisCredentials(u)
+
+	return &redis.ClusterOptions{
+		Addrs:    strings.Split(u.Host, ","),
+		Username: username,
+		Password: password,
+	}, nil
+}
+
+func parseRedisCredentials(u *url.URL) (string, string) {
+	username := "default"
+	password := ""
+	if u := u.User; u != nil {
+		if u.Username() != "" {
+			username = u.Username()
+		}
+		if pass, exist := u.Password(); exist {
+			password = pass
+		}
+	}
+
+	return username, password
+}
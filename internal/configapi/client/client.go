@@ -10,6 +10,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -23,8 +24,35 @@ const (
 	RefreshDelayKey = "refresh-delay"
 	// BlackListConfigKey is the key to access the blacklist configuration
 	BlackListConfigKey = "blacklist-config"
+	// RobotsTxtKey is the key to access the robots.txt configuration
+	RobotsTxtKey = "robots-txt"
+	// RateLimitKey is the key to access the rate limit configuration
+	RateLimitKey = "rate-limit"
+	// CrawlLimitsKey is the key to access the crawl limits configuration
+	CrawlLimitsKey = "crawl-limits"
+
+	// RobotsTxtObey means the robots.txt are fetched and honoured
+	RobotsTxtObey = "obey"
+	// RobotsTxtIgnore means the robots.txt are not fetched at all
+	RobotsTxtIgnore = "ignore"
+	// RobotsTxtRecord means the robots.txt are fetched and violations logged, but not honoured
+	RobotsTxtRecord = "record"
+
+	// pingTimeout is the maximum duration of a ConfigAPI availability check
+	pingTimeout = 2 * time.Second
 )
 
+// ManagedKeys are the configuration keys read by the components
+var ManagedKeys = []string{
+	AllowedMimeTypesKey,
+	ForbiddenHostnamesKey,
+	RefreshDelayKey,
+	BlackListConfigKey,
+	RobotsTxtKey,
+	RateLimitKey,
+	CrawlLimitsKey,
+}
+
 // MimeType is the mime type as represented in the config
 type MimeType struct {
 	// The content-type
@@ -41,6 +69,27 @@ type ForbiddenHostname struct {
 // RefreshDelay is the refresh delay for re-crawling
 type RefreshDelay struct {
 	Delay time.Duration `json:"delay"`
+	// MinDelay and MaxDelay bound the per URL delay, adapted to how often the URL content changes.
+	// The delay is not adapted unless both are set
+	MinDelay time.Duration `json:"min-delay"`
+	MaxDelay time.Duration `json:"max-delay"`
+}
+
+// Adaptive returns true if the delay is adapted per URL
+func (r *RefreshDelay) Adaptive() bool {
+	return r.MinDelay > 0 && r.MaxDelay > 0
+}
+
+// Bound returns given delay bounded by the minimum & maximum delay
+func (r *RefreshDelay) Bound(delay time.Duration) time.Duration {
+	if delay < r.MinDelay {
+		return r.MinDelay
+	}
+	if delay > r.MaxDelay {
+		return r.MaxDelay
+	}
+
+	return delay
 }
 
 // BlackListConfig is the config used for hostname blacklisting
@@ -49,14 +98,69 @@ type BlackListConfig struct {
 	TTL       time.Duration `json:"ttl"`
 }
 
+// RobotsTxtConfig is the config used to handle the hostnames robots.txt
+type RobotsTxtConfig struct {
+	// Mode is either obey, ignore or record
+	Mode string        `json:"mode"`
+	TTL  time.Duration `json:"ttl"`
+}
+
+// RateLimit is the crawling rate allowed for an hostname
+type RateLimit struct {
+	// Interval is the delay between two requests, zero means unlimited
+	Interval time.Duration `json:"interval"`
+	// Burst is the number of requests that may be sent at once
+	Burst int64 `json:"burst"`
+}
+
+// RateLimitConfig is the config used to limit the crawling rate of the hostnames
+type RateLimitConfig struct {
+	Default RateLimit `json:"default"`
+	// Hostnames are the per hostname overrides
+	Hostnames map[string]RateLimit `json:"hostnames"`
+}
+
+// GetRateLimit returns the rate limit applying to given hostname (and its subdomains)
+func (c *RateLimitConfig) GetRateLimit(hostname string) RateLimit {
+	for {
+		if rateLimit, exist := c.Hostnames[hostname]; exist {
+			return rateLimit
+		}
+
+		// Lookup parent domain
+		idx := strings.Index(hostname, ".")
+		if idx < 0 {
+			return c.Default
+		}
+		hostname = hostname[idx+1:]
+	}
+}
+
+// CrawlLimits is the config used to bound the crawling
+type CrawlLimits struct {
+	// MaxDepth is the maximum distance (in links) from the seed, zero means unlimited
+	MaxDepth int64 `json:"max-depth"`
+	// HostnameBudget is the number of pages that may be scheduled per hostname
+	// during the budget period, zero means unlimited
+	HostnameBudget int64 `json:"hostname-budget"`
+	// BudgetPeriod is the period after which the hostname page budget is reset, one day if not set
+	BudgetPeriod time.Duration `json:"budget-period"`
+}
+
 // Client is a nice client interface for the ConfigAPI
 type Client interface {
 	GetAllowedMimeTypes() ([]MimeType, error)
 	GetForbiddenHostnames() ([]ForbiddenHostname, error)
 	GetRefreshDelay() (RefreshDelay, error)
 	GetBlackListConfig() (BlackListConfig, error)
+	GetRobotsTxtConfig() (RobotsTxtConfig, error)
+	GetRateLimitConfig() (RateLimitConfig, error)
+	GetCrawlLimits() (CrawlLimits, error)
 
 	Set(key string, value interface{}) error
+
+	// Ping returns an error if the ConfigAPI is not reachable
+	Ping() error
 }
 
 type client struct {
@@ -64,12 +168,17 @@ type client struct {
 	sub          event.Subscriber
 	mutexes      map[string]*sync.RWMutex
 	keys         []string
+	// pingClient has a short timeout so that an hung ConfigAPI does not hang the readiness checks
+	pingClient *http.Client
 
 	forbiddenMimeTypes []MimeType
 	allowedMimeTypes   []MimeType
 	forbiddenHostnames []ForbiddenHostname
 	refreshDelay       RefreshDelay
 	blackListConfig    BlackListConfig
+	robotsTxtConfig    RobotsTxtConfig
+	rateLimitConfig    RateLimitConfig
+	crawlLimits        CrawlLimits
 }
 
 // NewConfigClient create a new client for the ConfigAPI.
@@ -79,6 +188,7 @@ func NewConfigClient(configAPIURL string, subscriber event.Subscriber, keys []st
 		sub:          subscriber,
 		mutexes:      map[string]*sync.RWMutex{},
 		keys:         keys,
+		pingClient:   &http.Client{Timeout: pingTimeout},
 	}
 
 	// Pre-load wanted keys & create mutex
@@ -170,6 +280,70 @@ func (c *client) setBlackListConfig(value BlackListConfig) error {
 	return nil
 }
 
+func (c *client) GetRobotsTxtConfig() (RobotsTxtConfig, error) {
+	c.mutexes[RobotsTxtKey].RLock()
+	defer c.mutexes[RobotsTxtKey].RUnlock()
+
+	return c.robotsTxtConfig, nil
+}
+
+func (c *client) setRobotsTxtConfig(value RobotsTxtConfig) error {
+	c.mutexes[RobotsTxtKey].Lock()
+	defer c.mutexes[RobotsTxtKey].Unlock()
+
+	c.robotsTxtConfig = RobotsTxtConfig{
+		Mode: value.Mode,
+		TTL:  value.TTL * time.Second, // TTL is in seconds
+	}
+
+	return nil
+}
+
+func (c *client) GetRateLimitConfig() (RateLimitConfig, error) {
+	c.mutexes[RateLimitKey].RLock()
+	defer c.mutexes[RateLimitKey].RUnlock()
+
+	return c.rateLimitConfig, nil
+}
+
+func (c *client) setRateLimitConfig(value RateLimitConfig) error {
+	c.mutexes[RateLimitKey].Lock()
+	defer c.mutexes[RateLimitKey].Unlock()
+
+	// Intervals are in seconds
+	config := RateLimitConfig{
+		Default:   RateLimit{Interval: value.Default.Interval * time.Second, Burst: value.Default.Burst},
+		Hostnames: map[string]RateLimit{},
+	}
+	for hostname, rateLimit := range value.Hostnames {
+		config.Hostnames[hostname] = RateLimit{Interval: rateLimit.Interval * time.Second, Burst: rateLimit.Burst}
+	}
+
+	c.rateLimitConfig = config
+
+	return nil
+}
+
+func (c *client) GetCrawlLimits() (CrawlLimits, error) {
+	c.mutexes[CrawlLimitsKey].RLock()
+	defer c.mutexes[CrawlLimitsKey].RUnlock()
+
+	return c.crawlLimits, nil
+}
+
+func (c *client) setCrawlLimits(value CrawlLimits) error {
+	c.mutexes[CrawlLimitsKey].Lock()
+	defer c.mutexes[CrawlLimitsKey].Unlock()
+
+	c.crawlLimits = CrawlLimits{
+		MaxDepth:       value.MaxDepth,
+		HostnameBudget: value.HostnameBudget,
+		BudgetPeriod:   value.BudgetPeriod * time.Second, // period is in seconds
+	}
+
+	return nil
+}
+
 func (c *client) Set(key string, value interface{}) error {
 	b, err := json.Marshal(value)
 	if err != nil {
@@ -185,6 +359,13 @@ func (c *client) Set(key string, value interface{}) error {
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
+
+	// The invalid values are rejected with the reason
+	if res.StatusCode == http.StatusBadRequest {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("invalid value: %s", strings.TrimSpace(string(msg)))
+	}
 
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("invalid status code: %d", res.StatusCode)
@@ -193,6 +374,20 @@ func (c *client) Set(key string, value interface{}) error {
 	return nil
 }
 
+func (c *client) Ping() error {
+	r, err := c.pingClient.Get(fmt.Sprintf("%s/healthz", c.configAPIURL))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("non-managed status code %d", r.StatusCode)
+	}
+
+	return nil
+}
+
 func (c *client) get(key string) ([]byte, error) {
 	r, err := http.Get(fmt.Sprintf("%s/config/%s", c.configAPIURL, key))
 	if err != nil {
@@ -245,6 +440,33 @@ func (c *client) setValue(key string, value []byte) error {
 			return err
 		}
 		break
+	case RobotsTxtKey:
+		var val RobotsTxtConfig
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setRobotsTxtConfig(val); err != nil {
+			return err
+		}
+		break
+	case RateLimitKey:
+		var val RateLimitConfig
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setRateLimitConfig(val); err != nil {
+			return err
+		}
+		break
+	case CrawlLimitsKey:
+		var val CrawlLimits
+		if err := json.Unmarshal(value, &val); err != nil {
+			return err
+		}
+		if err := c.setCrawlLimits(val); err != nil {
+			return err
+		}
+		break
 	default:
 		return fmt.Errorf("non managed value type: %s", key)
 	}
@@ -255,15 +477,39 @@ func (c *client) setValue(key string, value []byte) error {
 }
 
 func (c *client) handleConfigEvent(_ event.Subscriber, msg event.RawMessage) error {
+	// Bulk updates hold the value of every updated key, null if deleted
+	if bulk, _ := msg.Headers["Config-Bulk"].(bool); bulk {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(msg.Body, &values); err != nil {
+			return err
+		}
+
+		for _, key := range c.keys {
+			if value, exist := values[key]; exist {
+				if err := c.setValue(key, value); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
 	// Make sure we have the header
 	configKey, ok := msg.Headers["Config-Key"].(string)
 	if !ok {
 		return fmt.Errorf("message has no Config-Key header")
 	}
 
+	// The deleted keys are reset to their zero value
+	value := msg.Body
+	if deleted, _ := msg.Headers["Config-Deleted"].(bool); deleted {
+		value = []byte("null")
+	}
+
 	for _, key := range c.keys {
 		if key == configKey {
-			if err := c.setValue(configKey, msg.Body); err != nil {
+			if err := c.setValue(configKey, value); err != nil {
 				return err
 			}
 			break
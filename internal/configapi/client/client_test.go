@@ -4,8 +4,11 @@ import (
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
 	"github.com/golang/mock/gomock"
+	"net/http"
+	"net/http/httptest"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestClient(t *testing.T) {
@@ -63,3 +66,122 @@ func TestClient(t *testing.T) {
 	}
 
 }
+
+func TestClient_BulkAndDeletedEvents(t *testing.T) {
+	client := &client{
+		mutexes: map[string]*sync.RWMutex{RefreshDelayKey: {}, CrawlLimitsKey: {}},
+		keys:    []string{RefreshDelayKey, CrawlLimitsKey},
+	}
+
+	// Only the watched keys are updated
+	msg := event.RawMessage{
+		Body:    []byte(`{"refresh-delay": {"delay": 3600000000000}, "crawl-limits": {"max-depth": 3, "budget-period": 3600}, "robots-txt": {"mode": "obey"}}`),
+		Headers: map[string]interface{}{"Config-Bulk": true},
+	}
+	if err := client.handleConfigEvent(nil, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if val, _ := client.GetRefreshDelay(); val.Delay != time.Hour {
+		t.Errorf("wrong refresh delay: %v", val)
+	}
+	if val, _ := client.GetCrawlLimits(); val.MaxDepth != 3 || val.BudgetPeriod != time.Hour {
+		t.Errorf("wrong crawl limits: %v", val)
+	}
+
+	// The deleted keys are reset
+	msg = event.RawMessage{
+		Body:    []byte(`{"refresh-delay": null}`),
+		Headers: map[string]interface{}{"Config-Bulk": true},
+	}
+	if err := client.handleConfigEvent(nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := client.GetRefreshDelay(); val.Delay != 0 {
+		t.Errorf("wrong refresh delay: %v", val)
+	}
+
+	msg = event.RawMessage{
+		Body:    []byte("null"),
+		Headers: map[string]interface{}{"Config-Key": CrawlLimitsKey, "Config-Deleted": true},
+	}
+	if err := client.handleConfigEvent(nil, msg); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := client.GetCrawlLimits(); val.MaxDepth != 0 {
+		t.Errorf("wrong crawl limits: %v", val)
+	}
+}
+
+func TestRateLimitConfig_GetRateLimit(t *testing.T) {
+	config := RateLimitConfig{
+		Default: RateLimit{Interval: time.Second, Burst: 1},
+		Hostnames: map[string]RateLimit{
+			"example.onion":      {Interval: time.Minute, Burst: 2},
+			"data.example.onion": {Interval: time.Hour, Burst: 3},
+		},
+	}
+
+	tests := map[string]RateLimit{
+		"google.onion":           config.Default,
+		"example.onion":          config.Hostnames["example.onion"],
+		"www.example.onion":      config.Hostnames["example.onion"],
+		"data.example.onion":     config.Hostnames["data.example.onion"],
+		"www.data.example.onion": config.Hostnames["data.example.onion"],
+		"notexample.onion":       config.Default,
+	}
+
+	for hostname, want := range tests {
+		if got := config.GetRateLimit(hostname); got != want {
+			t.Errorf("wrong rate limit for %s: (got: %v, want: %v)", hostname, got, want)
+		}
+	}
+}
+
+func TestRefreshDelay_Bound(t *testing.T) {
+	delay := RefreshDelay{Delay: time.Hour, MinDelay: time.Minute, MaxDelay: 24 * time.Hour}
+	if !delay.Adaptive() {
+		t.Error("delay should be adaptive")
+	}
+
+	tests := map[time.Duration]time.Duration{
+		time.Second:      time.Minute,
+		time.Hour:        time.Hour,
+		48 * time.Hour:   24 * time.Hour,
+		24*time.Hour + 1: 24 * time.Hour,
+		time.Minute - 1:  time.Minute,
+	}
+
+	for value, want := range tests {
+		if got := delay.Bound(value); got != want {
+			t.Errorf("wrong bounded delay for %s: (got: %s, want: %s)", value, got, want)
+		}
+	}
+
+	if (&RefreshDelay{Delay: time.Hour}).Adaptive() {
+		t.Error("delay should not be adaptive")
+	}
+}
+
+func TestClient_Ping(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer hung.Close()
+	defer close(release)
+
+	pingClient := &http.Client{Timeout: 50 * time.Millisecond}
+
+	c := &client{configAPIURL: srv.URL, pingClient: pingClient}
+	if err := c.Ping(); err != nil {
+		t.Errorf("error while pinging ConfigAPI: %s", err)
+	}
+
+	// The check does not hang
+	c = &client{configAPIURL: hung.URL, pingClient: pingClient}
+	if err := c.Ping(); err == nil {
+		t.Error("hung ConfigAPI should not be available")
+	}
+}
@@ -1,8 +1,10 @@
 package configapi
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
 	"github.com/gorilla/mux"
@@ -10,6 +12,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -19,6 +22,15 @@ type State struct {
 	pub         event.Publisher
 }
 
+// keyMetadata describes a configuration key
+type keyMetadata struct {
+	Key string `json:"key"`
+	// Size is the size of the value in bytes
+	Size int `json:"size"`
+	// Managed is true if the key is read by the components, a not managed key being stale
+	Managed bool `json:"managed"`
+}
+
 // Name return the process name
 func (state *State) Name() string {
 	return "configapi"
@@ -33,6 +45,8 @@ This component expose a REST API to allow other process to retrieve
 configuration as startup time, and to allow value update at runtime.
 Each time a configuration is update trough the API, an event will
 be dispatched so that running processes can update their local values.
+The keys may be listed, deleted, or several of them updated at once.
+The values of the known keys are validated before being stored.
 
 This component produces the 'config' event.`
 }
@@ -91,12 +105,20 @@ func (state *State) Subscribers() []process.SubscriberDef {
 // HTTPHandler returns the HTTP API the process expose
 func (state *State) HTTPHandler() http.Handler {
 	r := mux.NewRouter()
+	r.HandleFunc("/config", state.listConfiguration).Methods(http.MethodGet)
+	r.HandleFunc("/config", state.patchConfiguration).Methods(http.MethodPatch)
 	r.HandleFunc("/config/{key}", state.getConfiguration).Methods(http.MethodGet)
 	r.HandleFunc("/config/{key}", state.setConfiguration).Methods(http.MethodPut)
+	r.HandleFunc("/config/{key}", state.deleteConfiguration).Methods(http.MethodDelete)
 
 	return r
 }
 
+// Shutdown the process, the dependencies are released by the provider
+func (state *State) Shutdown() error {
+	return nil
+}
+
 func (state *State) getConfiguration(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
@@ -125,6 +147,12 @@ func (state *State) setConfiguration(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateValue(key, b); err != nil {
+		log.Debug().Err(err).Msg("Rejecting invalid value")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	log.Debug().Str("key", key).Bytes("value", b).Msg("Setting key")
 
 	if err := state.configCache.SetBytes(key, b, cache.NoTTL); err != nil {
@@ -146,6 +174,150 @@ func (state *State) setConfiguration(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(b)
 }
 
+func (state *State) listConfiguration(w http.ResponseWriter, r *http.Request) {
+	keys, err := state.configCache.Keys()
+	if err != nil {
+		log.Err(err).Msg("error while listing configuration")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sort.Strings(keys)
+
+	managed := map[string]bool{}
+	for _, key := range configapi.ManagedKeys {
+		managed[key] = true
+	}
+
+	metadata := []keyMetadata{}
+	for _, key := range keys {
+		b, err := state.configCache.GetBytes(key)
+		if err != nil {
+			log.Err(err).Msg("error while retrieving configuration")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Deleted meanwhile
+		if b == nil {
+			continue
+		}
+
+		metadata = append(metadata, keyMetadata{Key: key, Size: len(b), Managed: managed[key]})
+	}
+
+	writeJSON(w, metadata)
+}
+
+func (state *State) deleteConfiguration(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	b, err := state.configCache.GetBytes(key)
+	if err != nil {
+		log.Err(err).Msg("error while retrieving configuration")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if b == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	log.Debug().Str("key", key).Msg("Deleting key")
+
+	if err := state.configCache.Remove(key); err != nil {
+		log.Err(err).Msg("error while deleting configuration")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// publish event to notify config deleted
+	if err := state.pub.PublishJSON(event.ConfigExchange, event.RawMessage{
+		Body:    []byte("null"),
+		Headers: map[string]interface{}{"Config-Key": key, "Config-Deleted": true},
+	}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// patchConfiguration update several keys at once: the body is a JSON object of the new values,
+// a null value deleting the key (JSON merge patch). The keys are set in one transaction, which is only
+// atomic for the keys of a same hash slot with a Redis Cluster: the patch may then be partially applied
+// if the cache fails
+func (state *State) patchConfiguration(w http.ResponseWriter, r *http.Request) {
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		log.Err(err).Msg("error while reading body")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	values := map[string][]byte{}
+	for key, value := range patch {
+		if key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if string(value) == "null" {
+			values[key] = nil
+			continue
+		}
+
+		if err := validateValue(key, value); err != nil {
+			log.Debug().Err(err).Msg("Rejecting invalid value")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		values[key] = value
+	}
+
+	if len(values) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	log.Debug().Int("count", len(values)).Msg("Setting keys")
+
+	if err := state.configCache.SetManyBytes(values, cache.NoTTL); err != nil {
+		log.Err(err).Msg("error while setting configuration")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := json.Marshal(patch)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// publish a single event to notify every config changed
+	if err := state.pub.PublishJSON(event.ConfigExchange, event.RawMessage{
+		Body:    b,
+		Headers: map[string]interface{}{"Config-Bulk": true},
+	}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
 func setDefaultValues(configCache cache.Cache, values map[string]string) error {
 	for key, value := range values {
 		b, err := configCache.GetBytes(key)
@@ -154,6 +326,10 @@ func setDefaultValues(configCache cache.Cache, values map[string]string) error {
 		}
 
 		if b == nil {
+			if err := validateValue(key, []byte(value)); err != nil {
+				return fmt.Errorf("invalid default value: %s", err)
+			}
+
 			if err := configCache.SetBytes(key, []byte(value), cache.NoTTL); err != nil {
 				return fmt.Errorf("error while setting default value of %s: %s", key, err)
 			}
@@ -1,8 +1,10 @@
 package configapi
 
 import (
+	"encoding/json"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
@@ -13,6 +15,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -116,3 +119,109 @@ func TestSetConfiguration(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestListConfiguration(t *testing.T) {
+	configCache := cache.NewMemoryCache(t.Name(), "configuration")
+	_ = configCache.SetBytes(client.RefreshDelayKey, []byte(`{"delay": 10}`), cache.NoTTL)
+	_ = configCache.SetBytes("stale-key", []byte(`{}`), cache.NoTTL)
+
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	rec := httptest.NewRecorder()
+
+	s := State{configCache: configCache}
+	s.HTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	var metadata []keyMetadata
+	if err := json.NewDecoder(rec.Body).Decode(&metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []keyMetadata{
+		{Key: client.RefreshDelayKey, Size: 13, Managed: true},
+		{Key: "stale-key", Size: 2, Managed: false},
+	}
+	if !reflect.DeepEqual(metadata, want) {
+		t.Errorf("got %v want %v", metadata, want)
+	}
+}
+
+func TestDeleteConfiguration(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+	configCache := cache.NewMemoryCache(t.Name(), "configuration")
+	_ = configCache.SetBytes("hello", []byte(`{"ttl": "10s"}`), cache.NoTTL)
+
+	pubMock.EXPECT().PublishJSON("config", event.RawMessage{
+		Body:    []byte("null"),
+		Headers: map[string]interface{}{"Config-Key": "hello", "Config-Deleted": true},
+	}).Return(nil)
+
+	s := State{configCache: configCache, pub: pubMock}
+
+	rec := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/config/hello", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	if b, _ := configCache.GetBytes("hello"); b != nil {
+		t.Errorf("key should have been deleted")
+	}
+
+	// Deleting a missing key
+	rec = httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/config/hello", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
+
+func TestPatchConfiguration(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+	configCache := cache.NewMemoryCache(t.Name(), "configuration")
+	_ = configCache.SetBytes("stale-key", []byte(`{}`), cache.NoTTL)
+
+	// A single event for every key
+	pubMock.EXPECT().PublishJSON("config", event.RawMessage{
+		Body:    []byte(`{"crawl-limits":{"max-depth":3},"refresh-delay":{"delay":10},"stale-key":null}`),
+		Headers: map[string]interface{}{"Config-Bulk": true},
+	}).Return(nil)
+
+	body := `{"refresh-delay": {"delay": 10}, "crawl-limits": {"max-depth": 3}, "stale-key": null}`
+	rec := httptest.NewRecorder()
+
+	s := State{configCache: configCache, pub: pubMock}
+	s.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/config", strings.NewReader(body)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	if b, _ := configCache.GetBytes(client.RefreshDelayKey); string(b) != `{"delay": 10}` {
+		t.Errorf("wrong value: %s", b)
+	}
+	if b, _ := configCache.GetBytes(client.CrawlLimitsKey); string(b) != `{"max-depth": 3}` {
+		t.Errorf("wrong value: %s", b)
+	}
+	if b, _ := configCache.GetBytes("stale-key"); b != nil {
+		t.Errorf("key should have been deleted")
+	}
+
+	// Invalid patches are rejected
+	for _, body := range []string{`[]`, `{}`, `{"a": }`} {
+		rec := httptest.NewRecorder()
+		s.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/config", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status for %s: %d", body, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package configapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"sync"
+	"time"
+)
+
+// errInvalidJSON is returned when a value is not valid JSON, whatever its key
+var errInvalidJSON = errors.New("value is not valid JSON")
+
+// Schema validates the values of a configuration key, returning an error describing why a value is invalid
+type Schema func(value []byte) error
+
+var (
+	schemasMutex sync.RWMutex
+	schemas      = map[string]Schema{
+		configapi.AllowedMimeTypesKey:   validateAllowedMimeTypes,
+		configapi.ForbiddenHostnamesKey: validateForbiddenHostnames,
+		configapi.RefreshDelayKey:       validateRefreshDelay,
+		configapi.BlackListConfigKey:    validateBlackListConfig,
+		configapi.RobotsTxtKey:          validateRobotsTxtConfig,
+		configapi.RateLimitKey:          validateRateLimitConfig,
+		configapi.CrawlLimitsKey:        validateCrawlLimits,
+	}
+)
+
+// RegisterSchema registers the schema validating the values of given key, replacing the existing one if any
+func RegisterSchema(key string, schema Schema) {
+	schemasMutex.Lock()
+	defer schemasMutex.Unlock()
+
+	schemas[key] = schema
+}
+
+// validateValue returns an error if given value does not match the schema of its key.
+// The keys without schema only need a valid JSON value
+func validateValue(key string, value []byte) error {
+	if !json.Valid(value) {
+		return fmt.Errorf("%s: %w", key, errInvalidJSON)
+	}
+
+	schemasMutex.RLock()
+	schema, exist := schemas[key]
+	schemasMutex.RUnlock()
+
+	if !exist {
+		return nil
+	}
+
+	if err := schema(value); err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+
+	return nil
+}
+
+// decodeStrict decodes given value, rejecting the unknown fields (most likely typos)
+func decodeStrict(value []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+func validateAllowedMimeTypes(value []byte) error {
+	var mimeTypes []configapi.MimeType
+	if err := decodeStrict(value, &mimeTypes); err != nil {
+		return err
+	}
+
+	for i, mimeType := range mimeTypes {
+		if mimeType.ContentType == "" && len(mimeType.Extensions) == 0 {
+			return fmt.Errorf("[%d]: content-type or extensions is required", i)
+		}
+	}
+
+	return nil
+}
+
+func validateForbiddenHostnames(value []byte) error {
+	var hostnames []configapi.ForbiddenHostname
+	if err := decodeStrict(value, &hostnames); err != nil {
+		return err
+	}
+
+	for i, hostname := range hostnames {
+		if hostname.Hostname == "" {
+			return fmt.Errorf("[%d]: hostname is required", i)
+		}
+	}
+
+	return nil
+}
+
+func validateRefreshDelay(value []byte) error {
+	var delay configapi.RefreshDelay
+	if err := decodeStrict(value, &delay); err != nil {
+		return err
+	}
+
+	if err := checkPositive(map[string]time.Duration{"delay": delay.Delay, "min-delay": delay.MinDelay, "max-delay": delay.MaxDelay}); err != nil {
+		return err
+	}
+	if delay.Adaptive() && delay.MinDelay > delay.MaxDelay {
+		return errors.New("min-delay is greater than max-delay")
+	}
+
+	return nil
+}
+
+func validateBlackListConfig(value []byte) error {
+	var config configapi.BlackListConfig
+	if err := decodeStrict(value, &config); err != nil {
+		return err
+	}
+
+	if config.Threshold < 0 {
+		return errors.New("threshold is negative")
+	}
+
+	return checkPositive(map[string]time.Duration{"ttl": config.TTL})
+}
+
+func validateRobotsTxtConfig(value []byte) error {
+	var config configapi.RobotsTxtConfig
+	if err := decodeStrict(value, &config); err != nil {
+		return err
+	}
+
+	// No mode means obey
+	switch config.Mode {
+	case "", configapi.RobotsTxtObey, configapi.RobotsTxtIgnore, configapi.RobotsTxtRecord:
+	default:
+		return fmt.Errorf("mode must be one of %s, %s or %s", configapi.RobotsTxtObey, configapi.RobotsTxtIgnore, configapi.RobotsTxtRecord)
+	}
+
+	return checkPositive(map[string]time.Duration{"ttl": config.TTL})
+}
+
+func validateRateLimitConfig(value []byte) error {
+	var config configapi.RateLimitConfig
+	if err := decodeStrict(value, &config); err != nil {
+		return err
+	}
+
+	rateLimits := map[string]configapi.RateLimit{"default": config.Default}
+	for hostname, rateLimit := range config.Hostnames {
+		rateLimits["hostnames."+hostname] = rateLimit
+	}
+
+	for name, rateLimit := range rateLimits {
+		if err := checkPositive(map[string]time.Duration{name + ".interval": rateLimit.Interval}); err != nil {
+			return err
+		}
+		if rateLimit.Burst < 0 {
+			return fmt.Errorf("%s.burst is negative", name)
+		}
+	}
+
+	return nil
+}
+
+func validateCrawlLimits(value []byte) error {
+	var limits configapi.CrawlLimits
+	if err := decodeStrict(value, &limits); err != nil {
+		return err
+	}
+
+	if limits.MaxDepth < 0 {
+		return errors.New("max-depth is negative")
+	}
+	if limits.HostnameBudget < 0 {
+		return errors.New("hostname-budget is negative")
+	}
+
+	return checkPositive(map[string]time.Duration{"budget-period": limits.BudgetPeriod})
+}
+
+// checkPositive returns an error naming a negative duration, if any
+func checkPositive(durations map[string]time.Duration) error {
+	for name, duration := range durations {
+		if duration < 0 {
+			return fmt.Errorf("%s is negative", name)
+		}
+	}
+
+	return nil
+}
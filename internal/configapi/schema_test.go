@@ -0,0 +1,126 @@
+package configapi
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateValue(t *testing.T) {
+	tests := []struct {
+		key   string
+		value string
+		valid bool
+	}{
+		// The default values
+		{configapi.ForbiddenHostnamesKey, `[]`, true},
+		{configapi.AllowedMimeTypesKey, `[{"content-type":"text/","extensions":["html","php","aspx","htm"]}]`, true},
+		{configapi.RefreshDelayKey, `{"delay": 0}`, true},
+		{configapi.BlackListConfigKey, `{"threshold": 5, "ttl": 1200}`, true},
+		{configapi.RobotsTxtKey, `{"mode": "obey", "ttl": 86400}`, true},
+		{configapi.RateLimitKey, `{"default": {"interval": 1, "burst": 1}, "hostnames": {}}`, true},
+		{configapi.CrawlLimitsKey, `{"max-depth": 10, "hostname-budget": 1000, "budget-period": 86400}`, true},
+
+		{configapi.ForbiddenHostnamesKey, `[{"hostname": "example.onion"}]`, true},
+		{configapi.ForbiddenHostnamesKey, `["example.onion"]`, false},
+		{configapi.ForbiddenHostnamesKey, `[{"hostname": ""}]`, false},
+		{configapi.ForbiddenHostnamesKey, `[{"host": "example.onion"}]`, false},
+		{configapi.AllowedMimeTypesKey, `[{}]`, false},
+		{configapi.AllowedMimeTypesKey, `{"content-type": "text/"}`, false},
+		{configapi.RefreshDelayKey, `{"delay": 3600000000000, "min-delay": 60000000000, "max-delay": 86400000000000}`, true},
+		{configapi.RefreshDelayKey, `{"delay": "1h"}`, false},
+		{configapi.RefreshDelayKey, `{"delay": -1}`, false},
+		{configapi.RefreshDelayKey, `{"min-delay": 600000000000, "max-delay": 60000000000}`, false},
+		{configapi.BlackListConfigKey, `{"threshold": -5}`, false},
+		{configapi.RobotsTxtKey, `{"mode": "disobey"}`, false},
+		{configapi.RateLimitKey, `{"hostnames": {"example.onion": {"interval": 5, "burst": -1}}}`, false},
+		{configapi.CrawlLimitsKey, `{"max-depth": -1}`, false},
+		{configapi.CrawlLimitsKey, `{"hostname-budget": 1000, "budget-period": 3600}`, true},
+		{configapi.CrawlLimitsKey, `{"hostname-budget": 1000, "budget-period": -1}`, false},
+
+		// The keys without schema only need valid JSON
+		{"custom-key", `{"anything": [1, 2]}`, true},
+		{"custom-key", `{"anything": `, false},
+		{configapi.CrawlLimitsKey, `{"max-depth": 1} {}`, false},
+	}
+
+	for _, test := range tests {
+		err := validateValue(test.key, []byte(test.value))
+		if test.valid && err != nil {
+			t.Errorf("%s %s should be valid: %s", test.key, test.value, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s %s should be invalid", test.key, test.value)
+		}
+	}
+}
+
+func TestRegisterSchema(t *testing.T) {
+	errOdd := errors.New("value is odd")
+	RegisterSchema("even-number", func(value []byte) error {
+		if len(value) > 0 && (value[len(value)-1]-'0')%2 != 0 {
+			return errOdd
+		}
+		return nil
+	})
+
+	if err := validateValue("even-number", []byte("42")); err != nil {
+		t.Errorf("value should be valid: %s", err)
+	}
+	if err := validateValue("even-number", []byte("43")); err == nil || !strings.Contains(err.Error(), errOdd.Error()) {
+		t.Errorf("value should be invalid: %v", err)
+	}
+}
+
+func TestSetConfiguration_InvalidValue(t *testing.T) {
+	configCache := cache.NewMemoryCache(t.Name(), "configuration")
+	s := State{configCache: configCache}
+
+	req := httptest.NewRequest(http.MethodPut, "/config/forbidden-hostnames", strings.NewReader(`["example.onion"]`))
+	rec := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "forbidden-hostnames: json: cannot unmarshal string") {
+		t.Errorf("unexpected message: %s", rec.Body.String())
+	}
+
+	if b, _ := configCache.GetBytes(configapi.ForbiddenHostnamesKey); b != nil {
+		t.Errorf("invalid value should not be stored")
+	}
+}
+
+func TestPatchConfiguration_InvalidValue(t *testing.T) {
+	configCache := cache.NewMemoryCache(t.Name(), "configuration")
+	s := State{configCache: configCache}
+
+	// Nothing is stored if any value is invalid
+	body := `{"crawl-limits": {"max-depth": 3}, "robots-txt": {"mode": "disobey"}}`
+	rec := httptest.NewRecorder()
+	s.HTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/config", strings.NewReader(body)))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "robots-txt: mode must be one of") {
+		t.Errorf("unexpected message: %s", rec.Body.String())
+	}
+
+	if keys, _ := configCache.Keys(); len(keys) != 0 {
+		t.Errorf("invalid patch should not be stored: %v", keys)
+	}
+}
+
+func TestSetDefaultValues_InvalidValue(t *testing.T) {
+	configCache := cache.NewMemoryCache(t.Name(), "configuration")
+
+	if err := setDefaultValues(configCache, map[string]string{configapi.RefreshDelayKey: `{"delay": "1h"}`}); err == nil {
+		t.Error("invalid default value should be rejected")
+	}
+}
@@ -0,0 +1,94 @@
+package constraint
+
+import (
+	"errors"
+	"fmt"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/onion"
+	"net/url"
+	"strings"
+)
+
+var (
+	// ErrNotOnionHostname is returned when the URL hostname is not a .onion one
+	ErrNotOnionHostname = errors.New("hostname is not .onion")
+	// ErrProtocolNotAllowed is returned when the URL protocol is not HTTP(S)
+	ErrProtocolNotAllowed = errors.New("protocol is not allowed")
+	// ErrExtensionNotAllowed is returned when the URL extension does not match an allowed mime type
+	ErrExtensionNotAllowed = errors.New("extension is not allowed")
+	// ErrHostnameNotAllowed is returned when the URL hostname is forbidden
+	ErrHostnameNotAllowed = errors.New("hostname is not allowed")
+)
+
+// URLErrors are the reasons for an URL to not be allowed
+var URLErrors = []error{
+	ErrNotOnionHostname,
+	onion.ErrDeprecatedVersion,
+	onion.ErrInvalidAddress,
+	ErrProtocolNotAllowed,
+	ErrExtensionNotAllowed,
+	ErrHostnameNotAllowed,
+}
+
+// CheckURLAllowed check if given URL is eligible for crawling: an HTTP(S) URL of a valid v3 onion address,
+// with an allowed extension and a hostname not forbidden. The onion address of the URL is returned if allowed,
+// otherwise the returned error wraps one of URLErrors
+func CheckURLAllowed(configClient configapi.Client, rawurl string) (*onion.Address, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing URL: %s", err)
+	}
+
+	// Make sure URL is valid .onion
+	addr, err := onion.Parse(u.Hostname())
+	if errors.Is(err, onion.ErrNotOnion) {
+		return nil, fmt.Errorf("%s %w", u.Host, ErrNotOnionHostname)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Make sure protocol is not forbidden
+	if !strings.HasPrefix(u.Scheme, "http") {
+		return nil, fmt.Errorf("%s %w", u, ErrProtocolNotAllowed)
+	}
+
+	// Make sure extension is allowed
+	allowed := false
+	if mimeTypes, err := configClient.GetAllowedMimeTypes(); err == nil {
+		for _, mimeType := range mimeTypes {
+			for _, ext := range mimeType.Extensions {
+				if strings.HasSuffix(strings.ToLower(u.Path), "."+ext) {
+					allowed = true
+				}
+			}
+		}
+	}
+
+	// Handle case no extension present
+	if !allowed {
+		components := strings.Split(u.Path, "/")
+
+		lastIdx := 0
+		if size := len(components); size > 0 {
+			lastIdx = size - 1
+		}
+
+		// generally no extension means text/* content-type
+		if !strings.Contains(components[lastIdx], ".") {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return nil, fmt.Errorf("%s %w", u, ErrExtensionNotAllowed)
+	}
+
+	// Make sure hostname is not forbidden
+	if allowed, err := CheckHostnameAllowed(configClient, rawurl); err != nil {
+		return nil, err
+	} else if !allowed {
+		return nil, fmt.Errorf("%s %w", u, ErrHostnameNotAllowed)
+	}
+
+	return addr, nil
+}
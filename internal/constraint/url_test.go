@@ -0,0 +1,45 @@
+package constraint
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/onion"
+	"github.com/golang/mock/gomock"
+	"testing"
+)
+
+func TestCheckURLAllowed(t *testing.T) {
+	const (
+		example   = "nn44k7tkbfjdskbmasay5fqrf47qhjaadouxuvsmeocsupy6ux6fdgid.onion"
+		forbidden = "3ln5dbfc2utpd265lqdp3lmtlgzcq5m3jv7xtvtgrh5cksvnqvddmpid.onion"
+	)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html"}}}, nil).AnyTimes()
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: forbidden}}, nil).AnyTimes()
+
+	tests := map[string]error{
+		"https://" + example + "/index.html":   nil,
+		"https://www." + example + "/about":    nil,
+		"https://example.org":                  ErrNotOnionHostname,
+		"https://facebookcorewwwi.onion":       onion.ErrDeprecatedVersion,
+		"https://example.onion":                onion.ErrInvalidAddress,
+		"ftp://" + example:                     ErrProtocolNotAllowed,
+		"https://" + example + "/image.png":    ErrExtensionNotAllowed,
+		"https://" + forbidden + "/index.html": ErrHostnameNotAllowed,
+	}
+
+	for url, want := range tests {
+		addr, err := CheckURLAllowed(configClientMock, url)
+		if !errors.Is(err, want) {
+			t.Errorf("%s: got %v want %v", url, err, want)
+		}
+		if err == nil && addr.Hostname != example {
+			t.Errorf("%s: unexpected onion address %s", url, addr.Hostname)
+		}
+	}
+}
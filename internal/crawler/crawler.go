@@ -2,6 +2,7 @@ package crawler
 
 import (
 	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/clock"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/constraint"
@@ -12,19 +13,25 @@ import (
 	"github.com/urfave/cli/v2"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
 var (
 	errContentTypeNotAllowed = fmt.Errorf("content type is not allowed")
 	errHostnameNotAllowed    = fmt.Errorf("hostname is not allowed")
+	errDisallowedByRobotsTxt = fmt.Errorf("URL is disallowed by robots.txt")
+	errHostnameThrottled     = fmt.Errorf("hostname crawling rate is exceeded")
 )
 
 // State represent the application state
 type State struct {
-	httpClient   chttp.Client
-	clock        clock.Clock
-	configClient configapi.Client
+	httpClient     chttp.Client
+	clock          clock.Clock
+	configClient   configapi.Client
+	robotsCache    cache.Cache
+	rateLimitCache cache.Cache
 }
 
 // Name return the process name
@@ -37,6 +44,9 @@ func (state *State) Description() string {
 	return `
 The crawling component. It consumes URL, crawl the resource, and
 publish the result (page content + headers).
+The hostnames robots.txt are honoured depending on the configuration,
+and the crawling rate is limited per hostname across the crawler instances:
+the throttled URLs are delivered again later.
 
 The crawler consumes the 'url.new' event and produces either:
 - 'url.timeout' event if the crawling has failed because of timeout issue
@@ -45,7 +55,7 @@ The crawler consumes the 'url.new' event and produces either:
 
 // Features return the process features
 func (state *State) Features() []process.Feature {
-	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CrawlingFeature}
+	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature, process.CrawlingFeature}
 }
 
 // CustomFlags return process custom flags
@@ -67,19 +77,43 @@ func (state *State) Initialize(provider process.Provider) error {
 	}
 	state.clock = cl
 
-	configClient, err := provider.ConfigClient([]string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey})
+	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RobotsTxtKey, configapi.RateLimitKey}
+	configClient, err := provider.ConfigClient(keys)
 	if err != nil {
 		return err
 	}
 	state.configClient = configClient
 
+	robotsCache, err := provider.Cache("robots")
+	if err != nil {
+		return err
+	}
+	state.robotsCache = robotsCache
+
+	rateLimitCache, err := provider.Cache("rate-limit")
+	if err != nil {
+		return err
+	}
+	state.rateLimitCache = rateLimitCache
+
 	return nil
 }
 
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.NewURLExchange, Queue: "crawlingQueue", Handler: state.handleNewURLEvent},
+		{
+			Exchange: event.NewURLExchange,
+			Queue:    "crawlingQueue",
+			Handler:  state.handleNewURLEvent,
+			Errors: []error{
+				errContentTypeNotAllowed,
+				errHostnameNotAllowed,
+				errDisallowedByRobotsTxt,
+				errHostnameThrottled,
+				chttp.ErrTimeout,
+			},
+		},
 	}
 }
 
@@ -88,6 +122,11 @@ func (state *State) HTTPHandler() http.Handler {
 	return nil
 }
 
+// Shutdown the process, the dependencies are released by the provider
+func (state *State) Shutdown() error {
+	return nil
+}
+
 func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.RawMessage) error {
 	var evt event.NewURLEvent
 	if err := subscriber.Read(&msg, &evt); err != nil {
@@ -103,7 +142,24 @@ func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.Raw
 		return fmt.Errorf("%s %w", evt.URL, errHostnameNotAllowed)
 	}
 
+	u, err := url.Parse(evt.URL)
+	if err != nil {
+		return err
+	}
+
+	crawlDelay, err := state.checkRobotsTxt(u)
+	if err != nil {
+		return err
+	}
+
+	// Be polite: make sure we are not hammering the hostname
+	if err := state.throttle(u.Hostname(), crawlDelay); err != nil {
+		return err
+	}
+
+	start := time.Now()
 	r, err := state.httpClient.Get(evt.URL)
+	recordFetch(start, r, err)
 	if err != nil {
 		if err == chttp.ErrTimeout {
 			// indicate that crawling has failed
@@ -141,10 +197,13 @@ func (state *State) handleNewURLEvent(subscriber event.Subscriber, msg event.Raw
 	}
 
 	res := event.NewResourceEvent{
-		URL:     evt.URL,
-		Body:    string(b),
-		Headers: r.Headers(),
-		Time:    state.clock.Now(),
+		URL:       evt.URL,
+		Body:      string(b),
+		Headers:   r.Headers(),
+		Time:      state.clock.Now(),
+		Depth:     evt.Depth,
+		Seed:      evt.Seed,
+		PublicKey: evt.PublicKey,
 	}
 
 	if err := subscriber.PublishEvent(&res); err != nil {
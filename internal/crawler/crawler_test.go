@@ -1,6 +1,8 @@
 package crawler
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"errors"
 	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
@@ -27,7 +29,7 @@ func TestState_Name(t *testing.T) {
 
 func TestState_Features(t *testing.T) {
 	s := State{}
-	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CrawlingFeature})
+	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature, process.CrawlingFeature})
 }
 
 func TestState_CustomFlags(t *testing.T) {
@@ -39,7 +41,9 @@ func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
 		p.HTTPClient()
 		p.Clock()
-		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey})
+		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey, client.RobotsTxtKey, client.RateLimitKey})
+		p.Cache("robots")
+		p.Cache("rate-limit")
 	})
 }
 
@@ -132,11 +136,14 @@ func TestHandleNewURLEvent(t *testing.T) {
 		},
 	}
 
+	// The hidden service public key is forwarded
+	pubKey := ed25519.PublicKey(bytes.Repeat([]byte{1}, ed25519.PublicKeySize))
+
 	for _, test := range tests {
 		msg := event.RawMessage{}
 		subscriberMock.EXPECT().
 			Read(&msg, &event.NewURLEvent{}).
-			SetArg(1, event.NewURLEvent{URL: test.url}).
+			SetArg(1, event.NewURLEvent{URL: test.url, PublicKey: pubKey}).
 			Return(nil)
 
 		// mock crawling
@@ -147,6 +154,7 @@ func TestHandleNewURLEvent(t *testing.T) {
 			break
 		default:
 			httpResponseMock.EXPECT().Headers().Return(test.responseHeaders)
+			httpResponseMock.EXPECT().StatusCode().Return(200)
 			httpClientMock.EXPECT().Get(test.url).Return(httpResponseMock, nil)
 
 			// mock config retrieval
@@ -155,6 +163,8 @@ func TestHandleNewURLEvent(t *testing.T) {
 		}
 
 		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+		configClientMock.EXPECT().GetRobotsTxtConfig().Return(client.RobotsTxtConfig{Mode: client.RobotsTxtIgnore}, nil)
+		configClientMock.EXPECT().GetRateLimitConfig().Return(client.RateLimitConfig{}, nil)
 
 		if test.err == nil {
 			httpResponseMock.EXPECT().Headers().Return(test.responseHeaders)
@@ -165,10 +175,11 @@ func TestHandleNewURLEvent(t *testing.T) {
 
 			// if test should pass expect event publishing
 			subscriberMock.EXPECT().PublishEvent(&event.NewResourceEvent{
-				URL:     test.url,
-				Body:    test.responseBody,
-				Headers: test.responseHeaders,
-				Time:    tn,
+				URL:       test.url,
+				Body:      test.responseBody,
+				Headers:   test.responseHeaders,
+				Time:      tn,
+				PublicKey: pubKey,
 			}).Return(nil)
 		}
 
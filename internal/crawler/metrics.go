@@ -0,0 +1,45 @@
+package crawler
+
+import (
+	"errors"
+	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+var (
+	fetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "crawler",
+		Name:      "fetch_duration_seconds",
+		Help:      "The time taken to fetch the URLs",
+		Buckets:   []float64{.5, 1, 2.5, 5, 10, 20, 30, 60},
+	})
+	fetchResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "crawler",
+		Name:      "responses_total",
+		Help:      "The number of fetched URLs, per status code ('timeout' or 'error' if the fetching has failed)",
+	}, []string{"status"})
+)
+
+// recordFetch update the metrics once an URL has been fetched
+func recordFetch(start time.Time, r chttp.Response, err error) {
+	fetchDuration.Observe(time.Since(start).Seconds())
+
+	status := "error"
+	var statusErr *chttp.StatusCodeError
+	switch {
+	case err == nil:
+		status = strconv.Itoa(r.StatusCode())
+	case errors.As(err, &statusErr):
+		status = strconv.Itoa(statusErr.Code)
+	case errors.Is(err, chttp.ErrTimeout):
+		status = "timeout"
+	}
+
+	fetchResponses.WithLabelValues(status).Inc()
+}
@@ -0,0 +1,41 @@
+package crawler
+
+import (
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"time"
+)
+
+// throttle make sure given hostname crawling rate is not exceeded.
+// The rate limiting is a token bucket shared by the crawler instances trough the cache,
+// atomically applying the GCRA algorithm: the cache only holds the theoretical arrival time of the next request.
+// The crawl delay (if any) is enforced as the minimum interval between two requests.
+func (state *State) throttle(hostname string, crawlDelay time.Duration) error {
+	config, err := state.configClient.GetRateLimitConfig()
+	if err != nil {
+		return err
+	}
+
+	rateLimit := config.GetRateLimit(hostname)
+	if crawlDelay > rateLimit.Interval {
+		rateLimit.Interval = crawlDelay
+		rateLimit.Burst = 1
+	}
+
+	// Unlimited
+	if rateLimit.Interval <= 0 {
+		return nil
+	}
+
+	wait, err := state.rateLimitCache.Throttle(hostname, state.clock.Now(), rateLimit.Interval, rateLimit.Burst)
+	if err != nil {
+		return err
+	}
+
+	// The bucket is empty
+	if wait > 0 {
+		return event.Defer(wait, fmt.Errorf("%s %w", hostname, errHostnameThrottled))
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package crawler
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	s := State{
+		configClient:   configClientMock,
+		clock:          clockMock,
+		rateLimitCache: cache.NewMemoryCache("throttle", "rate-limit"),
+	}
+
+	config := client.RateLimitConfig{
+		Default: client.RateLimit{Interval: 10 * time.Second, Burst: 2},
+		Hostnames: map[string]client.RateLimit{
+			"unlimited.onion": {},
+		},
+	}
+	configClientMock.EXPECT().GetRateLimitConfig().AnyTimes().Return(config, nil)
+
+	now := time.Now()
+
+	// Burst of two requests
+	clockMock.EXPECT().Now().Times(2).Return(now)
+	for i := 0; i < 2; i++ {
+		if err := s.throttle("example.onion", 0); err != nil {
+			t.Errorf("request %d should have been allowed: %s", i, err)
+		}
+	}
+
+	// Bucket is empty: wait for a token
+	clockMock.EXPECT().Now().Return(now.Add(4 * time.Second))
+
+	err := s.throttle("example.onion", 0)
+	var deferredErr *event.DeferredError
+	if !errors.As(err, &deferredErr) || !errors.Is(err, errHostnameThrottled) {
+		t.Fatalf("request should have been throttled: %v", err)
+	}
+	if deferredErr.Delay != 6*time.Second {
+		t.Errorf("wrong delay: (got: %s, want: %s)", deferredErr.Delay, 6*time.Second)
+	}
+
+	// Token is available again
+	clockMock.EXPECT().Now().Return(now.Add(10 * time.Second))
+	if err := s.throttle("example.onion", 0); err != nil {
+		t.Errorf("request should have been allowed: %s", err)
+	}
+
+	// Overrides are applied to subdomains too
+	for i := 0; i < 5; i++ {
+		if err := s.throttle("www.unlimited.onion", 0); err != nil {
+			t.Errorf("request %d should have been allowed: %s", i, err)
+		}
+	}
+
+	// The crawl delay is honoured when greater than the configured interval
+	clockMock.EXPECT().Now().Times(2).Return(now)
+	if err := s.throttle("polite.onion", time.Minute); err != nil {
+		t.Errorf("request should have been allowed: %s", err)
+	}
+	if err := s.throttle("polite.onion", time.Minute); !errors.As(err, &deferredErr) || deferredErr.Delay != time.Minute {
+		t.Errorf("request should have been throttled for a minute: %v", err)
+	}
+}
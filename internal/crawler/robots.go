@@ -0,0 +1,304 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// robotsUserAgent is the product token used to find our rules in the robots.txt
+	robotsUserAgent = "bathyscaphe"
+	// robotsTxtFailureTTL is how long the outcome of a failed robots.txt fetch is cached
+	robotsTxtFailureTTL = 10 * time.Minute
+)
+
+// robotsRule is an allow / disallow line of a robots.txt
+type robotsRule struct {
+	Allow bool   `json:"allow"`
+	Path  string `json:"path"`
+}
+
+// robotsTxt is the parsed robots.txt of an hostname, only containing the rules applying to us
+type robotsTxt struct {
+	Rules      []robotsRule  `json:"rules"`
+	CrawlDelay time.Duration `json:"crawl_delay"`
+}
+
+// robotsGroup is a group of rules of a robots.txt
+type robotsGroup struct {
+	userAgents []string
+	robotsTxt
+}
+
+// parseRobotsTxt parse given robots.txt and keep the rules applying to us
+func parseRobotsTxt(r io.Reader) (*robotsTxt, error) {
+	var groups []*robotsGroup
+	var current *robotsGroup
+
+	// set to true once the current group has rules, a new user-agent line then starts a new group
+	currentHasRules := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		// Remove comments
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.TrimSpace(parts[1])
+
+		switch key {
+		case "user-agent":
+			if current == nil || currentHasRules {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+				currentHasRules = false
+			}
+			current.userAgents = append(current.userAgents, strings.ToLower(value))
+		case "allow", "disallow":
+			if current == nil {
+				continue
+			}
+			currentHasRules = true
+
+			// An empty disallow means everything is allowed
+			if value == "" {
+				continue
+			}
+			current.Rules = append(current.Rules, robotsRule{Allow: key == "allow", Path: value})
+		case "crawl-delay":
+			if current == nil {
+				continue
+			}
+			currentHasRules = true
+
+			if delay, err := strconv.ParseFloat(value, 64); err == nil && delay > 0 {
+				current.CrawlDelay = time.Duration(delay * float64(time.Second))
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Use the groups targeting us, or fallback to the wildcard ones
+	robots := &robotsTxt{}
+	for _, userAgent := range []string{robotsUserAgent, "*"} {
+		found := false
+		for _, group := range groups {
+			for _, groupUserAgent := range group.userAgents {
+				if groupUserAgent == userAgent {
+					found = true
+					robots.Rules = append(robots.Rules, group.Rules...)
+					if group.CrawlDelay > robots.CrawlDelay {
+						robots.CrawlDelay = group.CrawlDelay
+					}
+					break
+				}
+			}
+		}
+
+		if found {
+			break
+		}
+	}
+
+	return robots, nil
+}
+
+// allowed determinate if given path can be crawled.
+// The most specific (longest) matching rule wins, allow wins in case of tie
+func (r *robotsTxt) allowed(path string) bool {
+	allowed := true
+	matchLen := -1
+
+	for _, rule := range r.Rules {
+		if !matchRobotsPath(rule.Path, path) {
+			continue
+		}
+
+		if len(rule.Path) > matchLen || (len(rule.Path) == matchLen && rule.Allow) {
+			allowed = rule.Allow
+			matchLen = len(rule.Path)
+		}
+	}
+
+	return allowed
+}
+
+// matchRobotsPath determinate if given path match given robots.txt pattern
+// The pattern may contains * (any sequence of characters) and end with $ (end of path)
+func matchRobotsPath(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+
+	parts := strings.Split(pattern, "*")
+
+	// First part should be a prefix
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+
+	for i, part := range parts[1:] {
+		// The last part must be at the end of the path if the pattern is anchored
+		if anchored && i == len(parts)-2 {
+			return strings.HasSuffix(path, part)
+		}
+
+		idx := strings.Index(path, part)
+		if idx < 0 {
+			return false
+		}
+		path = path[idx+len(part):]
+	}
+
+	return !anchored || path == ""
+}
+
+// checkRobotsTxt make sure given URL can be crawled according to the hostname robots.txt
+// and returns the crawl delay to honour
+func (state *State) checkRobotsTxt(u *url.URL) (time.Duration, error) {
+	config, err := state.configClient.GetRobotsTxtConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	if config.Mode == configapi.RobotsTxtIgnore {
+		return 0, nil
+	}
+
+	robots, err := state.getRobotsTxt(u, config.TTL)
+	if err != nil {
+		return 0, err
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	if !robots.allowed(path) {
+		if config.Mode == configapi.RobotsTxtRecord {
+			log.Info().
+				Stringer("url", u).
+				Str("reason", "robots-txt").
+				Msg("Crawling URL disallowed by robots.txt")
+			return 0, nil
+		}
+
+		log.Debug().
+			Stringer("url", u).
+			Str("reason", "robots-txt").
+			Msg("Skipping URL disallowed by robots.txt")
+		return 0, fmt.Errorf("%s %w", u, errDisallowedByRobotsTxt)
+	}
+
+	// The crawl delay is only honoured when obeying
+	if config.Mode == configapi.RobotsTxtRecord {
+		return 0, nil
+	}
+
+	return robots.CrawlDelay, nil
+}
+
+// getRobotsTxt returns the robots.txt of given URL hostname, from the cache if possible
+func (state *State) getRobotsTxt(u *url.URL, TTL time.Duration) (*robotsTxt, error) {
+	key := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
+
+	b, err := state.robotsCache.GetBytes(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) > 0 {
+		var robots robotsTxt
+		if err := json.Unmarshal(b, &robots); err != nil {
+			return nil, err
+		}
+
+		return &robots, nil
+	}
+
+	// Fetching the robots.txt counts as a request to the hostname
+	if err := state.throttle(u.Hostname(), 0); err != nil {
+		return nil, err
+	}
+
+	robots, TTL, err := state.fetchRobotsTxt(key+"/robots.txt", TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err = json.Marshal(robots)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := state.robotsCache.SetBytes(key, b, TTL); err != nil {
+		return nil, err
+	}
+
+	return robots, nil
+}
+
+// fetchRobotsTxt fetch the robots.txt at given URL and returns how long it should be cached.
+// Following RFC 9309, a missing robots.txt (4xx) allows everything while an unavailable one (5xx)
+// disallows everything. The failures are only cached for a short time, to fetch the robots.txt again soon
+func (state *State) fetchRobotsTxt(URL string, TTL time.Duration) (*robotsTxt, time.Duration, error) {
+	failureTTL := robotsTxtFailureTTL
+	if TTL > 0 && TTL < failureTTL {
+		failureTTL = TTL
+	}
+
+	r, err := state.httpClient.Get(URL)
+
+	var statusErr *chttp.StatusCodeError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.Code >= http.StatusInternalServerError:
+		log.Debug().Int("status", statusErr.Code).Str("url", URL).Msg("Unavailable robots.txt, disallowing everything")
+		return &robotsTxt{Rules: []robotsRule{{Allow: false, Path: "/"}}}, failureTTL, nil
+	case errors.As(err, &statusErr) && statusErr.Code >= http.StatusBadRequest:
+		return &robotsTxt{}, TTL, nil
+	case err != nil:
+		// The hostname is most likely down: allow everything since fetching the URL fails too,
+		// reporting the timeout
+		log.Debug().Err(err).Str("url", URL).Msg("Unable to fetch robots.txt")
+		return &robotsTxt{}, failureTTL, nil
+	case r.StatusCode() != http.StatusOK:
+		// Not followed redirection
+		return &robotsTxt{}, failureTTL, nil
+	}
+
+	robots, err := parseRobotsTxt(r.Body())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return robots, TTL, nil
+}
@@ -0,0 +1,261 @@
+package crawler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/darkspot-org/bathyscaphe/internal/http_mock"
+	"github.com/golang/mock/gomock"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const robotsTxtBody = `
+# Robots of the test hostname
+User-agent: Googlebot
+Disallow: /
+
+User-agent: *
+Disallow: /admin # private area
+Disallow: /*.php$
+Allow: /admin/public
+Crawl-delay: 2.5
+
+User-agent: otherbot
+Disallow:
+`
+
+func TestParseRobotsTxt(t *testing.T) {
+	robots, err := parseRobotsTxt(strings.NewReader(robotsTxtBody))
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(robots.Rules) != 3 {
+		t.Errorf("wrong number of rules: %d", len(robots.Rules))
+	}
+	if robots.CrawlDelay != 2500*time.Millisecond {
+		t.Errorf("wrong crawl delay: %s", robots.CrawlDelay)
+	}
+
+	// Rules targeting us should take precedence
+	robots, err = parseRobotsTxt(strings.NewReader(robotsTxtBody + "\nUser-agent: Bathyscaphe\nDisallow: /private\n"))
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(robots.Rules) != 1 || robots.Rules[0].Path != "/private" || robots.CrawlDelay != 0 {
+		t.Errorf("wrong rules: %v", robots)
+	}
+}
+
+func TestRobotsTxt_Allowed(t *testing.T) {
+	robots, err := parseRobotsTxt(strings.NewReader(robotsTxtBody))
+	if err != nil {
+		t.FailNow()
+	}
+
+	tests := map[string]bool{
+		"/":                    true,
+		"/index.html":          true,
+		"/admin":               false,
+		"/admin/users":         false,
+		"/admin/public":        true,
+		"/admin/public/a.html": true,
+		"/test.php":            false,
+		"/test.php?id=12":      true,
+		"/test.phpx":           true,
+	}
+
+	for path, want := range tests {
+		if got := robots.allowed(path); got != want {
+			t.Errorf("wrong result for %s: (got: %v, want: %v)", path, got, want)
+		}
+	}
+}
+
+func TestMatchRobotsPath(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/", path: "/anything", want: true},
+		{pattern: "/fish", path: "/fish.html", want: true},
+		{pattern: "/fish", path: "/Fish.html", want: false},
+		{pattern: "/fish*", path: "/fishheads/yummy.html", want: true},
+		{pattern: "/*.php", path: "/folder/filename.php?parameters", want: true},
+		{pattern: "/*.php$", path: "/filename.php", want: true},
+		{pattern: "/*.php$", path: "/filename.php?parameters", want: false},
+		{pattern: "/fish*.php", path: "/fishheads/catfish.php?parameters", want: true},
+		{pattern: "/fish*.php", path: "/fish.asp", want: false},
+		{pattern: "/fish$", path: "/fish", want: true},
+		{pattern: "/fish$", path: "/fish/", want: false},
+	}
+
+	for _, test := range tests {
+		if got := matchRobotsPath(test.pattern, test.path); got != test.want {
+			t.Errorf("wrong result for %s on %s: (got: %v, want: %v)", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestCheckRobotsTxt(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	robotsCacheMock := cache_mock.NewMockCache(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	httpResponseMock := http_mock.NewMockResponse(mockCtrl)
+
+	s := State{
+		configClient: configClientMock,
+		robotsCache:  robotsCacheMock,
+		httpClient:   httpClientMock,
+	}
+
+	config := client.RobotsTxtConfig{Mode: client.RobotsTxtObey, TTL: time.Hour}
+
+	// First time: the robots.txt is fetched and cached
+	u, _ := url.Parse("https://example.onion/admin/users")
+
+	configClientMock.EXPECT().GetRobotsTxtConfig().Return(config, nil)
+	robotsCacheMock.EXPECT().GetBytes("https://example.onion").Return(nil, nil)
+	configClientMock.EXPECT().GetRateLimitConfig().Return(client.RateLimitConfig{}, nil)
+	httpClientMock.EXPECT().Get("https://example.onion/robots.txt").Return(httpResponseMock, nil)
+	httpResponseMock.EXPECT().StatusCode().Return(200)
+	httpResponseMock.EXPECT().Body().Return(strings.NewReader(robotsTxtBody))
+	robotsCacheMock.EXPECT().SetBytes("https://example.onion", gomock.Any(), time.Hour).Return(nil)
+
+	if _, err := s.checkRobotsTxt(u); !errors.Is(err, errDisallowedByRobotsTxt) {
+		t.Errorf("URL should have been disallowed: %v", err)
+	}
+
+	// Record mode does not skip the URL
+	robots, _ := parseRobotsTxt(strings.NewReader(robotsTxtBody))
+	b, _ := json.Marshal(robots)
+
+	configClientMock.EXPECT().GetRobotsTxtConfig().Return(client.RobotsTxtConfig{Mode: client.RobotsTxtRecord}, nil)
+	robotsCacheMock.EXPECT().GetBytes("https://example.onion").Return(b, nil)
+
+	if delay, err := s.checkRobotsTxt(u); err != nil || delay != 0 {
+		t.Errorf("URL should have been allowed without crawl delay: %s (%v)", delay, err)
+	}
+
+	// Allowed URL: the crawl delay is returned
+	u, _ = url.Parse("https://example.onion/index.html")
+
+	configClientMock.EXPECT().GetRobotsTxtConfig().Return(config, nil)
+	robotsCacheMock.EXPECT().GetBytes("https://example.onion").Return(b, nil)
+
+	if delay, err := s.checkRobotsTxt(u); err != nil || delay != 2500*time.Millisecond {
+		t.Errorf("URL should have been allowed with crawl delay: %s (%v)", delay, err)
+	}
+
+	// Ignore mode does not even fetch the robots.txt
+	configClientMock.EXPECT().GetRobotsTxtConfig().Return(client.RobotsTxtConfig{Mode: client.RobotsTxtIgnore}, nil)
+
+	if delay, err := s.checkRobotsTxt(u); err != nil || delay != 0 {
+		t.Errorf("URL should have been allowed without crawl delay: %s (%v)", delay, err)
+	}
+}
+
+func TestGetRobotsTxt_Failures(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	s := State{
+		configClient:   configClientMock,
+		robotsCache:    cache.NewMemoryCache(t.Name(), "robots"),
+		rateLimitCache: cache.NewMemoryCache(t.Name(), "rate-limit"),
+		httpClient:     httpClientMock,
+		clock:          clockMock,
+	}
+
+	rateLimitConfig := client.RateLimitConfig{Default: client.RateLimit{Interval: time.Minute, Burst: 1}}
+	configClientMock.EXPECT().GetRateLimitConfig().AnyTimes().Return(rateLimitConfig, nil)
+	clockMock.EXPECT().Now().AnyTimes().Return(time.Now())
+
+	tests := []struct {
+		hostname string
+		err      error
+		allowed  bool
+	}{
+		// Unavailable robots.txt: everything is disallowed
+		{hostname: "unavailable.onion", err: &chttp.StatusCodeError{Code: 503}, allowed: false},
+		// Missing robots.txt: everything is allowed
+		{hostname: "missing.onion", err: &chttp.StatusCodeError{Code: 404}, allowed: true},
+		// Unreachable hostname: everything is allowed
+		{hostname: "unreachable.onion", err: chttp.ErrTimeout, allowed: true},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse("https://" + test.hostname + "/index.html")
+
+		httpClientMock.EXPECT().Get("https://"+test.hostname+"/robots.txt").Return(nil, test.err)
+
+		robots, err := s.getRobotsTxt(u, 24*time.Hour)
+		if err != nil {
+			t.Fatalf("error while getting %s robots.txt: %s", test.hostname, err)
+		}
+		if robots.allowed(u.Path) != test.allowed {
+			t.Errorf("wrong result for %s: (got: %v, want: %v)", test.hostname, !test.allowed, test.allowed)
+		}
+
+		// The robots.txt is cached, and the fetch is rate limited
+		if _, err := s.getRobotsTxt(u, 24*time.Hour); err != nil {
+			t.Errorf("robots.txt of %s should have been cached: %s", test.hostname, err)
+		}
+
+		var deferredErr *event.DeferredError
+		if err := s.throttle(test.hostname, 0); !errors.As(err, &deferredErr) {
+			t.Errorf("robots.txt fetch of %s should have been rate limited: %v", test.hostname, err)
+		}
+	}
+
+	// The robots.txt is not fetched while the hostname is throttled
+	u, _ := url.Parse("https://unavailable.onion/index.html")
+	if err := s.robotsCache.Remove("https://unavailable.onion"); err != nil {
+		t.FailNow()
+	}
+	if _, err := s.getRobotsTxt(u, 24*time.Hour); !errors.Is(err, errHostnameThrottled) {
+		t.Errorf("robots.txt fetch should have been throttled: %v", err)
+	}
+}
+
+func TestFetchRobotsTxt_TTL(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	httpClientMock := http_mock.NewMockClient(mockCtrl)
+	s := State{httpClient: httpClientMock}
+
+	// The failures are cached for a short time only
+	httpClientMock.EXPECT().Get("https://example.onion/robots.txt").Return(nil, &chttp.StatusCodeError{Code: 500})
+	if _, TTL, err := s.fetchRobotsTxt("https://example.onion/robots.txt", 24*time.Hour); err != nil || TTL != robotsTxtFailureTTL {
+		t.Errorf("wrong TTL: %s (%v)", TTL, err)
+	}
+
+	httpClientMock.EXPECT().Get("https://example.onion/robots.txt").Return(nil, &chttp.StatusCodeError{Code: 500})
+	if _, TTL, err := s.fetchRobotsTxt("https://example.onion/robots.txt", time.Minute); err != nil || TTL != time.Minute {
+		t.Errorf("wrong TTL: %s (%v)", TTL, err)
+	}
+
+	httpClientMock.EXPECT().Get("https://example.onion/robots.txt").Return(nil, &chttp.StatusCodeError{Code: 410})
+	if _, TTL, err := s.fetchRobotsTxt("https://example.onion/robots.txt", 24*time.Hour); err != nil || TTL != 24*time.Hour {
+		t.Errorf("wrong TTL: %s (%v)", TTL, err)
+	}
+}
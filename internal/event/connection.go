@@ -0,0 +1,281 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"github.com/streadway/amqp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// minReconnectDelay is the delay before the first reconnection attempt
+	minReconnectDelay = time.Second
+	// maxReconnectDelay is the maximum delay between two reconnection attempts
+	maxReconnectDelay = 30 * time.Second
+)
+
+var (
+	errChannelClosed    = errors.New("channel is closed")
+	errConsumersDied    = errors.New("consumers have stopped")
+	errSubscriberClosed = errors.New("subscriber is closed")
+)
+
+// setupFunc declare the topology (exchanges, queues, bindings) and start the consumers
+// it needs on given channel
+type setupFunc func(channel *amqp.Channel) error
+
+// connection is an AMQP channel re-opened (with backoff) when the connection to the broker is lost.
+// The registered setups are run again on the new channel, to re-declare the topology
+// and re-register the consumers.
+type connection struct {
+	uri      string
+	prefetch int
+
+	mutex   sync.RWMutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	// err is set while the channel is closed
+	err error
+	// deadQueues are the queues whose consumer has been cancelled by the broker
+	deadQueues []string
+
+	// setupMutex prevent setups to be registered while the channel is re-opened
+	setupMutex sync.Mutex
+	setups     []setupFunc
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// dial connect to given AMQP broker. Zero prefetch means no prefetch limit
+func dial(uri string, prefetch int) (*connection, error) {
+	c := &connection{
+		uri:      uri,
+		prefetch: prefetch,
+		done:     make(chan struct{}),
+	}
+
+	if err := c.open(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// open establish a new connection & channel to the broker
+func (c *connection) open() error {
+	conn, err := amqp.Dial(c.uri)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	if c.prefetch > 0 {
+		if err := ch.Qos(c.prefetch, 0, false); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
+	// Register the notifications before the channel is used
+	closes := ch.NotifyClose(make(chan *amqp.Error, 1))
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
+	c.mutex.Lock()
+	c.conn = conn
+	c.channel = ch
+	c.err = nil
+	c.mutex.Unlock()
+
+	go c.watch(closes, cancels)
+
+	return nil
+}
+
+// watch the channel notifications, and re-open it once closed
+func (c *connection) watch(closes chan *amqp.Error, cancels chan string) {
+	for {
+		select {
+		case queue, ok := <-cancels:
+			if !ok {
+				cancels = nil
+				continue
+			}
+
+			// The consumer tag is the queue name
+			log.Warn().Str("queue", queue).Msg("Consumer has been cancelled by the broker")
+
+			c.mutex.Lock()
+			c.deadQueues = append(c.deadQueues, queue)
+			c.mutex.Unlock()
+		case err := <-closes:
+			c.mutex.Lock()
+			c.err = errChannelClosed
+			if err != nil {
+				c.err = fmt.Errorf("%w: %s", errChannelClosed, err)
+			}
+			conn := c.conn
+			c.mutex.Unlock()
+
+			// Closed by ourselves
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+
+			log.Warn().Err(err).Msg("Connection to the event server lost")
+
+			// Make sure the underlying connection is released (the channel may have been closed alone)
+			_ = conn.Close()
+
+			c.reconnect()
+			return
+		}
+	}
+}
+
+// reconnect re-open the channel and run the setups again, until it succeed or the connection is closed
+func (c *connection) reconnect() {
+	c.setupMutex.Lock()
+	defer c.setupMutex.Unlock()
+
+	for attempts := 1; ; attempts++ {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(reconnectDelay(attempts)):
+		}
+
+		if err := c.open(); err != nil {
+			log.Err(err).Int("attempts", attempts).Msg("error while reconnecting to the event server")
+			continue
+		}
+
+		// Closed while reconnecting
+		select {
+		case <-c.done:
+			c.mutex.RLock()
+			_ = c.conn.Close()
+			c.mutex.RUnlock()
+			return
+		default:
+		}
+
+		// The setups declare the queues and start their consumers again
+		c.resetDeadQueues()
+
+		if err := c.runSetups(); err != nil {
+			log.Err(err).Int("attempts", attempts).Msg("error while restoring the event topology")
+
+			// The channel is useless, closing it will trigger another reconnection
+			_ = c.getChannel().Close()
+			return
+		}
+
+		log.Info().Int("attempts", attempts).Msg("Reconnected to the event server")
+		return
+	}
+}
+
+// resetDeadQueues forget the queues whose consumer has been cancelled on the previous channel
+func (c *connection) resetDeadQueues() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.deadQueues = nil
+}
+
+// runSetups must be called with the setup mutex held
+func (c *connection) runSetups() error {
+	ch := c.getChannel()
+	for _, setup := range c.setups {
+		if err := setup(ch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setup run given setup on the current channel, and register it to be run again on reconnection
+func (c *connection) setup(setup setupFunc) error {
+	c.setupMutex.Lock()
+	defer c.setupMutex.Unlock()
+
+	if err := setup(c.getChannel()); err != nil {
+		return err
+	}
+
+	c.setups = append(c.setups, setup)
+	return nil
+}
+
+// getChannel returns the current channel
+func (c *connection) getChannel() *amqp.Channel {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.channel
+}
+
+// Ping returns an error if the channel is closed
+func (c *connection) Ping() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.err
+}
+
+// CheckConsumers returns an error if a consumer has been cancelled by the broker
+func (c *connection) CheckConsumers() error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.deadQueues) > 0 {
+		return fmt.Errorf("%w: %s", errConsumersDied, strings.Join(c.deadQueues, ", "))
+	}
+
+	return nil
+}
+
+// Close the connection, it will not be re-opened
+func (c *connection) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.mutex.RLock()
+		conn := c.conn
+		c.mutex.RUnlock()
+
+		// The connection may be already closed if lost
+		if err = conn.Close(); err == amqp.ErrClosed {
+			err = nil
+		}
+	})
+
+	return err
+}
+
+// reconnectDelay returns the delay to wait before given reconnection attempt
+func reconnectDelay(attempts int) time.Duration {
+	delay := minReconnectDelay
+	for i := 1; i < attempts && delay < maxReconnectDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxReconnectDelay {
+		delay = maxReconnectDelay
+	}
+
+	return delay
+}
@@ -0,0 +1,38 @@
+package event
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	tests := map[int]time.Duration{
+		0:  time.Second,
+		1:  time.Second,
+		2:  2 * time.Second,
+		3:  4 * time.Second,
+		5:  16 * time.Second,
+		6:  30 * time.Second,
+		42: 30 * time.Second,
+	}
+
+	for attempts, want := range tests {
+		if got := reconnectDelay(attempts); got != want {
+			t.Errorf("wrong delay for %d attempts: (got: %s, want: %s)", attempts, got, want)
+		}
+	}
+}
+
+func TestConnection_ResetDeadQueues(t *testing.T) {
+	c := &connection{deadQueues: []string{"schedulingQueue"}}
+	if err := c.CheckConsumers(); !errors.Is(err, errConsumersDied) {
+		t.Errorf("dead consumer should be reported: %v", err)
+	}
+
+	// Once reconnected, the consumers are started again
+	c.resetDeadQueues()
+	if err := c.CheckConsumers(); err != nil {
+		t.Errorf("consumers should be alive: %s", err)
+	}
+}
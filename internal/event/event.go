@@ -2,7 +2,10 @@ package event
 
 //go:generate mockgen -destination=../event_mock/event_mock.go -package=event_mock . Publisher,Subscriber
 
-import "time"
+import (
+	"crypto/ed25519"
+	"time"
+)
 
 const (
 	// NewURLExchange is the exchange used when an URL is schedule for crawling
@@ -24,6 +27,12 @@ type Event interface {
 // NewURLEvent represent an URL to crawl
 type NewURLEvent struct {
 	URL string `json:"url"`
+	// Depth is the distance (in links) from the seed
+	Depth int `json:"depth"`
+	// Seed is the URL from where the crawling has started
+	Seed string `json:"seed"`
+	// PublicKey is the public key of the hidden service, extracted from its v3 onion address
+	PublicKey ed25519.PublicKey `json:"public-key,omitempty"`
 }
 
 // Exchange returns the exchange where event should be push
@@ -47,6 +56,10 @@ type NewResourceEvent struct {
 	Body    string            `json:"body"`
 	Headers map[string]string `json:"headers"`
 	Time    time.Time         `json:"time"`
+	Depth   int               `json:"depth"`
+	Seed    string            `json:"seed"`
+	// PublicKey is the public key of the hidden service, extracted from its v3 onion address
+	PublicKey ed25519.PublicKey `json:"public-key,omitempty"`
 }
 
 // Exchange returns the exchange where event should be push
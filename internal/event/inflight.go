@@ -0,0 +1,63 @@
+package event
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errDrainTimeout = errors.New("events are still being handled")
+
+// inFlight track the events being handled, so that a subscriber can be drained
+type inFlight struct {
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{}
+}
+
+// begin record that an event is being handled. It returns false if the subscriber is draining,
+// in which case the event should not be handled
+func (f *inFlight) begin() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.draining {
+		return false
+	}
+
+	f.wg.Add(1)
+	return true
+}
+
+// end record that an event has been handled
+func (f *inFlight) end() {
+	f.wg.Done()
+}
+
+// stop accepting new events
+func (f *inFlight) stop() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.draining = true
+}
+
+// wait (up to given timeout) for the events being handled
+func (f *inFlight) wait(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return errDrainTimeout
+	}
+}
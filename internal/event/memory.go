@@ -0,0 +1,375 @@
+package event
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// MemoryScheme is the URI scheme used to select the in-process event bus
+const MemoryScheme = "memory"
+
+var (
+	memoryBusesMutex sync.Mutex
+	memoryBuses      = map[string]*memoryBus{}
+)
+
+// getMemoryBus returns the in-process bus with given name, creating it if needed.
+// Every publisher & subscriber using the same name share the same bus.
+func getMemoryBus(name string) *memoryBus {
+	memoryBusesMutex.Lock()
+	defer memoryBusesMutex.Unlock()
+
+	bus, exist := memoryBuses[name]
+	if !exist {
+		bus = &memoryBus{
+			bindings:    map[string][]*memoryQueue{},
+			queues:      map[string]*memoryQueue{},
+			deadLetters: map[string][]RawMessage{},
+		}
+		memoryBuses[name] = bus
+	}
+
+	return bus
+}
+
+// memoryBus is an in-process broker mimicking the fanout exchanges of the AMQP broker
+type memoryBus struct {
+	mutex       sync.RWMutex
+	bindings    map[string][]*memoryQueue
+	queues      map[string]*memoryQueue
+	deadLetters map[string][]RawMessage
+	// used to generate the exclusive queues names
+	exclusiveCount int
+}
+
+// declareQueue returns the queue with given name bound to given exchange, creating it if needed
+func (b *memoryBus) declareQueue(exchange, name string) *memoryQueue {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	q, exist := b.queues[name]
+	if !exist {
+		q = newMemoryQueue(name)
+		b.queues[name] = q
+	}
+
+	for _, bound := range b.bindings[exchange] {
+		if bound == q {
+			return q
+		}
+	}
+	b.bindings[exchange] = append(b.bindings[exchange], q)
+
+	return q
+}
+
+// declareExclusiveQueue returns a new queue with a generated name bound to given exchange
+func (b *memoryBus) declareExclusiveQueue(exchange string) *memoryQueue {
+	b.mutex.Lock()
+	b.exclusiveCount++
+	name := fmt.Sprintf("amq.gen-%d", b.exclusiveCount)
+	b.mutex.Unlock()
+
+	return b.declareQueue(exchange, name)
+}
+
+// deleteQueue unbind & delete given queue, pending messages are lost
+func (b *memoryBus) deleteQueue(q *memoryQueue) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for exchange, queues := range b.bindings {
+		var remaining []*memoryQueue
+		for _, bound := range queues {
+			if bound != q {
+				remaining = append(remaining, bound)
+			}
+		}
+		b.bindings[exchange] = remaining
+	}
+	delete(b.queues, q.name)
+
+	close(q.in)
+}
+
+// publish dispatch given message to every queue bound to given exchange
+func (b *memoryBus) publish(exchange string, msg RawMessage) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, q := range b.bindings[exchange] {
+		q.in <- RawMessage{Body: msg.Body, Headers: copyHeaders(msg.Headers)}
+	}
+}
+
+// publishToQueue push given message directly in given queue, after given delay
+func (b *memoryBus) publishToQueue(queue string, msg RawMessage, delay time.Duration) {
+	push := func() {
+		b.mutex.RLock()
+		defer b.mutex.RUnlock()
+
+		if q, exist := b.queues[queue]; exist {
+			q.in <- msg
+		}
+	}
+
+	if delay > 0 {
+		time.AfterFunc(delay, push)
+	} else {
+		push()
+	}
+}
+
+func (b *memoryBus) addDeadLetter(queue string, msg RawMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.deadLetters[queue] = append(b.deadLetters[queue], msg)
+}
+
+func (b *memoryBus) popDeadLetters(queue string) []RawMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	msgs := b.deadLetters[queue]
+	delete(b.deadLetters, queue)
+
+	return msgs
+}
+
+// memoryQueue is an unbounded FIFO queue: publishing never blocks
+// and messages are dispatched to the competing consumers
+type memoryQueue struct {
+	name string
+	in   chan RawMessage
+	out  chan RawMessage
+}
+
+func newMemoryQueue(name string) *memoryQueue {
+	q := &memoryQueue{
+		name: name,
+		in:   make(chan RawMessage),
+		out:  make(chan RawMessage),
+	}
+	go q.run()
+
+	return q
+}
+
+func (q *memoryQueue) run() {
+	var pending []RawMessage
+
+	for {
+		// Only try to dispatch if there's something to dispatch
+		var out chan RawMessage
+		var next RawMessage
+		if len(pending) > 0 {
+			out = q.out
+			next = pending[0]
+		}
+
+		select {
+		case msg, ok := <-q.in:
+			if !ok {
+				return
+			}
+			pending = append(pending, msg)
+		case out <- next:
+			pending = pending[1:]
+		}
+	}
+}
+
+type memoryPublisher struct {
+	bus *memoryBus
+}
+
+func newMemoryPublisher(name string) Publisher {
+	return &memoryPublisher{bus: getMemoryBus(name)}
+}
+
+func (p *memoryPublisher) PublishEvent(event Event) error {
+	evtBytes, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error while encoding event: %s", err)
+	}
+
+	return p.PublishJSON(event.Exchange(), RawMessage{Body: evtBytes})
+}
+
+func (p *memoryPublisher) PublishJSON(exchange string, msg RawMessage) error {
+	p.bus.publish(exchange, msg)
+	return recordPublished(exchange, nil)
+}
+
+func (p *memoryPublisher) Ping() error {
+	return nil
+}
+
+func (p *memoryPublisher) Close() error {
+	return nil
+}
+
+type memorySubscriber struct {
+	memoryPublisher
+	*inFlight
+
+	done      chan struct{}
+	closeOnce sync.Once
+	// exclusive queues to delete when closing
+	exclusiveQueues []*memoryQueue
+	mutex           sync.Mutex
+}
+
+func newMemorySubscriber(name string) Subscriber {
+	return &memorySubscriber{
+		memoryPublisher: memoryPublisher{bus: getMemoryBus(name)},
+		inFlight:        newInFlight(),
+		done:            make(chan struct{}),
+	}
+}
+
+func (s *memorySubscriber) Ping() error {
+	select {
+	case <-s.done:
+		return errSubscriberClosed
+	default:
+		return nil
+	}
+}
+
+// CheckConsumers always succeed since the delivery loops only stop once closed
+func (s *memorySubscriber) CheckConsumers() error {
+	return nil
+}
+
+func (s *memorySubscriber) Drain(timeout time.Duration) error {
+	s.stop()
+	return s.wait(timeout)
+}
+
+func (s *memorySubscriber) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		for _, q := range s.exclusiveQueues {
+			s.bus.deleteQueue(q)
+		}
+		s.exclusiveQueues = nil
+	})
+
+	return nil
+}
+
+func (s *memorySubscriber) Read(msg *RawMessage, event Event) error {
+	if err := json.Unmarshal(msg.Body, event); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *memorySubscriber) Subscribe(exchange, queue string, handler Handler) error {
+	go s.consume(s.bus.declareQueue(exchange, queue), handler, nil)
+	return nil
+}
+
+func (s *memorySubscriber) SubscribeWithRetry(exchange, queue string, handler Handler, policy RetryPolicy) error {
+	go s.consume(s.bus.declareQueue(exchange, queue), handler, &policy)
+	return nil
+}
+
+func (s *memorySubscriber) SubscribeAll(exchange string, handler Handler) error {
+	// Each call use its own exclusive queue so that everyone receive the messages
+	q := s.bus.declareExclusiveQueue(exchange)
+
+	s.mutex.Lock()
+	s.exclusiveQueues = append(s.exclusiveQueues, q)
+	s.mutex.Unlock()
+
+	go s.consume(q, handler, nil)
+	return nil
+}
+
+func (s *memorySubscriber) ReplayDeadLetters(queue string) (int, error) {
+	msgs := s.bus.popDeadLetters(queue)
+
+	for _, msg := range msgs {
+		// Reset the retry state before publishing the event back in its queue
+		headers := copyHeaders(msg.Headers)
+		delete(headers, AttemptsHeader)
+		delete(headers, ErrorHeader)
+
+		s.bus.publishToQueue(queue, RawMessage{Body: msg.Body, Headers: headers}, 0)
+	}
+
+	return len(msgs), nil
+}
+
+func (s *memorySubscriber) consume(q *memoryQueue, handler Handler, policy *RetryPolicy) {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-q.out:
+			// Draining: put the event back and stop consuming
+			if !s.begin() {
+				s.bus.publishToQueue(q.name, msg, 0)
+				return
+			}
+
+			s.handle(q, msg, handler, policy)
+			s.end()
+		}
+	}
+}
+
+// handle the given message
+func (s *memorySubscriber) handle(q *memoryQueue, msg RawMessage, handler Handler, policy *RetryPolicy) {
+	var deferredErr *DeferredError
+
+	if err := handler(s, msg); errors.As(err, &deferredErr) {
+		log.Debug().
+			Str("queue", q.name).
+			Stringer("delay", deferredErr.Delay).
+			Str("reason", deferredErr.Reason.Error()).
+			Msg("Deferring event")
+
+		s.bus.publishToQueue(q.name, msg, deferredErr.Delay)
+	} else if err != nil {
+		log.Err(err).Msg("error while processing event")
+
+		if policy != nil && policy.shouldRetry(err) {
+			s.retry(q.name, msg, policy, err)
+		}
+	}
+}
+
+// retry publish the failed message back in its queue or
+// in the dead letters if max attempts is reached
+func (s *memorySubscriber) retry(queue string, msg RawMessage, policy *RetryPolicy, handlerErr error) {
+	attempts := getAttempts(msg.Headers) + 1
+
+	headers := copyHeaders(msg.Headers)
+	headers[AttemptsHeader] = attempts
+
+	if attempts < policy.MaxAttempts {
+		s.bus.publishToQueue(queue, RawMessage{Body: msg.Body, Headers: headers}, policy.delay(attempts))
+		return
+	}
+
+	log.Warn().
+		Str("queue", queue).
+		Int("attempts", attempts).
+		Msg("Max attempts reached, dead-lettering event")
+
+	headers[ErrorHeader] = handlerErr.Error()
+	s.bus.addDeadLetter(queue, RawMessage{Body: msg.Body, Headers: headers})
+}
@@ -0,0 +1,310 @@
+package event
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestMemorySubscriber(t *testing.T, uri string) Subscriber {
+	sub, err := NewSubscriber(uri, 1)
+	if err != nil {
+		t.Fatalf("error while creating subscriber: %s", err)
+	}
+
+	return sub
+}
+
+func waitURL(t *testing.T, ch <-chan string) string {
+	select {
+	case u := <-ch:
+		return u
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for event")
+		return ""
+	}
+}
+
+func assertNoURL(t *testing.T, ch <-chan string) {
+	select {
+	case u := <-ch:
+		t.Errorf("unexpected event received: %s", u)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func urlHandler(ch chan<- string) Handler {
+	return func(sub Subscriber, msg RawMessage) error {
+		var evt NewURLEvent
+		if err := sub.Read(&msg, &evt); err != nil {
+			return err
+		}
+
+		ch <- evt.URL
+		return nil
+	}
+}
+
+func TestNewPublisher_Memory(t *testing.T) {
+	sub := newTestMemorySubscriber(t, "memory://publisher")
+	defer sub.Close()
+
+	urls := make(chan string, 1)
+	if err := sub.Subscribe(NewURLExchange, "crawlingQueue", urlHandler(urls)); err != nil {
+		t.FailNow()
+	}
+
+	pub, err := NewPublisher("memory://publisher")
+	if err != nil {
+		t.FailNow()
+	}
+	defer pub.Close()
+
+	if err := pub.PublishEvent(&NewURLEvent{URL: "https://example.onion"}); err != nil {
+		t.FailNow()
+	}
+
+	if u := waitURL(t, urls); u != "https://example.onion" {
+		t.Errorf("wrong url: (got: %s, want: %s)", u, "https://example.onion")
+	}
+}
+
+func TestMemorySubscriber_Subscribe(t *testing.T) {
+	first := newTestMemorySubscriber(t, "memory://subscribe")
+	defer first.Close()
+	second := newTestMemorySubscriber(t, "memory://subscribe")
+	defer second.Close()
+
+	// Both are competing on the same queue
+	urls := make(chan string, 10)
+	if err := first.Subscribe(NewURLExchange, "crawlingQueue", urlHandler(urls)); err != nil {
+		t.FailNow()
+	}
+	if err := second.Subscribe(NewURLExchange, "crawlingQueue", urlHandler(urls)); err != nil {
+		t.FailNow()
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := first.PublishEvent(&NewURLEvent{URL: "https://example.onion"}); err != nil {
+			t.FailNow()
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		waitURL(t, urls)
+	}
+	assertNoURL(t, urls)
+}
+
+func TestMemorySubscriber_SubscribeAll(t *testing.T) {
+	first := newTestMemorySubscriber(t, "memory://subscribe-all")
+	second := newTestMemorySubscriber(t, "memory://subscribe-all")
+	defer second.Close()
+
+	firstURLs := make(chan string, 10)
+	secondURLs := make(chan string, 10)
+	if err := first.SubscribeAll(NewURLExchange, urlHandler(firstURLs)); err != nil {
+		t.FailNow()
+	}
+	if err := second.SubscribeAll(NewURLExchange, urlHandler(secondURLs)); err != nil {
+		t.FailNow()
+	}
+
+	if err := first.PublishEvent(&NewURLEvent{URL: "https://example.onion"}); err != nil {
+		t.FailNow()
+	}
+
+	waitURL(t, firstURLs)
+	waitURL(t, secondURLs)
+
+	// Once closed the subscriber should not receive anything
+	if err := first.Close(); err != nil {
+		t.FailNow()
+	}
+
+	if err := second.PublishEvent(&NewURLEvent{URL: "https://example.onion"}); err != nil {
+		t.FailNow()
+	}
+
+	waitURL(t, secondURLs)
+	assertNoURL(t, firstURLs)
+}
+
+func TestMemorySubscriber_SubscribeWithRetry(t *testing.T) {
+	sub := newTestMemorySubscriber(t, "memory://retry")
+	defer sub.Close()
+
+	errExpected := errors.New("expected error")
+
+	attempts := make(chan int, 10)
+	handler := func(s Subscriber, msg RawMessage) error {
+		attempts <- getAttempts(msg.Headers)
+
+		if len(msg.Body) == 0 {
+			return errExpected
+		}
+		return errors.New("index is not available")
+	}
+
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond, Ignore: []error{errExpected}}
+	if err := sub.SubscribeWithRetry(NewResourceExchange, "indexingQueue", handler, policy); err != nil {
+		t.FailNow()
+	}
+
+	if err := sub.PublishJSON(NewResourceExchange, RawMessage{Body: []byte("{}")}); err != nil {
+		t.FailNow()
+	}
+
+	for want := 0; want < 3; want++ {
+		select {
+		case got := <-attempts:
+			if got != want {
+				t.Errorf("wrong attempts: (got: %d, want: %d)", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout while waiting for retry")
+		}
+	}
+
+	// Ignored errors are not retried
+	if err := sub.PublishJSON(NewResourceExchange, RawMessage{}); err != nil {
+		t.FailNow()
+	}
+	<-attempts
+
+	select {
+	case got := <-attempts:
+		t.Errorf("unexpected retry (attempts: %d)", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The first event should have been dead-lettered
+	bus := getMemoryBus("retry")
+	bus.mutex.RLock()
+	deadLetters := bus.deadLetters["indexingQueue"]
+	bus.mutex.RUnlock()
+
+	if len(deadLetters) != 1 {
+		t.Fatalf("wrong number of dead letters: %d", len(deadLetters))
+	}
+	if deadLetters[0].Headers[ErrorHeader] != "index is not available" {
+		t.Errorf("wrong error header: %v", deadLetters[0].Headers[ErrorHeader])
+	}
+
+	count, err := sub.ReplayDeadLetters("indexingQueue")
+	if err != nil {
+		t.FailNow()
+	}
+	if count != 1 {
+		t.Errorf("wrong number of replayed events: %d", count)
+	}
+
+	// Replayed event is processed again from scratch
+	select {
+	case got := <-attempts:
+		if got != 0 {
+			t.Errorf("wrong attempts: (got: %d, want: %d)", got, 0)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for replayed event")
+	}
+}
+
+func TestMemorySubscriber_Defer(t *testing.T) {
+	sub := newTestMemorySubscriber(t, "memory://defer")
+	defer sub.Close()
+
+	received := make(chan time.Time, 10)
+	deliveries := 0
+	handler := func(s Subscriber, msg RawMessage) error {
+		deliveries++
+		received <- time.Now()
+
+		// Only defer the first delivery
+		if deliveries == 1 {
+			return Defer(20*time.Millisecond, errors.New("crawl delay not elapsed"))
+		}
+		return nil
+	}
+
+	policy := RetryPolicy{MaxAttempts: 1}
+	if err := sub.SubscribeWithRetry(NewURLExchange, "crawlingQueue", handler, policy); err != nil {
+		t.FailNow()
+	}
+
+	if err := sub.PublishJSON(NewURLExchange, RawMessage{Body: []byte("{}")}); err != nil {
+		t.FailNow()
+	}
+
+	first := <-received
+	select {
+	case second := <-received:
+		if second.Sub(first) < 20*time.Millisecond {
+			t.Errorf("event delivered too early: %s", second.Sub(first))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for deferred event")
+	}
+
+	// Deferring should not count as a failed attempt
+	bus := getMemoryBus("defer")
+	bus.mutex.RLock()
+	deadLetters := bus.deadLetters["crawlingQueue"]
+	bus.mutex.RUnlock()
+
+	if len(deadLetters) != 0 {
+		t.Errorf("deferred event has been dead-lettered")
+	}
+}
+
+func TestMemorySubscriber_Drain(t *testing.T) {
+	first := newTestMemorySubscriber(t, "memory://drain")
+	defer first.Close()
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	handled := make(chan string, 10)
+
+	if err := first.Subscribe(NewURLExchange, "crawlingQueue", func(sub Subscriber, msg RawMessage) error {
+		started <- struct{}{}
+		<-release
+		return urlHandler(handled)(sub, msg)
+	}); err != nil {
+		t.FailNow()
+	}
+
+	if err := first.PublishEvent(&NewURLEvent{URL: "https://example.onion"}); err != nil {
+		t.FailNow()
+	}
+	<-started
+
+	// The in-flight event is not handled within the deadline
+	if err := first.Drain(10 * time.Millisecond); !errors.Is(err, errDrainTimeout) {
+		t.Errorf("drain should have timed out: %v", err)
+	}
+
+	close(release)
+	if err := first.Drain(time.Second); err != nil {
+		t.Errorf("error while draining: %s", err)
+	}
+	if u := waitURL(t, handled); u != "https://example.onion" {
+		t.Errorf("wrong url: (got: %s, want: %s)", u, "https://example.onion")
+	}
+
+	// The events published once drained are left to the other subscribers
+	if err := first.PublishEvent(&NewURLEvent{URL: "https://google.onion"}); err != nil {
+		t.FailNow()
+	}
+	assertNoURL(t, handled)
+
+	second := newTestMemorySubscriber(t, "memory://drain")
+	defer second.Close()
+
+	urls := make(chan string, 1)
+	if err := second.Subscribe(NewURLExchange, "crawlingQueue", urlHandler(urls)); err != nil {
+		t.FailNow()
+	}
+	if u := waitURL(t, urls); u != "https://google.onion" {
+		t.Errorf("wrong url: (got: %s, want: %s)", u, "https://google.onion")
+	}
+}
@@ -0,0 +1,22 @@
+package event
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var publishedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "bathyscaphe",
+	Subsystem: "event",
+	Name:      "published_total",
+	Help:      "The number of events published, per exchange",
+}, []string{"exchange"})
+
+// recordPublished update the metrics once an event has been published
+func recordPublished(exchange string, err error) error {
+	if err == nil {
+		publishedEvents.WithLabelValues(exchange).Inc()
+	}
+
+	return err
+}
@@ -4,34 +4,40 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/streadway/amqp"
+	"net/url"
 )
 
 // Publisher is something that push an event
 type Publisher interface {
 	PublishEvent(event Event) error
 	PublishJSON(exchange string, msg RawMessage) error
+	// Ping returns an error if the connection to the event server is broken
+	Ping() error
 	Close() error
 }
 
+// publisher is re-connected when the connection to the broker is lost
 type publisher struct {
-	channel *amqp.Channel
+	*connection
 }
 
-// NewPublisher create a new Publisher instance
-func NewPublisher(amqpURI string) (Publisher, error) {
-	conn, err := amqp.Dial(amqpURI)
+// NewPublisher create a new Publisher instance.
+// The server is either an AMQP broker or the in-process bus (memory://name)
+func NewPublisher(uri string) (Publisher, error) {
+	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
+	if u.Scheme == MemoryScheme {
+		return newMemoryPublisher(u.Host), nil
+	}
 
-	c, err := conn.Channel()
+	c, err := dial(uri, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	return &publisher{
-		channel: c,
-	}, nil
+	return &publisher{connection: c}, nil
 }
 
 func (p *publisher) PublishEvent(event Event) error {
@@ -44,14 +50,12 @@ func (p *publisher) PublishEvent(event Event) error {
 }
 
 func (p *publisher) PublishJSON(exchange string, msg RawMessage) error {
-	return p.channel.Publish(exchange, "", false, false, amqp.Publishing{
+	err := p.getChannel().Publish(exchange, "", false, false, amqp.Publishing{
 		ContentType:  "application/json",
 		Body:         msg.Body,
 		DeliveryMode: amqp.Persistent,
 		Headers:      msg.Headers,
 	})
-}
 
-func (p *publisher) Close() error {
-	return p.channel.Close()
+	return recordPublished(exchange, err)
 }
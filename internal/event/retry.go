@@ -0,0 +1,128 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// AttemptsHeader is the header used to track how many times an event has been processed
+	AttemptsHeader = "Attempts"
+	// ErrorHeader is the header holding the error that caused an event to be dead-lettered
+	ErrorHeader = "Error"
+)
+
+// RetryPolicy define how an event whose handler has failed should be retried
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an event is processed before being dead-lettered
+	MaxAttempts int
+	// Backoff is the delay before the first retry, it is doubled after each attempt
+	Backoff time.Duration
+	// Ignore is the list of errors that are expected and should not be retried
+	Ignore []error
+}
+
+// shouldRetry determinate if the event should be delivered again after given error
+func (p *RetryPolicy) shouldRetry(err error) bool {
+	for _, ignored := range p.Ignore {
+		if errors.Is(err, ignored) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// delay returns the delay to wait before delivering the event again
+func (p *RetryPolicy) delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	return p.Backoff * time.Duration(1<<uint(attempts-1))
+}
+
+// getAttempts returns the number of processing attempts recorded in given headers
+func getAttempts(headers map[string]interface{}) int {
+	switch val := headers[AttemptsHeader].(type) {
+	case int:
+		return val
+	case int32:
+		return int(val)
+	case int64:
+		return int(val)
+	default:
+		return 0
+	}
+}
+
+// copyHeaders returns a copy of given headers so they can be updated safely
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	for key, value := range headers {
+		res[key] = value
+	}
+	return res
+}
+
+const (
+	// minRetryDelay is the delay of the shortest retry queue
+	minRetryDelay = time.Second
+	// retryQueuesCount is the number of retry queues declared per queue, the delay of the
+	// longest one (a bit more than 1 hour) bounding how long an event is delayed at once
+	retryQueuesCount = 13
+)
+
+// retryDelays returns the delays of the retry queues: since the broker only expires the messages
+// at the head of a queue, each retry queue hold messages with the same delay
+func retryDelays() []time.Duration {
+	delays := make([]time.Duration, retryQueuesCount)
+	for i := range delays {
+		delays[i] = minRetryDelay << uint(i)
+	}
+	return delays
+}
+
+// retryDelay returns the delay of the retry queue to park an event delayed for given delay in:
+// the shortest delay not being lower than given one, so that the event is never delivered too early
+func retryDelay(delay time.Duration) time.Duration {
+	delays := retryDelays()
+	for _, d := range delays {
+		if d >= delay {
+			return d
+		}
+	}
+
+	// The event is deferred again by its handler if delivered too early
+	return delays[len(delays)-1]
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%ds", queue, delay/time.Second)
+}
+
+func deadLetterName(queue string) string {
+	return queue + ".dead"
+}
+
+// DeferredError is returned by an Handler to have the event delivered again after Delay.
+// Deferring an event does not count as a failed attempt.
+type DeferredError struct {
+	Delay  time.Duration
+	Reason error
+}
+
+// Defer returns an error asking the subscriber to deliver the event again after given delay
+func Defer(delay time.Duration, reason error) error {
+	return &DeferredError{Delay: delay, Reason: reason}
+}
+
+func (e *DeferredError) Error() string {
+	return fmt.Sprintf("event deferred for %s: %s", e.Delay, e.Reason)
+}
+
+// Unwrap returns the reason of the deferring
+func (e *DeferredError) Unwrap() error {
+	return e.Reason
+}
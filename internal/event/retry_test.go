@@ -0,0 +1,94 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_ShouldRetry(t *testing.T) {
+	errExpected := errors.New("expected error")
+
+	policy := RetryPolicy{Ignore: []error{errExpected}}
+
+	if !policy.shouldRetry(errors.New("connection refused")) {
+		t.Error("unexpected error should be retried")
+	}
+	if policy.shouldRetry(errExpected) {
+		t.Error("ignored error should not be retried")
+	}
+	if policy.shouldRetry(fmt.Errorf("https://example.onion %w", errExpected)) {
+		t.Error("wrapped ignored error should not be retried")
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	policy := RetryPolicy{Backoff: time.Second}
+
+	tests := map[int]time.Duration{
+		0: time.Second,
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		5: 16 * time.Second,
+	}
+
+	for attempts, want := range tests {
+		if got := policy.delay(attempts); got != want {
+			t.Errorf("wrong delay for %d attempts: (got: %s, want: %s)", attempts, got, want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := map[time.Duration]time.Duration{
+		time.Millisecond:        time.Second,
+		time.Second:             time.Second,
+		1500 * time.Millisecond: 2 * time.Second,
+		10 * time.Second:        16 * time.Second,
+		64 * time.Second:        64 * time.Second,
+		24 * time.Hour:          4096 * time.Second,
+	}
+
+	for delay, want := range tests {
+		if got := retryDelay(delay); got != want {
+			t.Errorf("wrong retry delay for %s: (got: %s, want: %s)", delay, got, want)
+		}
+	}
+
+	if name := retryQueueName("crawlingQueue", 16*time.Second); name != "crawlingQueue.retry.16s" {
+		t.Errorf("wrong retry queue name: %s", name)
+	}
+}
+
+func TestGetAttempts(t *testing.T) {
+	tests := []struct {
+		headers map[string]interface{}
+		want    int
+	}{
+		{headers: nil, want: 0},
+		{headers: map[string]interface{}{"Config-Key": "test"}, want: 0},
+		{headers: map[string]interface{}{AttemptsHeader: 2}, want: 2},
+		{headers: map[string]interface{}{AttemptsHeader: int32(3)}, want: 3},
+		{headers: map[string]interface{}{AttemptsHeader: int64(4)}, want: 4},
+		{headers: map[string]interface{}{AttemptsHeader: "5"}, want: 0},
+	}
+
+	for _, test := range tests {
+		if got := getAttempts(test.headers); got != test.want {
+			t.Errorf("wrong attempts for %v: (got: %d, want: %d)", test.headers, got, test.want)
+		}
+	}
+}
+
+func TestCopyHeaders(t *testing.T) {
+	headers := map[string]interface{}{AttemptsHeader: 1}
+
+	res := copyHeaders(headers)
+	res[AttemptsHeader] = 2
+
+	if headers[AttemptsHeader] != 1 {
+		t.Error("original headers have been updated")
+	}
+}
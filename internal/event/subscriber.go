@@ -2,9 +2,13 @@ package event
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/rs/zerolog/log"
 	"github.com/streadway/amqp"
+	"net/url"
+	"sync"
+	"time"
 )
 
 // RawMessage is a raw message as viewed by the messaging system
@@ -26,33 +30,52 @@ type Subscriber interface {
 	// Subscribe to named exchange with unique consuming guaranty
 	Subscribe(exchange, queue string, handler Handler) error
 
+	// SubscribeWithRetry subscribe to named exchange with unique consuming guaranty
+	// failing events are retried using given policy and then dead-lettered
+	SubscribeWithRetry(exchange, queue string, handler Handler, policy RetryPolicy) error
+
 	// SubscribeAll subscribe to given exchange but ensure everyone on the exchange receive the messages
 	SubscribeAll(exchange string, handler Handler) error
+
+	// ReplayDeadLetters re-inject the dead-lettered events of given queue
+	// and returns the number of replayed events
+	ReplayDeadLetters(queue string) (int, error)
+
+	// CheckConsumers returns an error if the delivery loop of a subscription has stopped
+	CheckConsumers() error
+
+	// Drain stop consuming and wait (up to given timeout) for the events being handled
+	Drain(timeout time.Duration) error
 }
 
-// Subscriber represent a subscriber
+// Subscriber represent a subscriber.
+// The topology it declares and its consumers are restored when the connection is re-established
 type subscriber struct {
-	channel *amqp.Channel
+	*connection
+	*inFlight
+
+	mutex sync.Mutex
+	// queues are the consumed queues (which are also the consumer tags)
+	queues []string
 }
 
-// NewSubscriber create a new subscriber and connect it to given server
-func NewSubscriber(amqpURI string, prefetch int) (Subscriber, error) {
-	conn, err := amqp.Dial(amqpURI)
+// NewSubscriber create a new subscriber and connect it to given server.
+// The server is either an AMQP broker or the in-process bus (memory://name)
+func NewSubscriber(uri string, prefetch int) (Subscriber, error) {
+	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
+	if u.Scheme == MemoryScheme {
+		return newMemorySubscriber(u.Host), nil
+	}
 
-	c, err := conn.Channel()
+	c, err := dial(uri, prefetch)
 	if err != nil {
 		return nil, err
 	}
-	if err := c.Qos(prefetch, 0, false); err != nil {
-		return nil, err
-	}
 
-	return &subscriber{
-		channel: c,
-	}, nil
+	return &subscriber{connection: c, inFlight: newInFlight()}, nil
 }
 
 func (s *subscriber) PublishEvent(event Event) error {
@@ -65,16 +88,14 @@ func (s *subscriber) PublishEvent(event Event) error {
 }
 
 func (s *subscriber) PublishJSON(exchange string, msg RawMessage) error {
-	return s.channel.Publish(exchange, "", false, false, amqp.Publishing{
+	err := s.getChannel().Publish(exchange, "", false, false, amqp.Publishing{
 		ContentType:  "application/json",
 		Body:         msg.Body,
 		DeliveryMode: amqp.Persistent,
 		Headers:      msg.Headers,
 	})
-}
 
-func (s *subscriber) Close() error {
-	return s.channel.Close()
+	return recordPublished(exchange, err)
 }
 
 func (s *subscriber) Read(msg *RawMessage, event Event) error {
@@ -86,87 +107,282 @@ func (s *subscriber) Read(msg *RawMessage, event Event) error {
 }
 
 func (s *subscriber) Subscribe(exchange, queue string, handler Handler) error {
-	// First of all declare the exchange
-	if err := s.channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
-		return err
+	return s.subscribe(exchange, queue, handler, nil)
+}
+
+func (s *subscriber) SubscribeWithRetry(exchange, queue string, handler Handler, policy RetryPolicy) error {
+	return s.subscribe(exchange, queue, handler, &policy)
+}
+
+func (s *subscriber) SubscribeAll(exchange string, handler Handler) error {
+	return s.setup(func(channel *amqp.Channel) error {
+		// First of all declare the exchange
+		if err := channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+			return err
+		}
+
+		// Then declare the queue (a new one is generated after each reconnection)
+		q, err := channel.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return err
+		}
+
+		// Bind the queue to the exchange
+		if err := channel.QueueBind(q.Name, "", exchange, false, nil); err != nil {
+			return err
+		}
+
+		return s.consume(channel, q.Name, handler, nil, false)
+	})
+}
+
+func (s *subscriber) Drain(timeout time.Duration) error {
+	s.stop()
+
+	// Stop the consumers, the events not yet delivered will be delivered again by the broker
+	s.mutex.Lock()
+	channel := s.getChannel()
+	for _, queue := range s.queues {
+		if err := channel.Cancel(queue, false); err != nil {
+			log.Err(err).Str("queue", queue).Msg("error while stopping consumer")
+		}
 	}
+	s.mutex.Unlock()
 
-	// Then declare the queue
-	q, err := s.channel.QueueDeclare(queue, true, false, false, false, nil)
-	if err != nil {
+	return s.wait(timeout)
+}
+
+func (s *subscriber) ReplayDeadLetters(queue string) (int, error) {
+	count := 0
+
+	for {
+		delivery, ok, err := s.getChannel().Get(deadLetterName(queue), false)
+		if err != nil {
+			return count, err
+		}
+		if !ok {
+			return count, nil
+		}
+
+		// Reset the retry state before publishing the event back in its queue
+		headers := copyHeaders(delivery.Headers)
+		delete(headers, AttemptsHeader)
+		delete(headers, ErrorHeader)
+
+		if err := s.publishToQueue(queue, delivery.Body, headers, 0); err != nil {
+			_ = delivery.Nack(false, true)
+			return count, err
+		}
+
+		if err := delivery.Ack(false); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+}
+
+func (s *subscriber) subscribe(exchange, queue string, handler Handler, policy *RetryPolicy) error {
+	return s.setup(func(channel *amqp.Channel) error {
+		// First of all declare the exchange
+		if err := channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+			return err
+		}
+
+		// Then declare the queue
+		q, err := channel.QueueDeclare(queue, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		// Bind the queue to the exchange
+		if err := channel.QueueBind(q.Name, "", exchange, false, nil); err != nil {
+			return err
+		}
+
+		// Declare the queues used to delay the events
+		if err := declareRetryQueues(channel, q.Name); err != nil {
+			return err
+		}
+
+		// Declare the dead-letter topology if needed
+		if policy != nil {
+			if err := declareDeadLetterTopology(channel, q.Name); err != nil {
+				return err
+			}
+		}
+
+		return s.consume(channel, q.Name, handler, policy, true)
+	})
+}
+
+// declareRetryQueues declare the queues used to delay the deferred events & retries of given queue,
+// one per delay since the messages expire in order
+func declareRetryQueues(channel *amqp.Channel, queue string) error {
+	for _, delay := range retryDelays() {
+		// Expired messages from the retry queues are routed back to the original queue
+		if _, err := channel.QueueDeclare(retryQueueName(queue, delay), true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// declareDeadLetterTopology declare the dead-letter exchange (and queue) of given queue
+func declareDeadLetterTopology(channel *amqp.Channel, queue string) error {
+	if err := channel.ExchangeDeclare(deadLetterName(queue), amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
 		return err
 	}
 
-	// Bind the queue to the exchange
-	if err := s.channel.QueueBind(q.Name, "", exchange, false, nil); err != nil {
+	if _, err := channel.QueueDeclare(deadLetterName(queue), true, false, false, false, nil); err != nil {
 		return err
 	}
 
+	return channel.QueueBind(deadLetterName(queue), "", deadLetterName(queue), false, nil)
+}
+
+// consume start consuming given queue on given channel. The events are only deferred if the queue supports it.
+// The consumer tag is the queue name so that the cancelled consumers can be identified.
+func (s *subscriber) consume(channel *amqp.Channel, queue string, handler Handler, policy *RetryPolicy, deferrable bool) error {
 	// Start consuming asynchronously
-	deliveries, err := s.channel.Consume(q.Name, "", false, false, false, false, nil)
+	deliveries, err := channel.Consume(queue, queue, false, false, false, false, nil)
 	if err != nil {
 		return err
 	}
 
+	s.mutex.Lock()
+	if !containsString(s.queues, queue) {
+		s.queues = append(s.queues, queue)
+	}
+	s.mutex.Unlock()
+
 	go func() {
 		for delivery := range deliveries {
-			msg := RawMessage{
-				Body:    delivery.Body,
-				Headers: delivery.Headers,
-			}
-			if err := handler(s, msg); err != nil {
-				log.Err(err).Msg("error while processing event")
+			// Draining: let the broker deliver the event again
+			if !s.begin() {
+				if err := delivery.Nack(false, true); err != nil {
+					log.Err(err).Msg("error while rejecting event")
+				}
+				continue
 			}
 
-			// Ack no matter what happen since we doesn't care about failing event (yet?)
-			if err := delivery.Ack(false); err != nil {
-				log.Err(err).Msg("error while acknowledging event")
-			}
+			s.handle(queue, delivery, handler, policy, deferrable)
+			s.end()
 		}
+
+		// Either the channel is closed (and will be re-opened), or the consumer has been cancelled
+		log.Debug().Str("queue", queue).Msg("Consuming has stopped")
 	}()
 
 	return nil
 }
 
-func (s *subscriber) SubscribeAll(exchange string, handler Handler) error {
-	// First of all declare the exchange
-	if err := s.channel.ExchangeDeclare(exchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
-		return err
+// handle the given delivery and acknowledge it
+func (s *subscriber) handle(queue string, delivery amqp.Delivery, handler Handler, policy *RetryPolicy, deferrable bool) {
+	msg := RawMessage{
+		Body:    delivery.Body,
+		Headers: delivery.Headers,
 	}
+	var deferredErr *DeferredError
 
-	// Then declare the queue
-	q, err := s.channel.QueueDeclare("", false, true, true, false, nil)
-	if err != nil {
-		return err
+	if err := handler(s, msg); deferrable && errors.As(err, &deferredErr) {
+		log.Debug().
+			Str("queue", queue).
+			Stringer("delay", deferredErr.Delay).
+			Str("reason", deferredErr.Reason.Error()).
+			Msg("Deferring event")
+
+		if err := s.publishToQueue(queue, delivery.Body, delivery.Headers, deferredErr.Delay); err != nil {
+			log.Err(err).Str("queue", queue).Msg("error while deferring event")
+
+			// Let the broker deliver the event again
+			if err := delivery.Nack(false, true); err != nil {
+				log.Err(err).Msg("error while rejecting event")
+			}
+			return
+		}
+	} else if err != nil {
+		log.Err(err).Msg("error while processing event")
+
+		if policy != nil && policy.shouldRetry(err) {
+			if err := s.retry(queue, delivery, policy, err); err != nil {
+				log.Err(err).Str("queue", queue).Msg("error while retrying event")
+
+				// Let the broker deliver the event again
+				if err := delivery.Nack(false, true); err != nil {
+					log.Err(err).Msg("error while rejecting event")
+				}
+				return
+			}
+		}
 	}
 
-	// Bind the queue to the exchange
-	if err := s.channel.QueueBind(q.Name, "", exchange, false, nil); err != nil {
-		return err
+	// Ack no matter what happen: failing events have been re-published if needed
+	if err := delivery.Ack(false); err != nil {
+		log.Err(err).Msg("error while acknowledging event")
 	}
+}
 
-	// Start consuming asynchronously
-	deliveries, err := s.channel.Consume(q.Name, "", false, false, false, false, nil)
-	if err != nil {
-		return err
+// retry publish the failed delivery in the retry queue or
+// in the dead-letter exchange if max attempts is reached
+func (s *subscriber) retry(queue string, delivery amqp.Delivery, policy *RetryPolicy, handlerErr error) error {
+	attempts := getAttempts(delivery.Headers) + 1
+
+	headers := copyHeaders(delivery.Headers)
+	headers[AttemptsHeader] = int32(attempts)
+
+	if attempts < policy.MaxAttempts {
+		log.Debug().
+			Str("queue", queue).
+			Int("attempts", attempts).
+			Msg("Scheduling event retry")
+
+		return s.publishToQueue(queue, delivery.Body, headers, policy.delay(attempts))
 	}
 
-	go func() {
-		for delivery := range deliveries {
-			msg := RawMessage{
-				Body:    delivery.Body,
-				Headers: delivery.Headers,
-			}
-			if err := handler(s, msg); err != nil {
-				log.Err(err).Msg("error while processing event")
-			}
+	log.Warn().
+		Str("queue", queue).
+		Int("attempts", attempts).
+		Msg("Max attempts reached, dead-lettering event")
 
-			// Ack no matter what happen since we doesn't care about failing event (yet?)
-			if err := delivery.Ack(false); err != nil {
-				log.Err(err).Msg("error while acknowledging event")
-			}
+	headers[ErrorHeader] = handlerErr.Error()
+
+	return s.getChannel().Publish(deadLetterName(queue), "", false, false, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         delivery.Body,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	})
+}
+
+// publishToQueue publish given message directly in given queue, after given delay
+func (s *subscriber) publishToQueue(queue string, body []byte, headers map[string]interface{}, delay time.Duration) error {
+	publishing := amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         body,
+		DeliveryMode: amqp.Persistent,
+		Headers:      headers,
+	}
+
+	// Delayed messages are parked in a retry queue until they expire
+	if delay > 0 {
+		queue = retryQueueName(queue, retryDelay(delay))
+	}
+
+	return s.getChannel().Publish("", queue, false, false, publishing)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
-	}()
+	}
 
-	return nil
+	return false
 }
@@ -12,6 +12,15 @@ import (
 // ErrTimeout is returned when the crawling failed because of timeout issue
 var ErrTimeout = errors.New("timeout has occurred")
 
+// StatusCodeError is returned when the server has answered with a non-managed status code
+type StatusCodeError struct {
+	Code int
+}
+
+func (e *StatusCodeError) Error() string {
+	return fmt.Sprintf("non-managed error code %d", e.Code)
+}
+
 // Client is an HTTP client
 type Client interface {
 	// Get the corresponding URL
@@ -47,7 +56,7 @@ func (c *client) Get(URL string) (Response, error) {
 
 	switch code := resp.StatusCode(); {
 	case code > 302:
-		return nil, fmt.Errorf("non-managed error code %d", code)
+		return nil, &StatusCodeError{Code: code}
 	// follow redirect
 	case code == 301 || code == 302:
 		if location := string(resp.Header.Peek("Location")); location != "" {
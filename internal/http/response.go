@@ -10,6 +10,8 @@ import (
 
 // Response is an HTTP response
 type Response interface {
+	// StatusCode returns the response status code
+	StatusCode() int
 	// Headers returns the response headers
 	Headers() map[string]string
 	// Body return the response body
@@ -20,6 +22,10 @@ type response struct {
 	raw fasthttp.Response
 }
 
+func (r *response) StatusCode() int {
+	return r.raw.StatusCode()
+}
+
 func (r *response) Headers() map[string]string {
 	headers := map[string]string{}
 	r.raw.Header.VisitAll(func(key, value []byte) {
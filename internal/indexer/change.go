@@ -0,0 +1,286 @@
+package indexer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+const (
+	// maxDiffLines is the maximum number of changed lines kept in a diff
+	maxDiffLines = 100
+	// maxDiffCells bound the size of the table used to diff two texts (about 2MB, allocated by each
+	// concurrent handler), bigger texts are only compared by similarity
+	maxDiffCells = 250000
+
+	// blockElements are the HTML elements rendered on their own line
+	blockElements = "address, article, aside, blockquote, br, dd, div, dl, dt, fieldset, figcaption, figure, " +
+		"footer, form, h1, h2, h3, h4, h5, h6, header, hr, li, main, nav, ol, p, pre, section, table, td, th, " +
+		"title, tr, ul"
+)
+
+// snapshot is the content of a resource at a given crawl, kept to be compared with the next crawl
+type snapshot struct {
+	Hash  string    `json:"hash"`
+	Time  time.Time `json:"time"`
+	Lines []string  `json:"lines"`
+
+	// key is the cache key of the snapshot
+	key string
+}
+
+func newSnapshot(key string, body string, t time.Time) (*snapshot, error) {
+	lines, err := textLines(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{
+		Hash:  fmt.Sprintf("%x", sha256.Sum256([]byte(body))),
+		Time:  t,
+		Lines: lines,
+		key:   key,
+	}, nil
+}
+
+// trackChange compare given resource with its previous snapshot. It returns the change, and the snapshot
+// to save once the resource is indexed (nil if the previous snapshot must be kept)
+func (state *State) trackChange(rawURL string, body string, t time.Time) (index.Change, *snapshot, error) {
+	key, err := snapshotKey(rawURL)
+	if err != nil {
+		return index.Change{}, nil, err
+	}
+
+	current, err := newSnapshot(key, body, t)
+	if err != nil {
+		return index.Change{}, nil, err
+	}
+
+	previous, err := state.getSnapshot(key)
+	if err != nil {
+		return index.Change{}, nil, err
+	}
+
+	// The resource has already been indexed (the event is delivered again): the previous
+	// snapshot has been overridden, so there is nothing to compare with
+	if previous != nil && previous.Time.Equal(t) {
+		return index.Change{Hash: current.Hash}, nil, nil
+	}
+
+	change := compareSnapshots(previous, current)
+	recordChange(change)
+
+	// Do not override a more recent snapshot (the events may be handled out of order)
+	if previous != nil && previous.Time.After(t) {
+		return change, nil, nil
+	}
+
+	return change, current, nil
+}
+
+// getSnapshot returns the snapshot stored at given key, nil if there's none
+func (state *State) getSnapshot(key string) (*snapshot, error) {
+	b, err := state.snapshotCache.GetBytes(key)
+	if err != nil || len(b) == 0 {
+		return nil, err
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("error while reading snapshot: %s", err)
+	}
+	defer r.Close()
+
+	var s snapshot
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("error while reading snapshot: %s", err)
+	}
+
+	return &s, nil
+}
+
+// saveSnapshots store given snapshots (compressed) once their resources are indexed. The resources being
+// indexed already, a failure is only logged: their next crawl is compared with an older snapshot
+func (state *State) saveSnapshots(snapshots []*snapshot) {
+	// The most recent snapshot of an URL wins
+	latest := map[string]*snapshot{}
+	for _, s := range snapshots {
+		if s == nil {
+			continue
+		}
+		if previous, exist := latest[s.key]; !exist || s.Time.After(previous.Time) {
+			latest[s.key] = s
+		}
+	}
+
+	values := map[string][]byte{}
+	for key, s := range latest {
+		b, err := encodeSnapshot(s)
+		if err != nil {
+			log.Err(err).Str("key", key).Msg("error while encoding snapshot")
+			continue
+		}
+		values[key] = b
+	}
+
+	if len(values) == 0 {
+		return
+	}
+
+	if err := state.snapshotCache.SetManyBytes(values, state.snapshotTTL); err != nil {
+		log.Err(err).Int("count", len(values)).Msg("error while saving snapshots")
+	}
+}
+
+// encodeSnapshot returns the gzipped JSON of given snapshot
+func encodeSnapshot(s *snapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// compareSnapshots returns how the resource changed between given snapshots.
+// The previous snapshot is nil if the resource is crawled for the first time
+func compareSnapshots(previous *snapshot, current *snapshot) index.Change {
+	change := index.Change{Hash: current.Hash}
+	if previous == nil {
+		return change
+	}
+
+	change.PreviousTime = previous.Time
+
+	if previous.Hash == current.Hash {
+		change.Similarity = 1
+		return change
+	}
+
+	change.Changed = true
+	change.Similarity, change.Diff = diffLines(previous.Lines, current.Lines)
+
+	return change
+}
+
+// textLines returns the non-empty lines of the text of given HTML body
+func textLines(body string) ([]string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// The scripts & styles are not part of the text
+	doc.Find("script, style, noscript").Remove()
+	doc.Find(blockElements).AfterHtml("\n")
+
+	var lines []string
+	for _, line := range strings.Split(doc.Text(), "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+// diffLines returns the similarity (between 0 and 1) of given texts, and the lines removed (-) and added (+)
+func diffLines(a, b []string) (float64, string) {
+	if len(a)+len(b) == 0 {
+		return 1, ""
+	}
+
+	// Too big to be diffed: fallback on the ratio of lines in common
+	if len(a)*len(b) > maxDiffCells {
+		return commonLinesRatio(a, b), ""
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	similarity := 2 * float64(lcs[0][0]) / float64(len(a)+len(b))
+
+	var diff []string
+	changes := 0
+	add := func(prefix, line string) {
+		if changes < maxDiffLines {
+			diff = append(diff, prefix+line)
+		}
+		changes++
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			add("- ", a[i])
+			i++
+		default:
+			add("+ ", b[j])
+			j++
+		}
+	}
+
+	if changes > maxDiffLines {
+		diff = append(diff, fmt.Sprintf("... %d more lines", changes-maxDiffLines))
+	}
+
+	return similarity, strings.Join(diff, "\n")
+}
+
+// commonLinesRatio returns the ratio of lines of given texts present in both of them
+func commonLinesRatio(a, b []string) float64 {
+	counts := map[string]int{}
+	for _, line := range a {
+		counts[line]++
+	}
+
+	common := 0
+	for _, line := range b {
+		if counts[line] > 0 {
+			counts[line]--
+			common++
+		}
+	}
+
+	return 2 * float64(common) / float64(len(a)+len(b))
+}
+
+// snapshotKey returns the cache key of the snapshot of given URL
+func snapshotKey(rawURL string) (string, error) {
+	normalizedURL, err := urlnorm.Normalize(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	return urlnorm.Hash(normalizedURL)
+}
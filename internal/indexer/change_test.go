@@ -0,0 +1,160 @@
+package indexer
+
+import (
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"testing"
+	"time"
+)
+
+func TestTextLines(t *testing.T) {
+	lines, err := textLines(`
+<html>
+<head><title>Market</title><style>body { color: red; }</style></head>
+<body>
+  <p>Item   #1:  10$</p>
+  <script>var price = 12;</script>
+  <p>Item #2: 20$</p>
+</body>
+</html>`)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := []string{"Market", "Item #1: 10$", "Item #2: 20$"}
+	if len(lines) != len(want) {
+		t.Fatalf("wrong lines: %v", lines)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("wrong line %d: (got: %s, want: %s)", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	similarity, diff := diffLines([]string{"a", "b", "c", "d"}, []string{"a", "c", "d", "e"})
+
+	if similarity != 0.75 {
+		t.Errorf("wrong similarity: %f", similarity)
+	}
+	if diff != "- b\n+ e" {
+		t.Errorf("wrong diff: %s", diff)
+	}
+
+	if similarity, diff := diffLines([]string{"a"}, []string{"a"}); similarity != 1 || diff != "" {
+		t.Errorf("texts should be identical: %f %s", similarity, diff)
+	}
+}
+
+func TestDiffLines_Truncated(t *testing.T) {
+	var a []string
+	for i := 0; i < maxDiffLines+10; i++ {
+		a = append(a, string(rune('a'+i%26))+"-line")
+	}
+
+	similarity, diff := diffLines(a, nil)
+	if similarity != 0 {
+		t.Errorf("wrong similarity: %f", similarity)
+	}
+	if want := "... 10 more lines"; diff[len(diff)-len(want):] != want {
+		t.Errorf("diff should be truncated: %s", diff)
+	}
+}
+
+func TestDiffLines_TooBig(t *testing.T) {
+	// Just above the cap: half of the lines are common
+	var a, b []string
+	for i := 0; i < 501; i++ {
+		a = append(a, fmt.Sprintf("line %d", i))
+	}
+	for i := 250; i < 750; i++ {
+		b = append(b, fmt.Sprintf("line %d", i))
+	}
+	if len(a)*len(b) <= maxDiffCells {
+		t.Fatalf("texts should exceed the diff cap")
+	}
+
+	similarity, diff := diffLines(a, b)
+	if diff != "" {
+		t.Errorf("texts should not be diffed: %s", diff)
+	}
+	if want := 2 * 251.0 / 1001; similarity != want {
+		t.Errorf("wrong similarity: (got: %f, want: %f)", similarity, want)
+	}
+}
+
+func TestTrackChange(t *testing.T) {
+	s := State{snapshotCache: cache.NewMemoryCache(t.Name(), "snapshot")}
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	// First crawl
+	change, current, err := s.trackChange("https://example.onion/", "<p>Price: 10$</p><p>Seller: bob</p>", t1)
+	if err != nil || current == nil {
+		t.FailNow()
+	}
+	if !change.PreviousTime.IsZero() || change.Changed || change.Hash == "" {
+		t.Errorf("resource should be new: %+v", change)
+	}
+
+	// The snapshot is saved once the resource is indexed only
+	if change, _, _ := s.trackChange("https://example.onion/", "<p>Price: 10$</p><p>Seller: bob</p>", t1); !change.PreviousTime.IsZero() {
+		t.Errorf("snapshot should not be saved yet: %+v", change)
+	}
+	s.saveSnapshots([]*snapshot{current})
+
+	// The event is delivered again: nothing to compare with
+	change, current, err = s.trackChange("https://example.onion/", "<p>Price: 10$</p><p>Seller: bob</p>", t1)
+	if err != nil || current != nil {
+		t.FailNow()
+	}
+	if !change.PreviousTime.IsZero() || change.Changed || change.Hash == "" {
+		t.Errorf("resource should not be compared: %+v", change)
+	}
+
+	// Content edited (the URL is normalized)
+	change, current, err = s.trackChange("https://example.onion/index.html", "<p>Price: 12$</p><p>Seller: bob</p>", t2)
+	if err != nil {
+		t.FailNow()
+	}
+	if !change.Changed || change.PreviousTime != t1 || change.Similarity != 0.5 {
+		t.Errorf("resource should be changed: %+v", change)
+	}
+	if change.Diff != "- Price: 10$\n+ Price: 12$" {
+		t.Errorf("wrong diff: %s", change.Diff)
+	}
+	s.saveSnapshots([]*snapshot{current})
+
+	// Older snapshot handled late: the latest snapshot is kept
+	if _, current, err := s.trackChange("https://example.onion/", "<p>Price: 10$</p><p>Seller: bob</p>", t1.Add(time.Minute)); err != nil || current != nil {
+		t.Errorf("older snapshot should not be saved")
+	}
+
+	change, _, err = s.trackChange("https://example.onion/", "<p>Price: 12$</p><p>Seller: bob</p>", t2.Add(time.Hour))
+	if err != nil {
+		t.FailNow()
+	}
+	if change.Changed || change.PreviousTime != t2 || change.Similarity != 1 {
+		t.Errorf("resource should be unchanged: %+v", change)
+	}
+}
+
+func TestSaveSnapshots(t *testing.T) {
+	s := State{snapshotCache: cache.NewMemoryCache(t.Name(), "snapshot")}
+	t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	older, _ := newSnapshot("key", "<p>Price: 10$</p>", t1)
+	newer, _ := newSnapshot("key", "<p>Price: 12$</p>", t1.Add(time.Hour))
+
+	// The most recent snapshot of an URL is kept, whatever the indexing order
+	s.saveSnapshots([]*snapshot{newer, nil, older})
+
+	saved, err := s.getSnapshot("key")
+	if err != nil || saved == nil {
+		t.FailNow()
+	}
+	if !saved.Time.Equal(newer.Time) || saved.Hash != newer.Hash || len(saved.Lines) != 1 || saved.Lines[0] != "Price: 12$" {
+		t.Errorf("wrong snapshot: %+v", saved)
+	}
+}
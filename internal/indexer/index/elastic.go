@@ -2,14 +2,42 @@ package index
 
 import (
 	"context"
+	"crypto/sha256"
+	"fmt"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
 	"github.com/olivere/elastic/v7"
 	"github.com/rs/zerolog/log"
 	"strings"
 	"time"
 )
 
-const resourcesIndexName = "resources"
+const (
+	resourcesIndexName = "resources"
+	// historyIndexName is the append-only index keeping every snapshot of the resources
+	historyIndexName = "resources-history"
+)
+
+// upsertScript maintain the crawl statistics of a resource, the content is replaced
+// unless the given snapshot is older than the indexed one
+const upsertScript = `
+if (ctx.op == 'create') {
+  ctx._source.putAll(params.doc);
+  ctx._source.first_seen = params.seen;
+  ctx._source.last_seen = params.seen;
+  ctx._source.crawl_count = 1;
+} else {
+  ctx._source.crawl_count += 1;
+  if (params.seen < ctx._source.first_seen) {
+    ctx._source.first_seen = params.seen;
+  }
+  if (params.seen >= ctx._source.last_seen) {
+    ctx._source.putAll(params.doc);
+    ctx._source.last_seen = params.seen;
+  }
+}`
+
+// mapping is shared by the resources & the history index
 const mapping = `
 {
   "settings": {
@@ -36,6 +64,33 @@ const mapping = `
       "time": {
         "type": "date"
       },
+      "first_seen": {
+        "type": "date"
+      },
+      "last_seen": {
+        "type": "date"
+      },
+      "crawl_count": {
+        "type": "long"
+      },
+      "resource_id": {
+        "type": "keyword"
+      },
+      "content_hash": {
+        "type": "keyword"
+      },
+      "previous_time": {
+        "type": "date"
+      },
+      "changed": {
+        "type": "boolean"
+      },
+      "similarity": {
+        "type": "float"
+      },
+      "diff": {
+        "type": "text"
+      },
       "title": {
         "type": "text"
       },
@@ -63,13 +118,21 @@ type resourceIdx struct {
 	Meta        map[string]string `json:"meta"`
 	Description string            `json:"description"`
 	Headers     map[string]string `json:"headers"`
+	// ResourceID is the ID of the upserted document, set on the history snapshots
+	ResourceID   string     `json:"resource_id,omitempty"`
+	ContentHash  string     `json:"content_hash,omitempty"`
+	PreviousTime *time.Time `json:"previous_time,omitempty"`
+	Changed      bool       `json:"changed"`
+	Similarity   float64    `json:"similarity"`
+	Diff         string     `json:"diff,omitempty"`
 }
 
 type elasticSearchIndex struct {
 	client *elastic.Client
+	opts   Options
 }
 
-func newElasticIndex(uri string) (Index, error) {
+func newElasticIndex(uri string, opts Options) (Index, error) {
 	// Create Elasticsearch client
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -83,65 +146,159 @@ func newElasticIndex(uri string) (Index, error) {
 		return nil, err
 	}
 
-	if err := setupElasticSearch(ctx, ec); err != nil {
+	indexes := []string{resourcesIndexName}
+	if opts.History {
+		indexes = append(indexes, historyIndexName)
+	}
+
+	if err := setupElasticSearch(ctx, ec, indexes); err != nil {
 		return nil, err
 	}
 
 	return &elasticSearchIndex{
 		client: ec,
+		opts:   opts,
 	}, nil
 }
 
 func (e *elasticSearchIndex) IndexResource(resource Resource) error {
-	res, err := indexResource(resource)
-	if err != nil {
-		return err
-	}
-
-	_, err = e.client.Index().
-		Index(resourcesIndexName).
-		BodyJson(res).
-		Do(context.Background())
-	return err
+	return e.IndexResources([]Resource{resource})
 }
 
 func (e *elasticSearchIndex) IndexResources(resources []Resource) error {
 	bulkRequest := e.client.Bulk()
 
 	for _, resource := range resources {
-		resourceIndex, err := indexResource(resource)
+		requests, err := e.bulkRequests(resource)
 		if err != nil {
 			return err
 		}
 
+		bulkRequest.Add(requests...)
+	}
+
+	res, err := bulkRequest.Do(context.Background())
+	if err != nil {
+		return err
+	}
+
+	// The bulk request succeed even if some of the documents were not indexed
+	if failed := res.Failed(); len(failed) > 0 {
+		reason := fmt.Sprintf("status %d", failed[0].Status)
+		if failed[0].Error != nil {
+			reason = failed[0].Error.Reason
+		}
+
+		return fmt.Errorf("%d documents not indexed: %s", len(failed), reason)
+	}
+
+	return nil
+}
+
+// bulkRequests returns the requests storing given resource depending on the index options
+func (e *elasticSearchIndex) bulkRequests(resource Resource) ([]elastic.BulkableRequest, error) {
+	resourceIndex, err := indexResource(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	if !e.opts.Upsert {
 		req := elastic.NewBulkIndexRequest().
 			Index(resourcesIndexName).
 			Doc(resourceIndex)
-		bulkRequest.Add(req)
+
+		return e.withHistory([]elastic.BulkableRequest{req}, "", resourceIndex), nil
+	}
+
+	id, err := resourceID(resource.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	script := elastic.NewScript(upsertScript).
+		Lang("painless").
+		Params(map[string]interface{}{
+			"doc":  resourceIndex,
+			"seen": resource.Time.UnixNano() / int64(time.Millisecond),
+		})
+
+	req := elastic.NewBulkUpdateRequest().
+		Index(resourcesIndexName).
+		Id(id).
+		Script(script).
+		ScriptedUpsert(true).
+		Upsert(map[string]interface{}{}).
+		// Concurrent indexers may update the same resource
+		RetryOnConflict(3)
+
+	return e.withHistory([]elastic.BulkableRequest{req}, id, resourceIndex), nil
+}
+
+// withHistory append the request storing given snapshot in the history index, if enabled
+func (e *elasticSearchIndex) withHistory(requests []elastic.BulkableRequest, id string, resourceIndex *resourceIdx) []elastic.BulkableRequest {
+	if !e.opts.History {
+		return requests
 	}
 
-	_, err := bulkRequest.Do(context.Background())
-	return err
+	snapshot := *resourceIndex
+	snapshot.ResourceID = id
+
+	return append(requests, elastic.NewBulkIndexRequest().
+		Index(historyIndexName).
+		Doc(&snapshot))
 }
 
-func setupElasticSearch(ctx context.Context, es *elastic.Client) error {
-	// Setup index if doesn't exist
-	exist, err := es.IndexExists(resourcesIndexName).Do(ctx)
+func (e *elasticSearchIndex) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := e.client.ClusterHealth().Do(ctx)
 	if err != nil {
 		return err
 	}
-	if !exist {
-		log.Debug().Str("index", resourcesIndexName).Msg("Creating missing index")
+	if res.Status == "red" {
+		return fmt.Errorf("cluster status is %s", res.Status)
+	}
 
-		q := es.CreateIndex(resourcesIndexName).BodyString(mapping)
-		if _, err := q.Do(ctx); err != nil {
+	return nil
+}
+
+func (e *elasticSearchIndex) Close() error {
+	// Stop the background processes (sniffing, health checks)
+	e.client.Stop()
+	return nil
+}
+
+func setupElasticSearch(ctx context.Context, es *elastic.Client, indexes []string) error {
+	for _, index := range indexes {
+		// Setup index if doesn't exist
+		exist, err := es.IndexExists(index).Do(ctx)
+		if err != nil {
 			return err
 		}
+		if !exist {
+			log.Debug().Str("index", index).Msg("Creating missing index")
+
+			q := es.CreateIndex(index).BodyString(mapping)
+			if _, err := q.Do(ctx); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+// resourceID returns the ID of the document holding given resource, derived from its normalized URL
+func resourceID(rawURL string) (string, error) {
+	normalizedURL, err := urlnorm.Normalize(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(normalizedURL))), nil
+}
+
 func indexResource(resource Resource) (*resourceIdx, error) {
 	doc, err := goquery.NewDocumentFromReader(strings.NewReader(resource.Body))
 	if err != nil {
@@ -174,7 +331,7 @@ func indexResource(resource Resource) (*resourceIdx, error) {
 		lowerCasedHeaders[strings.ToLower(key)] = value
 	}
 
-	return &resourceIdx{
+	res := &resourceIdx{
 		URL:         resource.URL,
 		Body:        resource.Body,
 		Time:        resource.Time,
@@ -182,5 +339,14 @@ func indexResource(resource Resource) (*resourceIdx, error) {
 		Meta:        meta,
 		Description: meta["description"],
 		Headers:     lowerCasedHeaders,
-	}, nil
+		ContentHash: resource.Change.Hash,
+		Changed:     resource.Change.Changed,
+		Similarity:  resource.Change.Similarity,
+		Diff:        resource.Change.Diff,
+	}
+	if !resource.Change.PreviousTime.IsZero() {
+		res.PreviousTime = &resource.Change.PreviousTime
+	}
+
+	return res, nil
 }
@@ -2,6 +2,7 @@ package index
 
 import (
 	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"strings"
 	"testing"
 	"time"
 )
@@ -59,3 +60,56 @@ This is sparta
 		t.Fail()
 	}
 }
+
+func TestResourceID(t *testing.T) {
+	id, err := resourceID("https://example.onion/index.html#top")
+	if err != nil {
+		t.FailNow()
+	}
+
+	// The same resource is always stored in the same document
+	if other, _ := resourceID("https://example.onion/"); other != id {
+		t.Errorf("IDs should match: %s %s", id, other)
+	}
+
+	if other, _ := resourceID("https://example.onion/page"); other == id {
+		t.Errorf("IDs should not match: %s %s", id, other)
+	}
+
+	if len(id) != 64 {
+		t.Errorf("wrong ID length: %d", len(id))
+	}
+}
+
+func TestBulkRequests_Upsert(t *testing.T) {
+	e := elasticSearchIndex{opts: Options{Upsert: true, History: true}}
+
+	requests, err := e.bulkRequests(Resource{URL: "https://example.onion", Time: time.Unix(1600000000, 0)})
+	if err != nil {
+		t.FailNow()
+	}
+	if len(requests) != 2 {
+		t.Fatalf("wrong number of requests: %d", len(requests))
+	}
+
+	id, _ := resourceID("https://example.onion")
+
+	upsert, err := requests[0].Source()
+	if err != nil {
+		t.FailNow()
+	}
+	if !strings.Contains(upsert[0], `"_id":"`+id+`"`) || !strings.Contains(upsert[0], `"_index":"resources"`) {
+		t.Errorf("wrong upsert action: %s", upsert[0])
+	}
+	if !strings.Contains(upsert[1], `"seen":1600000000000`) || !strings.Contains(upsert[1], `"scripted_upsert":true`) {
+		t.Errorf("wrong upsert body: %s", upsert[1])
+	}
+
+	snapshot, err := requests[1].Source()
+	if err != nil {
+		t.FailNow()
+	}
+	if !strings.Contains(snapshot[0], `"_index":"resources-history"`) || !strings.Contains(snapshot[1], `"resource_id":"`+id+`"`) {
+		t.Errorf("wrong history request: %s", snapshot)
+	}
+}
@@ -20,19 +20,48 @@ type Resource struct {
 	Time    time.Time
 	Body    string
 	Headers map[string]string
+	Change  Change
+}
+
+// Change describe how a resource changed since its previous crawl
+type Change struct {
+	// Hash is the hash of the resource body
+	Hash string
+	// PreviousTime is the time of the previous crawl, zero if the resource is crawled for the first time
+	PreviousTime time.Time
+	// Changed is set if the body differs from the previous crawl
+	Changed bool
+	// Similarity is the ratio (between 0 and 1) of text lines in common with the previous crawl
+	Similarity float64
+	// Diff is the text lines removed (-) and added (+) since the previous crawl
+	Diff string
 }
 
 // Index is the interface used to abstract communication with the persistence unit
 type Index interface {
 	IndexResource(resource Resource) error
 	IndexResources(resources []Resource) error
+
+	// Ping returns an error if the index is not reachable
+	Ping() error
+	// Close release the connection to the index
+	Close() error
+}
+
+// Options tune how the resources are stored
+type Options struct {
+	// Upsert keep a single document per URL, updated at each crawl,
+	// instead of a new document per crawl (elastic only)
+	Upsert bool
+	// History keep every crawled snapshot in a separate append-only index (elastic only)
+	History bool
 }
 
 // NewIndex create a new index using given driver, destination
-func NewIndex(driver string, dest string) (Index, error) {
+func NewIndex(driver string, dest string, opts Options) (Index, error) {
 	switch driver {
 	case Elastic:
-		return newElasticIndex(dest)
+		return newElasticIndex(dest, opts)
 	case Local:
 		return newLocalIndex(dest)
 	default:
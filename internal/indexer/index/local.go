@@ -43,6 +43,13 @@ func (s *localIndex) IndexResource(resource Resource) error {
 		return err
 	}
 
+	// Keep the changes since the previous crawl next to the resource
+	if resource.Change.Diff != "" {
+		if err := ioutil.WriteFile(fullPath+".diff", []byte(resource.Change.Diff), 0640); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -58,6 +65,22 @@ func (s *localIndex) IndexResources(resources []Resource) error {
 	return nil
 }
 
+func (s *localIndex) Ping() error {
+	info, err := os.Stat(s.baseDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.baseDir)
+	}
+
+	return nil
+}
+
+func (s *localIndex) Close() error {
+	return nil
+}
+
 func formatResource(url string, body string, headers map[string]string) ([]byte, error) {
 	builder := strings.Builder{}
 
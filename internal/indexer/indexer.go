@@ -2,6 +2,7 @@ package indexer
 
 import (
 	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
@@ -10,6 +11,16 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	bufferSizeFlag    = "buffer-size"
+	flushIntervalFlag = "flush-interval"
+	indexUpsertFlag   = "index-upsert"
+	indexHistoryFlag  = "index-history"
+	snapshotTTLFlag   = "snapshot-ttl"
 )
 
 var errHostnameNotAllowed = fmt.Errorf("hostname is not allowed")
@@ -20,8 +31,23 @@ type State struct {
 	indexDriver  string
 	configClient configapi.Client
 
+	// snapshotCache hold the last crawled snapshot of the resources, to track their changes
+	snapshotCache cache.Cache
+	snapshotTTL   time.Duration
+
 	bufferThreshold int
-	resources       []index.Resource
+	// flushInterval is the maximum duration a resource stay buffered, zero means no limit
+	flushInterval time.Duration
+
+	// mutex guard the buffer against the concurrent handlers & the background flush
+	mutex     sync.Mutex
+	resources []index.Resource
+	// snapshots of the buffered resources, saved once they are indexed
+	snapshots []*snapshot
+	// flushTimer flush the buffer once its first resource is too old
+	flushTimer *time.Timer
+	// flushes count the buffer flushes, to detect the outdated timers
+	flushes uint64
 }
 
 // Name return the process name
@@ -34,13 +60,17 @@ func (state *State) Description() string {
 	return `
 The indexing component. It consumes crawled resources, format
 them and finally index them using the configured driver.
+The resources can be buffered to be indexed in bulk: the buffer is
+flushed once full, or once its oldest resource reach the flush interval.
+Each resource is compared with its previous crawl: the content hash,
+the similarity and the changed lines are stored alongside.
 
 This component consumes the 'resource.new' event.`
 }
 
 // Features return the process features
 func (state *State) Features() []process.Feature {
-	return []process.Feature{process.EventFeature, process.ConfigFeature}
+	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature}
 }
 
 // CustomFlags return process custom flags
@@ -56,19 +86,47 @@ func (state *State) CustomFlags() []cli.Flag {
 			Usage:    "Destination (config) passed to the driver",
 			Required: true,
 		},
+		&cli.BoolFlag{
+			Name:  indexUpsertFlag,
+			Usage: "Keep a single document per URL updated at each crawl (elastic only)",
+		},
+		&cli.BoolFlag{
+			Name:  indexHistoryFlag,
+			Usage: "Keep every crawled snapshot in an append-only history index (elastic only)",
+		},
+		&cli.IntFlag{
+			Name:  bufferSizeFlag,
+			Usage: "Number of resources to index at once (1 means no buffering). The buffered resources are acknowledged before being indexed, and lost if the indexer stops while the index is failing",
+			Value: 1,
+		},
+		&cli.DurationFlag{
+			Name:  flushIntervalFlag,
+			Usage: "Maximum duration a resource stay buffered before being indexed (0 means no limit)",
+			Value: time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:  snapshotTTLFlag,
+			Usage: "Duration the last snapshot of a resource is kept to track its changes (should exceed the refresh delay)",
+			Value: 7 * 24 * time.Hour,
+		},
 	}
 }
 
 // Initialize the process
 func (state *State) Initialize(provider process.Provider) error {
 	indexDriver := provider.GetStrValue("index-driver")
-	idx, err := index.NewIndex(indexDriver, provider.GetStrValue("index-dest"))
+	idx, err := index.NewIndex(indexDriver, provider.GetStrValue("index-dest"), index.Options{
+		Upsert:  provider.GetBoolValue(indexUpsertFlag),
+		History: provider.GetBoolValue(indexHistoryFlag),
+	})
 	if err != nil {
 		return err
 	}
 	state.index = idx
 	state.indexDriver = indexDriver
-	state.bufferThreshold = provider.GetIntValue(process.EventPrefetchFlag)
+	provider.AddReadinessCheck("index", idx.Ping)
+	state.bufferThreshold = provider.GetIntValue(bufferSizeFlag)
+	state.flushInterval = provider.GetDurationValue(flushIntervalFlag)
 
 	configClient, err := provider.ConfigClient([]string{configapi.ForbiddenHostnamesKey})
 	if err != nil {
@@ -76,13 +134,31 @@ func (state *State) Initialize(provider process.Provider) error {
 	}
 	state.configClient = configClient
 
+	snapshotCache, err := provider.Cache("snapshot")
+	if err != nil {
+		return err
+	}
+	state.snapshotCache = snapshotCache
+	state.snapshotTTL = provider.GetDurationValue(snapshotTTLFlag)
+
 	return nil
 }
 
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.NewResourceExchange, Queue: fmt.Sprintf("%sIndexingQueue", state.indexDriver), Handler: state.handleNewResourceEvent},
+		{
+			Exchange: event.NewResourceExchange,
+			Queue:    fmt.Sprintf("%sIndexingQueue", state.indexDriver),
+			Handler:  state.handleNewResourceEvent,
+			// Retry to not lose resources while the index is unavailable
+			RetryPolicy: &event.RetryPolicy{
+				MaxAttempts: 5,
+				Backoff:     10 * time.Second,
+				Ignore:      []error{errHostnameNotAllowed},
+			},
+			Errors: []error{errHostnameNotAllowed},
+		},
 	}
 }
 
@@ -91,6 +167,26 @@ func (state *State) HTTPHandler() http.Handler {
 	return nil
 }
 
+// Shutdown index the buffered resources and close the index
+func (state *State) Shutdown() error {
+	state.mutex.Lock()
+	err := state.flush()
+	if err != nil {
+		// The buffered events are already acknowledged: log the dropped resources to crawl them again
+		for _, resource := range state.resources {
+			log.Error().Str("url", resource.URL).Msg("Dropping buffered resource")
+		}
+	}
+	state.mutex.Unlock()
+
+	if err != nil {
+		_ = state.index.Close()
+		return err
+	}
+
+	return state.index.Close()
+}
+
 func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg event.RawMessage) error {
 	var evt event.NewResourceEvent
 	if err := subscriber.Read(&msg, &evt); err != nil {
@@ -102,17 +198,28 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 		return fmt.Errorf("%s %w", evt.URL, errHostnameNotAllowed)
 	}
 
+	change, current, err := state.trackChange(evt.URL, evt.Body, evt.Time)
+	if err != nil {
+		return fmt.Errorf("error while tracking resource changes: %s", err)
+	}
+
 	// Direct saving (no buffering)
-	if state.bufferThreshold == 1 {
-		if err := state.index.IndexResource(index.Resource{
+	if state.bufferThreshold <= 1 {
+		start := time.Now()
+		err := state.index.IndexResource(index.Resource{
 			URL:     evt.URL,
 			Time:    evt.Time,
 			Body:    evt.Body,
 			Headers: evt.Headers,
-		}); err != nil {
+			Change:  change,
+		})
+		recordIndexing(state.indexDriver, 1, start, err)
+		if err != nil {
 			return fmt.Errorf("error while indexing resource: %s", err)
 		}
 
+		state.saveSnapshots([]*snapshot{current})
+
 		log.Info().
 			Str("url", evt.URL).
 			Msg("Successfully indexed resource")
@@ -121,28 +228,105 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 	}
 
 	// Otherwise we are in buffered saving mode
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	// The buffer is still full since the last flush has failed: try again, and refuse
+	// the resource if the index is still failing so that its event is retried instead
+	if len(state.resources) >= state.bufferThreshold {
+		if err := state.flush(); err != nil {
+			state.scheduleFlush()
+			return err
+		}
+	}
+
 	state.resources = append(state.resources, index.Resource{
 		URL:     evt.URL,
 		Time:    evt.Time,
 		Body:    evt.Body,
 		Headers: evt.Headers,
+		Change:  change,
 	})
+	state.snapshots = append(state.snapshots, current)
 
 	log.Debug().Str("url", evt.URL).Msg("Successfully stored resource in buffer")
 
+	// Make sure the resource will not stay buffered forever
+	if state.flushTimer == nil {
+		state.scheduleFlush()
+	}
+
 	if len(state.resources) >= state.bufferThreshold {
-		// Time to save!
-		if err := state.index.IndexResources(state.resources); err != nil {
-			return fmt.Errorf("error while indexing resources: %s", err)
+		// Time to save! The buffered events are already acknowledged: on failure the buffer
+		// is kept, to be flushed again with the next resource or once the flush interval is elapsed
+		if err := state.flush(); err != nil {
+			log.Err(err).Int("count", len(state.resources)).Msg("error while flushing buffered resources")
+			state.scheduleFlush()
 		}
+	}
 
-		log.Info().
-			Int("count", len(state.resources)).
-			Msg("Successfully indexed buffered resources")
+	return nil
+}
+
+// scheduleFlush schedule the flush of the buffer once the flush interval is elapsed.
+// It must be called with the mutex held
+func (state *State) scheduleFlush() {
+	if state.flushInterval <= 0 {
+		return
+	}
+
+	flushes := state.flushes
+	state.flushTimer = time.AfterFunc(state.flushInterval, func() {
+		state.flushExpired(flushes)
+	})
+}
+
+// flushExpired flush the buffer from the background, unless it has been flushed
+// since the timer was scheduled
+func (state *State) flushExpired(flushes uint64) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
 
-		// Clear cache
-		state.resources = []index.Resource{}
+	if state.flushes != flushes {
+		return
 	}
 
+	if err := state.flush(); err != nil {
+		log.Err(err).Msg("error while flushing buffered resources")
+
+		// Try again later
+		state.scheduleFlush()
+	}
+}
+
+// flush index the buffered resources (if any). It must be called with the mutex held
+func (state *State) flush() error {
+	if state.flushTimer != nil {
+		state.flushTimer.Stop()
+		state.flushTimer = nil
+	}
+
+	if len(state.resources) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := state.index.IndexResources(state.resources)
+	recordIndexing(state.indexDriver, len(state.resources), start, err)
+	if err != nil {
+		return fmt.Errorf("error while indexing resources: %s", err)
+	}
+
+	log.Info().
+		Int("count", len(state.resources)).
+		Msg("Successfully indexed buffered resources")
+
+	state.saveSnapshots(state.snapshots)
+
+	// Clear cache
+	state.resources = []index.Resource{}
+	state.snapshots = nil
+	state.flushes++
+
 	return nil
 }
@@ -1,7 +1,10 @@
 package indexer
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
@@ -26,12 +29,12 @@ func TestState_Name(t *testing.T) {
 
 func TestState_Features(t *testing.T) {
 	s := State{}
-	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature})
+	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature})
 }
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, []string{"index-driver", "index-dest"})
+	test.CheckProcessCustomFlags(t, &s, []string{"index-driver", "index-dest", "index-upsert", "index-history", "buffer-size", "flush-interval", "snapshot-ttl"})
 }
 
 func TestState_Initialize(t *testing.T) {
@@ -39,8 +42,14 @@ func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &s, func(p *process_mock.MockProviderMockRecorder) {
 		p.GetStrValue("index-driver").Return("local")
 		p.GetStrValue("index-dest")
-		p.GetIntValue(process.EventPrefetchFlag).Return(10)
+		p.GetBoolValue("index-upsert")
+		p.GetBoolValue("index-history")
+		p.AddReadinessCheck("index", gomock.Any())
+		p.GetIntValue("buffer-size").Return(10)
+		p.GetDurationValue("flush-interval").Return(time.Minute)
 		p.ConfigClient([]string{client.ForbiddenHostnamesKey})
+		p.Cache("snapshot")
+		p.GetDurationValue("snapshot-ttl").Return(time.Hour)
 	})
 
 	if s.indexDriver != "local" {
@@ -49,6 +58,12 @@ func TestState_Initialize(t *testing.T) {
 	if s.bufferThreshold != 10 {
 		t.Errorf("wrong buffer threshold: got: %d want: %d", s.bufferThreshold, 10)
 	}
+	if s.flushInterval != time.Minute {
+		t.Errorf("wrong flush interval: got: %s want: %s", s.flushInterval, time.Minute)
+	}
+	if s.snapshotTTL != time.Hour {
+		t.Errorf("wrong snapshot TTL: got: %s want: %s", s.snapshotTTL, time.Hour)
+	}
 }
 
 func TestState_Subscribers(t *testing.T) {
@@ -96,14 +111,62 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 		Time:    tn,
 		Body:    body,
 		Headers: map[string]string{"Server": "Traefik", "Content-Type": "application/html"},
+		Change:  index.Change{Hash: bodyHash(body)},
 	})
 
-	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 1}
+	s := State{
+		index:           indexMock,
+		configClient:    configClientMock,
+		snapshotCache:   cache.NewMemoryCache(t.Name(), "snapshot"),
+		bufferThreshold: 1,
+	}
 	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
 		t.FailNow()
 	}
 }
 
+func TestHandleNewResourceEvent_IndexFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	s := State{
+		index:           indexMock,
+		configClient:    configClientMock,
+		snapshotCache:   cache.NewMemoryCache(t.Name(), "snapshot"),
+		bufferThreshold: 1,
+	}
+
+	tn := time.Now()
+	msg := event.RawMessage{}
+	configClientMock.EXPECT().GetForbiddenHostnames().Times(2).Return([]client.ForbiddenHostname{}, nil)
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		Times(2).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion", Body: "<p>hello</p>", Time: tn}).
+		Return(nil)
+
+	// The snapshot is not saved when the indexing fails: the retried event is not compared with itself
+	resource := index.Resource{URL: "https://example.onion", Time: tn, Body: "<p>hello</p>", Change: index.Change{Hash: bodyHash("<p>hello</p>")}}
+	indexMock.EXPECT().IndexResource(resource).Return(errors.New("index unavailable"))
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err == nil {
+		t.Error("indexing error should be returned")
+	}
+
+	indexMock.EXPECT().IndexResource(resource).Return(nil)
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Errorf("error while indexing resource: %s", err)
+	}
+
+	key, _ := snapshotKey("https://example.onion")
+	if saved, err := s.getSnapshot(key); err != nil || saved == nil || !saved.Time.Equal(tn) {
+		t.Errorf("snapshot should be saved once indexed: %+v (%v)", saved, err)
+	}
+}
+
 func TestHandleNewResourceEvent_Buffering_NoDispatch(t *testing.T) {
 	body := `
 <title>Creekorful Inc</title>
@@ -138,7 +201,12 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{{Hostname: "example2.onion"}}, nil)
 
-	s := State{index: indexMock, configClient: configClientMock, bufferThreshold: 5}
+	s := State{
+		index:           indexMock,
+		configClient:    configClientMock,
+		snapshotCache:   cache.NewMemoryCache(t.Name(), "snapshot"),
+		bufferThreshold: 5,
+	}
 	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
 		t.FailNow()
 	}
@@ -203,12 +271,14 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 			Time:    tn,
 			Body:    body,
 			Headers: map[string]string{"Server": "Traefik", "Content-Type": "application/html"},
+			Change:  index.Change{Hash: bodyHash(body)},
 		},
 	})
 
 	s := State{
 		index:           indexMock,
 		configClient:    configClientMock,
+		snapshotCache:   cache.NewMemoryCache(t.Name(), "snapshot"),
 		bufferThreshold: 2,
 		resources:       []index.Resource{{URL: "https://google.onion"}},
 	}
@@ -222,6 +292,168 @@ Thanks to https://help.facebook.onion/ for the hosting :D
 	}
 }
 
+func TestHandleNewResourceEvent_Buffering_FlushInterval(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion"}).
+		Return(nil)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
+
+	flushed := make(chan struct{})
+	indexMock.EXPECT().
+		IndexResources([]index.Resource{{URL: "https://example.onion", Change: index.Change{Hash: bodyHash("")}}}).
+		DoAndReturn(func(resources []index.Resource) error {
+			close(flushed)
+			return nil
+		})
+
+	s := State{
+		index:           indexMock,
+		configClient:    configClientMock,
+		snapshotCache:   cache.NewMemoryCache(t.Name(), "snapshot"),
+		bufferThreshold: 5,
+		flushInterval:   10 * time.Millisecond,
+	}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.FailNow()
+	}
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("buffer has not been flushed")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.resources) != 0 || s.flushTimer != nil {
+		t.Errorf("buffer should be reset: %v", s.resources)
+	}
+}
+
+func TestHandleNewResourceEvent_Buffering_FlushFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	configClientMock.EXPECT().GetForbiddenHostnames().AnyTimes().Return([]client.ForbiddenHostname{}, nil)
+
+	s := State{
+		index:           indexMock,
+		configClient:    configClientMock,
+		snapshotCache:   cache.NewMemoryCache(t.Name(), "snapshot"),
+		bufferThreshold: 2,
+		resources:       []index.Resource{{URL: "https://google.onion"}},
+	}
+
+	buffered := []index.Resource{
+		{URL: "https://google.onion"},
+		{URL: "https://example.onion", Change: index.Change{Hash: bodyHash("")}},
+	}
+
+	// The flush fails: the buffered events are already acknowledged, the buffer is kept
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://example.onion"}).
+		Return(nil)
+	indexMock.EXPECT().IndexResources(buffered).Return(errors.New("index unavailable"))
+
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Errorf("buffered resource should be acknowledged: %s", err)
+	}
+	if !reflect.DeepEqual(s.resources, buffered) {
+		t.Errorf("buffer should be kept: %v", s.resources)
+	}
+
+	// The index is still failing: the new resource is refused, to be retried without being buffered twice
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://other.onion"}).
+		Return(nil)
+	indexMock.EXPECT().IndexResources(buffered).Return(errors.New("index unavailable"))
+
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err == nil {
+		t.Error("resource should have been refused")
+	}
+	if !reflect.DeepEqual(s.resources, buffered) {
+		t.Errorf("buffer should be kept: %v", s.resources)
+	}
+
+	// The index is back: the buffer is flushed before buffering the new resource
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{URL: "https://other.onion"}).
+		Return(nil)
+	indexMock.EXPECT().IndexResources(buffered).Return(nil)
+
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Errorf("resource should have been buffered: %s", err)
+	}
+	if len(s.resources) != 1 || s.resources[0].URL != "https://other.onion" {
+		t.Errorf("wrong buffer: %v", s.resources)
+	}
+}
+
+func TestState_Shutdown(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	gomock.InOrder(
+		indexMock.EXPECT().IndexResources([]index.Resource{{URL: "https://google.onion"}}).Return(nil),
+		indexMock.EXPECT().Close().Return(nil),
+	)
+
+	s := State{
+		index:           indexMock,
+		bufferThreshold: 5,
+		resources:       []index.Resource{{URL: "https://google.onion"}},
+	}
+	if err := s.Shutdown(); err != nil {
+		t.FailNow()
+	}
+
+	if len(s.resources) != 0 {
+		t.Fail()
+	}
+}
+
+func TestState_Shutdown_FlushFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	indexMock := index_mock.NewMockIndex(mockCtrl)
+
+	gomock.InOrder(
+		indexMock.EXPECT().IndexResources([]index.Resource{{URL: "https://google.onion"}}).Return(errors.New("index unavailable")),
+		indexMock.EXPECT().Close().Return(nil),
+	)
+
+	s := State{
+		index:           indexMock,
+		bufferThreshold: 5,
+		resources:       []index.Resource{{URL: "https://google.onion"}},
+	}
+	if err := s.Shutdown(); err == nil {
+		t.Error("flushing error should be returned")
+	}
+}
+
 func TestHandleMessageForbiddenHostname(t *testing.T) {
 	body := `
 <title>Creekorful Inc</title>
@@ -258,3 +490,7 @@ This is sparta (hosted on https://example.org)
 		t.FailNow()
 	}
 }
+
+func bodyHash(body string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+}
@@ -0,0 +1,61 @@
+package indexer
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/indexer/index"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"time"
+)
+
+var (
+	bulkSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "indexer",
+		Name:      "bulk_size",
+		Help:      "The number of resources indexed at once, per index driver",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"driver"})
+	bulkDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "indexer",
+		Name:      "bulk_duration_seconds",
+		Help:      "The time taken to index the resources, per index driver",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"driver"})
+	indexingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "indexer",
+		Name:      "errors_total",
+		Help:      "The number of failed indexing, per index driver",
+	}, []string{"driver"})
+	resourceChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "indexer",
+		Name:      "resource_changes_total",
+		Help:      "The number of indexed resources, per change since their previous crawl (new, changed, unchanged)",
+	}, []string{"change"})
+)
+
+// recordIndexing update the metrics once resources have been indexed
+func recordIndexing(driver string, count int, start time.Time, err error) {
+	if err != nil {
+		indexingErrors.WithLabelValues(driver).Inc()
+		return
+	}
+
+	bulkSize.WithLabelValues(driver).Observe(float64(count))
+	bulkDuration.WithLabelValues(driver).Observe(time.Since(start).Seconds())
+}
+
+// recordChange update the metrics once a resource has been compared with its previous crawl
+func recordChange(change index.Change) {
+	switch {
+	case change.PreviousTime.IsZero():
+		resourceChanges.WithLabelValues("new").Inc()
+	case change.Changed:
+		resourceChanges.WithLabelValues("changed").Inc()
+	default:
+		resourceChanges.WithLabelValues("unchanged").Inc()
+	}
+}
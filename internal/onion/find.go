@@ -0,0 +1,66 @@
+package onion
+
+import (
+	"regexp"
+	"strings"
+)
+
+// bareAddressRegex matches the onion addresses written without URL scheme, including the obfuscated ones:
+// split across whitespace (abcd efgh.onion) or with a disguised dot (abcd[.]onion, abcd (dot) onion, ...)
+var bareAddressRegex = regexp.MustCompile(`(?i)((?:[a-z2-7]\s*){55}[a-z2-7])` +
+	`(?:\s*(?:\.|\[\.\]|\(\.\)|\{\.\}|\[dot\]|\(dot\)|\{dot\})\s*|\s+dot\s+)onion`)
+
+// FindHostnames returns the valid v3 onion addresses written in given text without URL scheme.
+// The addresses are returned once, in their canonical form (see Address.Hostname)
+func FindHostnames(text string) []string {
+	var hostnames []string
+	seen := map[string]bool{}
+
+	for pos := 0; pos < len(text); {
+		loc := bareAddressRegex.FindStringSubmatchIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[0], pos+loc[1]
+
+		address := strings.Join(strings.Fields(text[pos+loc[2]:pos+loc[3]]), "")
+		addr, err := Parse(address + ".onion")
+
+		// The match may overlap the next address if invalid, or part of a longer word
+		if err != nil || isHostnameChar(text, start-1) || isHostnameChar(text, end) {
+			pos = start + 1
+			continue
+		}
+		pos = end
+
+		// Skip the addresses of the URLs
+		if isURLHostname(text, start) || seen[addr.Hostname] {
+			continue
+		}
+		seen[addr.Hostname] = true
+
+		hostnames = append(hostnames, addr.Hostname)
+	}
+
+	return hostnames
+}
+
+// isURLHostname returns true if the hostname starting at given position is preceded by an URL scheme
+func isURLHostname(text string, start int) bool {
+	// Skip the subdomains
+	for start > 0 && (isHostnameChar(text, start-1) || text[start-1] == '.') {
+		start--
+	}
+
+	return strings.HasSuffix(text[:start], "//")
+}
+
+// isHostnameChar returns true if the character at given position may be part of a hostname label
+func isHostnameChar(text string, i int) bool {
+	if i < 0 || i >= len(text) {
+		return false
+	}
+
+	c := text[i]
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
@@ -0,0 +1,37 @@
+package onion
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindHostnames(t *testing.T) {
+	const facebook = "facebookwkhpilnemxj7asaniu7vnjjbiltxjqhye3mhbshg7kx5tfyd.onion"
+	ddg := strings.TrimSuffix(duckDuckGo, ".onion")
+
+	tests := map[string][]string{
+		"Our mirror: " + duckDuckGo + ", see you there":                 {duckDuckGo},
+		"Mirrors:\n- " + strings.ToUpper(ddg) + ".ONION\n- " + facebook: {duckDuckGo, facebook},
+		ddg + "[.]onion":     {duckDuckGo},
+		ddg + " (dot) onion": {duckDuckGo},
+		ddg + " dot onion":   {duckDuckGo},
+		ddg[:20] + " " + ddg[20:40] + "\n" + ddg[40:] + " .onion": {duckDuckGo},
+		"www." + duckDuckGo + "/about":                            {duckDuckGo},
+		duckDuckGo + " " + duckDuckGo:                             {duckDuckGo},
+
+		// Addresses of URLs, invalid & v2 addresses are ignored
+		"https://" + duckDuckGo + " or http://www." + facebook: nil,
+		"a" + duckDuckGo:                       nil,
+		duckDuckGo + "s":                       nil,
+		"x" + ddg[1:] + ".onion":               nil,
+		"facebookcorewwwi.onion is deprecated": nil,
+		"hidden.onion":                         nil,
+	}
+
+	for text, want := range tests {
+		if hostnames := FindHostnames(text); !reflect.DeepEqual(hostnames, want) {
+			t.Errorf("%q: got %v want %v", text, hostnames, want)
+		}
+	}
+}
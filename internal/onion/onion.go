@@ -0,0 +1,94 @@
+package onion
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/sha3"
+	"strings"
+)
+
+const (
+	// v3AddressLength is the length of a v3 onion address (without the .onion suffix)
+	v3AddressLength = 56
+	// v2AddressLength is the length of a deprecated v2 onion address (without the .onion suffix)
+	v2AddressLength = 16
+	// v3Version is the version byte of the v3 onion addresses
+	v3Version = 0x03
+	// checksumPrefix is the constant prefixed to the hashed data of the v3 checksum
+	checksumPrefix = ".onion checksum"
+)
+
+var (
+	// ErrNotOnion is returned when the hostname is not a .onion one
+	ErrNotOnion = errors.New("hostname is not .onion")
+	// ErrDeprecatedVersion is returned for the v2 onion addresses, no longer supported by Tor
+	ErrDeprecatedVersion = errors.New("v2 onion addresses are deprecated")
+	// ErrInvalidAddress is returned when the onion address is malformed
+	ErrInvalidAddress = errors.New("onion address is invalid")
+)
+
+// onionEncoding is the base32 encoding of the onion addresses (lower case, without padding)
+var onionEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Address is a parsed v3 onion address
+type Address struct {
+	// Hostname is the onion address including the .onion suffix, without the subdomains
+	Hostname string
+	// PublicKey is the ed25519 public key of the hidden service
+	PublicKey ed25519.PublicKey
+}
+
+// Parse returns the v3 onion address of given hostname, which may include subdomains.
+// The address encoding, checksum and version are verified, see:
+// https://gitweb.torproject.org/torspec.git/tree/rend-spec-v3.txt (section 6)
+func Parse(hostname string) (*Address, error) {
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	if !strings.HasSuffix(hostname, ".onion") {
+		return nil, fmt.Errorf("%s %w", hostname, ErrNotOnion)
+	}
+
+	// Ignore the subdomains
+	labels := strings.Split(strings.TrimSuffix(hostname, ".onion"), ".")
+	address := labels[len(labels)-1]
+
+	switch len(address) {
+	case v3AddressLength:
+	case v2AddressLength:
+		return nil, fmt.Errorf("%s.onion %w", address, ErrDeprecatedVersion)
+	default:
+		return nil, fmt.Errorf("%s.onion %w: wrong length", address, ErrInvalidAddress)
+	}
+
+	// onion_address = base32(PUBKEY | CHECKSUM | VERSION)
+	b, err := onionEncoding.DecodeString(address)
+	if err != nil {
+		return nil, fmt.Errorf("%s.onion %w: %s", address, ErrInvalidAddress, err)
+	}
+
+	pubKey, checksum, version := b[:ed25519.PublicKeySize], b[ed25519.PublicKeySize:ed25519.PublicKeySize+2], b[len(b)-1]
+	if version != v3Version {
+		return nil, fmt.Errorf("%s.onion %w: wrong version %d", address, ErrInvalidAddress, version)
+	}
+
+	// CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+	digest := sha3.Sum256(append(append([]byte(checksumPrefix), pubKey...), version))
+	if !bytes.Equal(checksum, digest[:2]) {
+		return nil, fmt.Errorf("%s.onion %w: wrong checksum", address, ErrInvalidAddress)
+	}
+
+	return &Address{
+		Hostname:  address + ".onion",
+		PublicKey: ed25519.PublicKey(pubKey),
+	}, nil
+}
+
+// Hostname returns the v3 onion address of given public key
+func Hostname(pubKey ed25519.PublicKey) string {
+	digest := sha3.Sum256(append(append([]byte(checksumPrefix), pubKey...), v3Version))
+
+	b := append(append(append([]byte{}, pubKey...), digest[:2]...), v3Version)
+	return onionEncoding.EncodeToString(b) + ".onion"
+}
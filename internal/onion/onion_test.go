@@ -0,0 +1,47 @@
+package onion
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+const duckDuckGo = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion"
+
+func TestParse(t *testing.T) {
+	for _, hostname := range []string{duckDuckGo, "www." + duckDuckGo, "DuckDuckGoGG42XJOC72X3SJASOWOARFBGCMVFIMAFTT6TWAGSWZCZAD.ONION"} {
+		addr, err := Parse(hostname)
+		if err != nil {
+			t.Errorf("%s should be valid: %s", hostname, err)
+			continue
+		}
+
+		if addr.Hostname != duckDuckGo || len(addr.PublicKey) != ed25519.PublicKeySize {
+			t.Errorf("unexpected address: %+v", addr)
+		}
+		if Hostname(addr.PublicKey) != duckDuckGo {
+			t.Errorf("public key should give back the address: %s", Hostname(addr.PublicKey))
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	wrongVersion := onionEncoding.EncodeToString(append(make([]byte, 34), 0x04)) + ".onion"
+
+	tests := map[string]error{
+		"example.org":                ErrNotOnion,
+		"facebookcorewwwi.onion":     ErrDeprecatedVersion,
+		"foo.onion":                  ErrInvalidAddress,
+		duckDuckGo[1:]:               ErrInvalidAddress,
+		"a" + duckDuckGo[1:]:         ErrInvalidAddress, // wrong checksum
+		"1" + duckDuckGo[1:]:         ErrInvalidAddress, // not base32
+		wrongVersion:                 ErrInvalidAddress,
+		"www.facebookcorewwwi.onion": ErrDeprecatedVersion,
+	}
+
+	for hostname, want := range tests {
+		if _, err := Parse(hostname); !errors.Is(err, want) {
+			t.Errorf("%s: got %v want %v", hostname, err, want)
+		}
+	}
+}
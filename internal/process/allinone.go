@@ -0,0 +1,195 @@
+package process
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	"os"
+	"strings"
+)
+
+const (
+	seedFlag     = "seed"
+	seedFileFlag = "seed-file"
+)
+
+// MakeAllInOneApp return cli.App running all given processes in the same OS process.
+// The processes are initialized in given order, sharing the same Provider.
+// The given flags replace the processes flags having the same name,
+// this allow to set default values to plug the processes together.
+func MakeAllInOneApp(processes []Process, overrides []cli.Flag) *cli.App {
+	var names []string
+	for _, process := range processes {
+		names = append(names, process.Name())
+	}
+
+	app := &cli.App{
+		Name:    "bs-allinone",
+		Version: version,
+		Usage:   "Bathyscaphe all-in-one",
+		Description: fmt.Sprintf(`
+Run every Bathyscaphe component (%s)
+in a single process, and start crawling from the given seeds.`, strings.Join(names, ", ")),
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "log-level",
+				Usage: "Set the application log level",
+				Value: "info",
+			},
+			&cli.StringSliceFlag{
+				Name:  seedFlag,
+				Usage: "URL to start crawling from",
+			},
+			&cli.StringFlag{
+				Name:  seedFileFlag,
+				Usage: "Path to a file containing the URLs to start crawling from (one per line)",
+			},
+			shutdownTimeout(),
+		},
+		Authors: []*cli.Author{
+			{
+				Name:  "Aloïs Micard",
+				Email: "alois@micard.lu",
+			},
+		},
+		Action: executeAll(processes),
+	}
+
+	overridden := map[string]cli.Flag{}
+	for _, flag := range overrides {
+		overridden[flag.Names()[0]] = flag
+	}
+
+	// Add features & custom flags, only once since processes are sharing them
+	added := map[string]bool{}
+	addFlag := func(flag cli.Flag) {
+		name := flag.Names()[0]
+		if added[name] {
+			return
+		}
+		added[name] = true
+
+		if override, exist := overridden[name]; exist {
+			flag = override
+		}
+		app.Flags = append(app.Flags, flag)
+	}
+
+	featureFlags := getFeaturesFlags()
+	for _, process := range processes {
+		for _, feature := range process.Features() {
+			for _, flag := range featureFlags[feature] {
+				addFlag(flag)
+			}
+		}
+
+		for _, flag := range process.CustomFlags() {
+			addFlag(flag)
+		}
+	}
+
+	return app
+}
+
+func executeAll(processes []Process) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		provider := newDefaultProvider(c)
+
+		// Common setup
+		ConfigureLogger(c)
+
+		// Expose the HTTP API first since the processes
+		// need the ConfigAPI while being initialized
+		handler := &handlers{}
+		handler.add(metricsRouter())
+		handler.add(provider.health.router())
+		srv, err := serveHTTP(handler)
+		if err != nil {
+			log.Err(err).Msg("error while exposing HTTP API")
+			return err
+		}
+
+		for _, process := range processes {
+			if err := process.Initialize(provider); err != nil {
+				log.Err(err).Str("process", process.Name()).Msg("error while initializing process")
+				return err
+			}
+
+			if err := subscribe(process, provider); err != nil {
+				return err
+			}
+
+			if h := process.HTTPHandler(); h != nil {
+				handler.add(h)
+			}
+
+			log.Debug().Str("process", process.Name()).Msg("Process started")
+		}
+
+		provider.health.markStarted()
+
+		log.Info().
+			Str("ver", c.App.Version).
+			Msg(fmt.Sprintf("Started %s", c.App.Name))
+
+		// Start crawling
+		seeds, err := getSeeds(c)
+		if err != nil {
+			log.Err(err).Msg("error while reading seeds")
+			return err
+		}
+
+		if len(seeds) > 0 {
+			pub, err := provider.Publisher()
+			if err != nil {
+				return err
+			}
+
+			for _, seed := range seeds {
+				if err := pub.PublishEvent(&event.NewURLEvent{URL: seed, Seed: seed}); err != nil {
+					log.Err(err).Str("url", seed).Msg("error while publishing seed")
+					return err
+				}
+			}
+
+			log.Info().Int("count", len(seeds)).Msg("Published seeds")
+		}
+
+		// Handle graceful shutdown
+		waitForSignal()
+
+		return shutdown(c, srv, provider, processes)
+	}
+}
+
+// getSeeds returns the seeds given using flags
+func getSeeds(c *cli.Context) ([]string, error) {
+	seeds := c.StringSlice(seedFlag)
+
+	path := c.String(seedFileFlag)
+	if path == "" {
+		return seeds, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines & comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		seeds = append(seeds, line)
+	}
+
+	return seeds, scanner.Err()
+}
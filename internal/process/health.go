@@ -0,0 +1,127 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	"net/http"
+	"sync"
+)
+
+const (
+	// LivenessPath is the path where the process liveness is exposed
+	LivenessPath = "/healthz"
+	// ReadinessPath is the path where the process readiness is exposed
+	ReadinessPath = "/readyz"
+)
+
+var (
+	errStarting = errors.New("process is starting")
+	errStopping = errors.New("process is stopping")
+)
+
+// HealthCheck returns an error if the checked dependency is not healthy
+type HealthCheck func() error
+
+type namedCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// healthChecks hold the checks of the process dependencies
+type healthChecks struct {
+	mutex     sync.RWMutex
+	liveness  []namedCheck
+	readiness []namedCheck
+	// started is set once the process has been initialized
+	started bool
+	// stopping is set once the process has been asked to stop
+	stopping bool
+}
+
+func (h *healthChecks) markStarted() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.started = true
+}
+
+func (h *healthChecks) markStopping() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.stopping = true
+}
+
+func (h *healthChecks) addLiveness(name string, check HealthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.liveness = append(h.liveness, namedCheck{name: name, check: check})
+}
+
+func (h *healthChecks) addReadiness(name string, check HealthCheck) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.readiness = append(h.readiness, namedCheck{name: name, check: check})
+}
+
+// run the liveness (or readiness) checks and returns their status indexed by name
+// ('ok' or the error), and whether they are all succeeding
+func (h *healthChecks) run(readiness bool) (map[string]string, bool) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	checks := h.liveness
+	if readiness {
+		checks = h.readiness
+	}
+
+	healthy := true
+	res := map[string]string{}
+	if readiness && !h.started {
+		healthy = false
+		res["process"] = errStarting.Error()
+	}
+	if readiness && h.stopping {
+		healthy = false
+		res["process"] = errStopping.Error()
+	}
+
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			healthy = false
+			res[c.name] = err.Error()
+			continue
+		}
+
+		// A dependency may be registered several times, the failures take precedence
+		if _, exist := res[c.name]; !exist {
+			res[c.name] = "ok"
+		}
+	}
+
+	return res, healthy
+}
+
+// router returns a router exposing the liveness & readiness endpoints
+func (h *healthChecks) router() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc(LivenessPath, h.handler(false)).Methods(http.MethodGet)
+	r.HandleFunc(ReadinessPath, h.handler(true)).Methods(http.MethodGet)
+	return r
+}
+
+func (h *healthChecks) handler(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, healthy := h.run(readiness)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
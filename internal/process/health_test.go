@@ -0,0 +1,65 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthChecks(t *testing.T) {
+	h := &healthChecks{}
+	router := h.router()
+
+	failing := errors.New("connection refused")
+	cacheErr := error(nil)
+
+	h.addLiveness("event-consumers", func() error { return nil })
+	h.addReadiness("event", func() error { return nil })
+	h.addReadiness("cache", func() error { return nil })
+	h.addReadiness("cache", func() error { return cacheErr })
+
+	// Not ready while starting
+	if code, res := get(t, router, ReadinessPath); code != http.StatusServiceUnavailable || res["process"] != errStarting.Error() {
+		t.Errorf("process should not be ready: %d %v", code, res)
+	}
+
+	// But alive
+	if code, res := get(t, router, LivenessPath); code != http.StatusOK || res["event-consumers"] != "ok" {
+		t.Errorf("process should be alive: %d %v", code, res)
+	}
+
+	h.markStarted()
+
+	if code, res := get(t, router, ReadinessPath); code != http.StatusOK || len(res) != 2 || res["cache"] != "ok" {
+		t.Errorf("process should be ready: %d %v", code, res)
+	}
+
+	// Failing dependency
+	cacheErr = failing
+
+	if code, res := get(t, router, ReadinessPath); code != http.StatusServiceUnavailable || res["cache"] != failing.Error() || res["event"] != "ok" {
+		t.Errorf("process should not be ready: %d %v", code, res)
+	}
+
+	// Not ready while stopping
+	cacheErr = nil
+	h.markStopping()
+
+	if code, res := get(t, router, ReadinessPath); code != http.StatusServiceUnavailable || res["process"] != errStopping.Error() {
+		t.Errorf("process should not be ready: %d %v", code, res)
+	}
+}
+
+func get(t *testing.T, h http.Handler, path string) (int, map[string]string) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	var res map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec.Code, res
+}
@@ -0,0 +1,81 @@
+package process
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const (
+	// MetricsNamespace is the namespace of the Bathyscaphe metrics
+	MetricsNamespace = "bathyscaphe"
+	// MetricsPath is the path where the metrics are exposed
+	MetricsPath = "/metrics"
+)
+
+var (
+	consumedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "event",
+		Name:      "consumed_total",
+		Help:      "The number of events consumed, per exchange and queue",
+	}, []string{"exchange", "queue"})
+	handlerErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "event",
+		Name:      "handler_errors_total",
+		Help:      "The number of events whose handler has failed, per exchange, queue and error kind",
+	}, []string{"exchange", "queue", "kind"})
+	handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "event",
+		Name:      "handler_duration_seconds",
+		Help:      "The time taken to handle the events, per exchange and queue",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"exchange", "queue"})
+)
+
+// ErrorKind returns the kind of given error to be used as metric label: the message of the
+// matching known error, 'deferred' if the event has been deferred, 'other' otherwise
+func ErrorKind(err error, known []error) string {
+	for _, knownErr := range known {
+		if errors.Is(err, knownErr) {
+			return knownErr.Error()
+		}
+	}
+
+	var deferredErr *event.DeferredError
+	if errors.As(err, &deferredErr) {
+		return "deferred"
+	}
+
+	return "other"
+}
+
+// instrument wrap the subscriber handler to record the consuming metrics
+func instrument(def SubscriberDef) event.Handler {
+	return func(subscriber event.Subscriber, msg event.RawMessage) error {
+		start := time.Now()
+		err := def.Handler(subscriber, msg)
+
+		consumedEvents.WithLabelValues(def.Exchange, def.Queue).Inc()
+		handlerDuration.WithLabelValues(def.Exchange, def.Queue).Observe(time.Since(start).Seconds())
+		if err != nil {
+			handlerErrors.WithLabelValues(def.Exchange, def.Queue, ErrorKind(err, def.Errors)).Inc()
+		}
+
+		return err
+	}
+}
+
+// metricsRouter returns a router exposing the metrics
+func metricsRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.Handle(MetricsPath, promhttp.Handler()).Methods(http.MethodGet)
+	return r
+}
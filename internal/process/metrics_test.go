@@ -0,0 +1,52 @@
+package process
+
+import (
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorKind(t *testing.T) {
+	errKnown := errors.New("known error")
+
+	tests := map[error]string{
+		fmt.Errorf("https://example.onion %w", errKnown):                           "known error",
+		event.Defer(time.Second, fmt.Errorf("https://example.onion %w", errKnown)): "known error",
+		event.Defer(time.Second, errors.New("unknown error")):                      "deferred",
+		errors.New("unknown error"):                                                "other",
+	}
+
+	for err, want := range tests {
+		if got := ErrorKind(err, []error{errKnown}); got != want {
+			t.Errorf("wrong kind for %s: (got: %s, want: %s)", err, got, want)
+		}
+	}
+}
+
+func TestMetricsRouter(t *testing.T) {
+	h := &handlers{}
+	h.add(metricsRouter())
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("wrong status code: %d", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "go_goroutines") {
+		t.Error("metrics are not exposed")
+	}
+
+	// Other paths are not handled
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/config/test", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("wrong status code: %d", rec.Code)
+	}
+}
@@ -11,14 +11,19 @@ import (
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	chttp "github.com/darkspot-org/bathyscaphe/internal/http"
+	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/fasthttpproxy"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -41,6 +46,8 @@ const (
 	// EventPrefetchFlag is the prefetch count for the event subscriber
 	EventPrefetchFlag = "event-prefetch"
 
+	shutdownTimeoutFlag = "shutdown-timeout"
+
 	eventURIFlag     = "event-srv"
 	configAPIURIFlag = "config-api"
 	cacheSRVFlag     = "cache-srv"
@@ -68,15 +75,33 @@ type Provider interface {
 	GetStrValues(key string) []string
 	// GetIntValue return int value for given key
 	GetIntValue(key string) int
+	// GetBoolValue return bool value for given key
+	GetBoolValue(key string) bool
+	// GetDurationValue return duration value for given key
+	GetDurationValue(key string) time.Duration
+	// GetFloat64Value return float64 value for given key
+	GetFloat64Value(key string) float64
+	// AddReadinessCheck register a check of a dependency created by the process itself
+	AddReadinessCheck(name string, check HealthCheck)
 }
 
+// defaultProvider create the dependencies, track their health and release them on shutdown
 type defaultProvider struct {
-	ctx *cli.Context
+	ctx    *cli.Context
+	health *healthChecks
+
+	mutex       sync.Mutex
+	subscribers []event.Subscriber
+	closers     []io.Closer
 }
 
 // NewDefaultProvider create a brand new default provider using given cli.Context
 func NewDefaultProvider(ctx *cli.Context) Provider {
-	return &defaultProvider{ctx: ctx}
+	return newDefaultProvider(ctx)
+}
+
+func newDefaultProvider(ctx *cli.Context) *defaultProvider {
+	return &defaultProvider{ctx: ctx, health: &healthChecks{}}
 }
 
 func (p *defaultProvider) Clock() (clock.Clock, error) {
@@ -89,19 +114,51 @@ func (p *defaultProvider) ConfigClient(keys []string) (configapi.Client, error)
 		return nil, err
 	}
 
-	return configapi.NewConfigClient(p.ctx.String(configAPIURIFlag), sub, keys)
+	client, err := configapi.NewConfigClient(p.ctx.String(configAPIURIFlag), sub, keys)
+	if err != nil {
+		return nil, err
+	}
+	p.health.addReadiness("configapi", client.Ping)
+
+	return client, nil
 }
 
 func (p *defaultProvider) Subscriber() (event.Subscriber, error) {
-	return event.NewSubscriber(p.ctx.String(eventURIFlag), p.ctx.Int(EventPrefetchFlag))
+	sub, err := event.NewSubscriber(p.ctx.String(eventURIFlag), p.ctx.Int(EventPrefetchFlag))
+	if err != nil {
+		return nil, err
+	}
+	p.health.addReadiness("event", sub.Ping)
+	p.health.addLiveness("event-consumers", sub.CheckConsumers)
+
+	p.mutex.Lock()
+	p.subscribers = append(p.subscribers, sub)
+	p.closers = append(p.closers, sub)
+	p.mutex.Unlock()
+
+	return sub, nil
 }
 
 func (p *defaultProvider) Publisher() (event.Publisher, error) {
-	return event.NewPublisher(p.ctx.String(eventURIFlag))
+	pub, err := event.NewPublisher(p.ctx.String(eventURIFlag))
+	if err != nil {
+		return nil, err
+	}
+	p.health.addReadiness("event", pub.Ping)
+	p.track(pub)
+
+	return pub, nil
 }
 
 func (p *defaultProvider) Cache(keyPrefix string) (cache.Cache, error) {
-	return cache.NewRedisCache(p.ctx.String(cacheSRVFlag), keyPrefix)
+	c, err := cache.NewCache(p.ctx.String(cacheSRVFlag), keyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	p.health.addReadiness("cache", c.Ping)
+	p.track(c)
+
+	return c, nil
 }
 
 func (p *defaultProvider) HTTPClient() (chttp.Client, error) {
@@ -128,11 +185,65 @@ func (p *defaultProvider) GetIntValue(key string) int {
 	return p.ctx.Int(key)
 }
 
+func (p *defaultProvider) GetBoolValue(key string) bool {
+	return p.ctx.Bool(key)
+}
+
+func (p *defaultProvider) GetDurationValue(key string) time.Duration {
+	return p.ctx.Duration(key)
+}
+
+func (p *defaultProvider) GetFloat64Value(key string) float64 {
+	return p.ctx.Float64(key)
+}
+
+func (p *defaultProvider) AddReadinessCheck(name string, check HealthCheck) {
+	p.health.addReadiness(name, check)
+}
+
+// track register a dependency to close on shutdown
+func (p *defaultProvider) track(closer io.Closer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closers = append(p.closers, closer)
+}
+
+// drain stop the consumption of the subscribers and wait for the events being handled,
+// until given deadline
+func (p *defaultProvider) drain(deadline time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, sub := range p.subscribers {
+		if err := sub.Drain(time.Until(deadline)); err != nil {
+			log.Err(err).Msg("error while draining subscriber")
+		}
+	}
+}
+
+// close release the dependencies, the latest created first
+func (p *defaultProvider) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i := len(p.closers) - 1; i >= 0; i-- {
+		if err := p.closers[i].Close(); err != nil {
+			log.Err(err).Msg("error while closing dependency")
+		}
+	}
+	p.closers = nil
+}
+
 // SubscriberDef is the subscriber definition
 type SubscriberDef struct {
 	Exchange string
 	Queue    string
 	Handler  event.Handler
+	// RetryPolicy is the policy applied to failing events, nil means no retry
+	RetryPolicy *event.RetryPolicy
+	// Errors are the expected errors of the handler, used to label the metrics
+	Errors []error
 }
 
 // Process is a component of Bathyscaphe
@@ -144,6 +255,9 @@ type Process interface {
 	Initialize(provider Provider) error
 	Subscribers() []SubscriberDef
 	HTTPHandler() http.Handler
+	// Shutdown is called once the events consumption has stopped,
+	// to flush the buffers and release the dependencies created by the process itself
+	Shutdown() error
 }
 
 // MakeApp return cli.App corresponding for given Process
@@ -159,6 +273,7 @@ func MakeApp(process Process) *cli.App {
 				Usage: "Set the application log level",
 				Value: "info",
 			},
+			shutdownTimeout(),
 		},
 		Authors: []*cli.Author{
 			{
@@ -166,7 +281,22 @@ func MakeApp(process Process) *cli.App {
 				Email: "alois@micard.lu",
 			},
 		},
-		Action: execute(process),
+	}
+
+	// Add dead letters management if process is consuming events
+	if len(process.Subscribers()) > 0 {
+		app.Commands = append(app.Commands, &cli.Command{
+			Name:  "replay-dead-letters",
+			Usage: "Re-inject the dead-lettered events of the given queues",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:     "queue",
+					Usage:    "Name of the queue whose dead letters should be replayed",
+					Required: true,
+				},
+			},
+			Action: replayDeadLetters,
+		})
 	}
 
 	// Add features flags
@@ -182,15 +312,44 @@ func MakeApp(process Process) *cli.App {
 		app.Flags = append(app.Flags, flag)
 	}
 
+	// The required flags are checked when running the process only,
+	// the commands needing a few dependencies only (to replay the dead letters for example)
+	// should run without the others
+	var required []string
+	for i, flag := range app.Flags {
+		if f, ok := flag.(cli.RequiredFlag); ok && f.IsRequired() {
+			required = append(required, flag.Names()[0])
+			app.Flags[i] = optional(flag)
+		}
+	}
+
+	app.Action = execute(process, required)
+
 	return app
 }
 
-func execute(process Process) cli.ActionFunc {
+func execute(process Process, required []string) cli.ActionFunc {
 	return func(c *cli.Context) error {
-		provider := NewDefaultProvider(c)
+		if err := checkRequiredFlags(c, required); err != nil {
+			_ = cli.ShowAppHelp(c)
+			return err
+		}
+
+		provider := newDefaultProvider(c)
 
 		// Common setup
-		configureLogger(c)
+		ConfigureLogger(c)
+
+		// Expose the metrics & health first so the process can be probed while starting
+		handler := &handlers{}
+		handler.add(metricsRouter())
+		handler.add(provider.health.router())
+
+		srv, err := serveHTTP(handler)
+		if err != nil {
+			log.Err(err).Msg("error while exposing HTTP API")
+			return err
+		}
 
 		// Custom setup
 		if err := process.Initialize(provider); err != nil {
@@ -199,62 +358,229 @@ func execute(process Process) cli.ActionFunc {
 		}
 
 		// Create subscribers if any
-		if len(process.Subscribers()) > 0 {
-			sub, err := provider.Subscriber()
-			if err != nil {
-				return err
-			}
-			// TODO sub.Close()
-
-			for _, subscriberDef := range process.Subscribers() {
-				if err := sub.Subscribe(subscriberDef.Exchange, subscriberDef.Queue, subscriberDef.Handler); err != nil {
-					log.Err(err).
-						Str("exchange", subscriberDef.Exchange).
-						Str("queue", subscriberDef.Queue).
-						Msg("error while subscribing")
-					return err
-				}
-			}
+		if err := subscribe(process, provider); err != nil {
+			return err
 		}
 
-		var srv *http.Server
-
 		// Expose HTTP API if any
 		if h := process.HTTPHandler(); h != nil {
-			srv = &http.Server{
-				Addr: "0.0.0.0:8080",
-				// Good practice to set timeouts to avoid Slowloris attacks.
-				WriteTimeout: time.Second * 15,
-				ReadTimeout:  time.Second * 15,
-				IdleTimeout:  time.Second * 60,
-				Handler:      h, // Pass our instance of gorilla/mux in.
-			}
-
-			go func() {
-				_ = srv.ListenAndServe()
-			}()
+			handler.add(h)
 		}
 
+		provider.health.markStarted()
+
 		log.Info().
 			Str("ver", c.App.Version).
 			Msg(fmt.Sprintf("Started %s", c.App.Name))
 
 		// Handle graceful shutdown
-		ch := make(chan os.Signal, 1)
-		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		waitForSignal()
+
+		return shutdown(c, srv, provider, []Process{process})
+	}
+}
+
+// shutdown stop consuming events, wait for the events being handled (within the shutdown timeout),
+// then let the processes flush their buffers before releasing the dependencies
+func shutdown(c *cli.Context, srv *http.Server, provider *defaultProvider, processes []Process) error {
+	deadline := time.Now().Add(c.Duration(shutdownTimeoutFlag))
 
-		// Block until we receive our signal.
-		<-ch
+	log.Info().Msg("Shutting down")
+	provider.health.markStopping()
 
-		// Close HTTP API if any
-		if srv != nil {
-			_ = srv.Shutdown(context.Background())
+	provider.drain(deadline)
+
+	var shutdownErr error
+	for _, process := range processes {
+		if err := process.Shutdown(); err != nil {
+			log.Err(err).Str("process", process.Name()).Msg("error while shutting down process")
+			shutdownErr = err
 		}
+	}
 
-		// Connections are deferred here
+	provider.close()
 
+	// Close HTTP API
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	_ = srv.Shutdown(ctx)
+
+	return shutdownErr
+}
+
+// subscribe plug the process subscribers (if any) to the event server
+func subscribe(process Process, provider Provider) error {
+	if len(process.Subscribers()) == 0 {
 		return nil
 	}
+
+	// The subscriber is drained & closed by the provider on shutdown
+	sub, err := provider.Subscriber()
+	if err != nil {
+		return err
+	}
+
+	for _, subscriberDef := range process.Subscribers() {
+		handler := instrument(subscriberDef)
+
+		var err error
+		if subscriberDef.RetryPolicy != nil {
+			err = sub.SubscribeWithRetry(subscriberDef.Exchange, subscriberDef.Queue, handler, *subscriberDef.RetryPolicy)
+		} else {
+			err = sub.Subscribe(subscriberDef.Exchange, subscriberDef.Queue, handler)
+		}
+
+		if err != nil {
+			log.Err(err).
+				Str("exchange", subscriberDef.Exchange).
+				Str("queue", subscriberDef.Queue).
+				Msg("error while subscribing")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// serveHTTP start serving given handler asynchronously
+func serveHTTP(h http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr: "0.0.0.0:8080",
+		// Good practice to set timeouts to avoid Slowloris attacks.
+		WriteTimeout: time.Second * 15,
+		ReadTimeout:  time.Second * 15,
+		IdleTimeout:  time.Second * 60,
+		Handler:      h, // Pass our instance of gorilla/mux in.
+	}
+
+	// Listen synchronously so that the API is reachable once returned
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		_ = srv.Serve(l)
+	}()
+
+	return srv, nil
+}
+
+// handlers dispatch the requests to the first handler having a matching route
+type handlers struct {
+	mutex    sync.RWMutex
+	handlers []http.Handler
+}
+
+func (h *handlers) add(handler http.Handler) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.handlers = append(h.handlers, handler)
+}
+
+func (h *handlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for _, handler := range h.handlers {
+		// Handlers without route matching are catching everything
+		router, ok := handler.(*mux.Router)
+		if !ok || router.Match(r, &mux.RouteMatch{}) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+}
+
+// waitForSignal block until the process is asked to stop
+func waitForSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+
+	<-ch
+}
+
+func replayDeadLetters(c *cli.Context) error {
+	if err := checkRequiredFlags(c, []string{eventURIFlag}); err != nil {
+		_ = cli.ShowCommandHelp(c, c.Command.Name)
+		return err
+	}
+
+	provider := NewDefaultProvider(c)
+
+	ConfigureLogger(c)
+
+	sub, err := provider.Subscriber()
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	for _, queue := range c.StringSlice("queue") {
+		count, err := sub.ReplayDeadLetters(queue)
+		if err != nil {
+			log.Err(err).Str("queue", queue).Msg("error while replaying dead letters")
+			return err
+		}
+
+		log.Info().
+			Str("queue", queue).
+			Int("count", count).
+			Msg("Successfully replayed dead letters")
+	}
+
+	return nil
+}
+
+// checkRequiredFlags returns an error listing the given flags not set
+func checkRequiredFlags(c *cli.Context, names []string) error {
+	var missing []string
+	for _, name := range names {
+		if !c.IsSet(name) {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("required flags %q not set", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// optional returns a copy of given required flag, not checked by the cli framework
+func optional(flag cli.Flag) cli.Flag {
+	switch f := flag.(type) {
+	case *cli.StringFlag:
+		copied := *f
+		copied.Required = false
+		return &copied
+	case *cli.StringSliceFlag:
+		copied := *f
+		copied.Required = false
+		return &copied
+	case *cli.IntFlag:
+		copied := *f
+		copied.Required = false
+		return &copied
+	case *cli.DurationFlag:
+		copied := *f
+		copied.Required = false
+		return &copied
+	default:
+		return flag
+	}
+}
+
+func shutdownTimeout() cli.Flag {
+	return &cli.DurationFlag{
+		Name:  shutdownTimeoutFlag,
+		Usage: "Maximum duration to wait for the events being handled when stopping",
+		Value: 30 * time.Second,
+	}
 }
 
 func getFeaturesFlags() map[Feature][]cli.Flag {
@@ -305,7 +631,8 @@ func getFeaturesFlags() map[Feature][]cli.Flag {
 	return flags
 }
 
-func configureLogger(ctx *cli.Context) {
+// ConfigureLogger set the application logger up from the log-level flag
+func ConfigureLogger(ctx *cli.Context) {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 
 	// Set application log level
@@ -0,0 +1,58 @@
+package process
+
+import (
+	"errors"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/urfave/cli/v2"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var errInitialized = errors.New("initialized")
+
+// stubProcess is consuming events and failing once initialized, to stop the app
+type stubProcess struct{}
+
+func (p *stubProcess) Name() string        { return "stub" }
+func (p *stubProcess) Description() string { return "" }
+func (p *stubProcess) Features() []Feature {
+	return []Feature{EventFeature, ConfigFeature, CacheFeature, CrawlingFeature}
+}
+func (p *stubProcess) CustomFlags() []cli.Flag {
+	return []cli.Flag{&cli.StringFlag{Name: "index-driver", Required: true}}
+}
+func (p *stubProcess) Initialize(provider Provider) error { return errInitialized }
+func (p *stubProcess) Subscribers() []SubscriberDef {
+	return []SubscriberDef{{Exchange: "stub", Queue: "stubQueue", Handler: func(event.Subscriber, event.RawMessage) error { return nil }}}
+}
+func (p *stubProcess) HTTPHandler() http.Handler { return nil }
+func (p *stubProcess) Shutdown() error           { return nil }
+
+func TestMakeApp_RequiredFlags(t *testing.T) {
+	app := MakeApp(&stubProcess{})
+	app.Writer = ioutil.Discard
+
+	// The process requires every flag of its features
+	err := app.Run([]string{"bs-stub", "--event-srv", "memory://" + t.Name()})
+	if err == nil || err == errInitialized {
+		t.Fatalf("process should not start without its required flags: %v", err)
+	}
+	for _, name := range []string{"config-api", "cache-srv", "tor-proxy", "index-driver"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("missing flag %s not reported: %s", name, err)
+		}
+	}
+	if strings.Contains(err.Error(), "event-srv") {
+		t.Errorf("set flag reported as missing: %s", err)
+	}
+
+	// While the dead letters may be replayed with the event server only
+	if err := app.Run([]string{"bs-stub", "replay-dead-letters", "--queue", "stubQueue"}); err == nil || !strings.Contains(err.Error(), "event-srv") {
+		t.Errorf("missing event-srv flag not reported: %v", err)
+	}
+	if err := app.Run([]string{"bs-stub", "--event-srv", "memory://" + t.Name(), "replay-dead-letters", "--queue", "stubQueue"}); err != nil {
+		t.Errorf("error while replaying dead letters: %s", err)
+	}
+}
@@ -0,0 +1,178 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/bloom"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/clock"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"sync"
+	"time"
+)
+
+const (
+	dedupeFlag           = "dedupe"
+	bloomCapacityFlag    = "bloom-capacity"
+	bloomFPRateFlag      = "bloom-fp-rate"
+	bloomGenerationsFlag = "bloom-generations"
+
+	// cacheDedupe keep a cache entry per scheduled URL: exact and shared between the replicas
+	cacheDedupe = "cache"
+	// bloomDedupe keep the scheduled URLs in an in-process Bloom filter: bounded memory, but
+	// an URL may be wrongly considered as scheduled, and the replicas don't share their filter
+	bloomDedupe = "bloom"
+)
+
+// urlDeduper record the scheduled URLs (by hash), so that an URL is scheduled once per refresh delay
+type urlDeduper interface {
+	// Claim marks the URLs not scheduled yet as scheduled for ttl, and returns which ones have been claimed
+	Claim(hashes []string, ttl time.Duration) (map[string]bool, error)
+	// Mark marks the URLs as scheduled for ttl, even if already scheduled
+	Mark(hashes []string, ttl time.Duration) error
+	// Release forget the given URL, so that it may be scheduled again
+	Release(hash string) error
+}
+
+// newURLDeduper returns the deduper configured for the process
+func newURLDeduper(provider process.Provider) (urlDeduper, error) {
+	switch kind := provider.GetStrValue(dedupeFlag); kind {
+	case cacheDedupe:
+		urlCache, err := provider.Cache("url")
+		if err != nil {
+			return nil, err
+		}
+		return &cacheDeduper{cache: urlCache}, nil
+	case bloomDedupe:
+		cl, err := provider.Clock()
+		if err != nil {
+			return nil, err
+		}
+
+		capacity := provider.GetIntValue(bloomCapacityFlag)
+		fpRate := provider.GetFloat64Value(bloomFPRateFlag)
+		if capacity <= 0 || fpRate <= 0 || fpRate >= 1 {
+			return nil, fmt.Errorf("invalid bloom filter capacity (%d) or false positive rate (%f)", capacity, fpRate)
+		}
+
+		return newBloomDeduper(provider.GetIntValue(bloomGenerationsFlag), uint64(capacity), fpRate, cl), nil
+	default:
+		return nil, fmt.Errorf("unknown dedupe backend: %s", kind)
+	}
+}
+
+// cacheDeduper keep an entry per scheduled URL in the cache, expiring once the URL may be scheduled again
+type cacheDeduper struct {
+	cache cache.Cache
+}
+
+func (d *cacheDeduper) Claim(hashes []string, ttl time.Duration) (map[string]bool, error) {
+	claims := map[string]int64{}
+	for _, hash := range hashes {
+		claims[hash] = 1
+	}
+
+	// Claim the URLs atomically, so that an URL found concurrently by several replicas is scheduled once
+	return d.cache.SetManyNX(claims, ttl)
+}
+
+func (d *cacheDeduper) Mark(hashes []string, ttl time.Duration) error {
+	values := map[string]int64{}
+	for _, hash := range hashes {
+		values[hash] = 1
+	}
+
+	return d.cache.SetManyInt64(values, ttl)
+}
+
+func (d *cacheDeduper) Release(hash string) error {
+	return d.cache.Remove(hash)
+}
+
+// bloomDeduper keep the scheduled URLs in a time partitioned Bloom filter. The filter generations
+// are rotated so that an URL is forgotten between ttl and ttl*generations/(generations-1) after being scheduled.
+// Since the rotation is global, the URLs all expire after the refresh delay (the adapted ones are not honoured)
+type bloomDeduper struct {
+	filter      *bloom.Rotating
+	generations int
+	clock       clock.Clock
+
+	mutex     sync.Mutex
+	rotatedAt time.Time
+}
+
+func newBloomDeduper(generations int, capacity uint64, fpRate float64, cl clock.Clock) *bloomDeduper {
+	if generations < 2 {
+		generations = 2
+	}
+
+	return &bloomDeduper{
+		filter:      bloom.NewRotating(generations, capacity, fpRate),
+		generations: generations,
+		clock:       cl,
+		rotatedAt:   cl.Now(),
+	}
+}
+
+func (d *bloomDeduper) Claim(hashes []string, ttl time.Duration) (map[string]bool, error) {
+	d.rotate(ttl)
+
+	claimed := map[string]bool{}
+	for _, hash := range hashes {
+		claimed[hash] = !d.filter.TestAndAdd([]byte(hash))
+	}
+
+	d.updateMetrics()
+
+	return claimed, nil
+}
+
+func (d *bloomDeduper) Mark(hashes []string, ttl time.Duration) error {
+	d.rotate(ttl)
+
+	for _, hash := range hashes {
+		d.filter.Add([]byte(hash))
+	}
+
+	d.updateMetrics()
+
+	return nil
+}
+
+// Release does nothing: an URL cannot be removed from a Bloom filter, it is forgotten with its generation
+func (d *bloomDeduper) Release(hash string) error {
+	return nil
+}
+
+// rotate the filter generations once their period (depending on the refresh delay) is elapsed
+func (d *bloomDeduper) rotate(ttl time.Duration) {
+	// The URLs are scheduled once if there's no refresh delay
+	if ttl <= 0 {
+		return
+	}
+
+	period := ttl / time.Duration(d.generations-1)
+	if period <= 0 {
+		period = ttl
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.clock.Now()
+	elapsed := int(now.Sub(d.rotatedAt) / period)
+	if elapsed <= 0 {
+		return
+	}
+
+	// No need to rotate more than the number of generations, every one is dropped then
+	for i := 0; i < elapsed && i < d.generations; i++ {
+		d.filter.Rotate()
+	}
+	d.rotatedAt = d.rotatedAt.Add(time.Duration(elapsed) * period)
+}
+
+func (d *bloomDeduper) updateMetrics() {
+	stats := d.filter.Stats()
+	dedupeFilterItems.Set(float64(stats.Items))
+	dedupeFilterFillRatio.Set(stats.FillRatio)
+}
@@ -0,0 +1,97 @@
+package scheduler
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/clock"
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/process_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/test"
+	"github.com/golang/mock/gomock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestState_Initialize_BloomDedupe(t *testing.T) {
+	s := State{}
+	test.CheckInitialize(t, &s, func(p *process_mock.MockProviderMockRecorder) {
+		p.GetStrValue("dedupe").Return("bloom")
+		p.Clock().Return(&clock.SystemClock{}, nil)
+		p.GetIntValue("bloom-capacity").Return(1000)
+		p.GetFloat64Value("bloom-fp-rate").Return(0.01)
+		p.GetIntValue("bloom-generations").Return(4)
+		p.Cache("hostname")
+		p.Cache("recrawl")
+		p.GetBoolValue("frontier").Return(false)
+		p.ConfigClient(gomock.Any())
+	})
+
+	if _, ok := s.urlDeduper.(*bloomDeduper); !ok {
+		t.Errorf("wrong deduper: %T", s.urlDeduper)
+	}
+}
+
+func TestBloomDeduper(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+
+	tn := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clockMock.EXPECT().Now().Return(tn)
+	d := newBloomDeduper(3, 1000, 0.01, clockMock)
+
+	// Generations are rotated every 30 minutes, the URLs being forgotten after 1 hour to 1 hour and a half
+	ttl := time.Hour
+
+	clockMock.EXPECT().Now().Return(tn)
+	claimed, err := d.Claim([]string{"a", "b"}, ttl)
+	if err != nil {
+		t.FailNow()
+	}
+	if !reflect.DeepEqual(claimed, map[string]bool{"a": true, "b": true}) {
+		t.Errorf("wrong claimed URLs: %v", claimed)
+	}
+
+	clockMock.EXPECT().Now().Return(tn.Add(45 * time.Minute))
+	if err := d.Mark([]string{"c"}, ttl); err != nil {
+		t.FailNow()
+	}
+
+	clockMock.EXPECT().Now().Return(tn.Add(59 * time.Minute))
+	if claimed, _ := d.Claim([]string{"a", "c", "d"}, ttl); !reflect.DeepEqual(claimed, map[string]bool{"a": false, "c": false, "d": true}) {
+		t.Errorf("wrong claimed URLs: %v", claimed)
+	}
+
+	// Releasing does not forget the URL
+	if err := d.Release("d"); err != nil {
+		t.FailNow()
+	}
+
+	clockMock.EXPECT().Now().Return(tn.Add(90 * time.Minute))
+	if claimed, _ := d.Claim([]string{"a", "c", "d"}, ttl); !reflect.DeepEqual(claimed, map[string]bool{"a": true, "c": false, "d": false}) {
+		t.Errorf("wrong claimed URLs: %v", claimed)
+	}
+
+	// Every generation is dropped after a long time
+	clockMock.EXPECT().Now().Return(tn.Add(48 * time.Hour))
+	if claimed, _ := d.Claim([]string{"c", "d"}, ttl); !reflect.DeepEqual(claimed, map[string]bool{"c": true, "d": true}) {
+		t.Errorf("wrong claimed URLs: %v", claimed)
+	}
+}
+
+func TestBloomDeduper_NoTTL(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	clockMock.EXPECT().Now().Return(time.Now())
+
+	// Without refresh delay the generations are never rotated (no clock access)
+	d := newBloomDeduper(2, 1000, 0.01, clockMock)
+	if claimed, _ := d.Claim([]string{"a"}, 0); !claimed["a"] {
+		t.Errorf("wrong claimed URLs: %v", claimed)
+	}
+	if claimed, _ := d.Claim([]string{"a"}, 0); claimed["a"] {
+		t.Errorf("wrong claimed URLs: %v", claimed)
+	}
+}
@@ -0,0 +1,177 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/onion"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"mvdan.cc/xurls/v2"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// linkSelectors are the HTML elements holding links, and the attribute holding the link
+var linkSelectors = []struct {
+	selector string
+	attr     string
+}{
+	{selector: "a[href]", attr: "href"},
+	{selector: "area[href]", attr: "href"},
+	{selector: "link[href]", attr: "href"},
+	{selector: "form[action]", attr: "action"},
+	{selector: "[src]", attr: "src"},
+}
+
+// extractURLS extract the URLs from given resource.
+// HTML resources are parsed and their relative links resolved,
+// the URLs are extracted from the raw body for the other content types.
+// The onion addresses written without scheme in the text give their root URL, both in HTTP and HTTPS.
+func extractURLS(msg *event.NewResourceEvent) ([]string, error) {
+	var urls []string
+	text := msg.Body
+	if isHTML(msg) {
+		resourceURL, err := url.Parse(msg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing URL: %s", err)
+		}
+
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(msg.Body))
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing HTML: %s", err)
+		}
+
+		urls = extractHTMLURLS(resourceURL, doc)
+		text = htmlText(doc)
+	} else {
+		urls = xurls.Strict().FindAllString(msg.Body, -1)
+	}
+
+	for _, hostname := range onion.FindHostnames(text) {
+		urls = append(urls, "http://"+hostname, "https://"+hostname)
+	}
+
+	// Normalize & de-duplicate URLs
+	var normalizedURLS []string
+	seen := map[string]bool{}
+
+	for _, u := range urls {
+		normalizedURL, err := urlnorm.Normalize(u)
+		if err != nil {
+			continue
+		}
+
+		if seen[normalizedURL] {
+			continue
+		}
+		seen[normalizedURL] = true
+
+		normalizedURLS = append(normalizedURLS, normalizedURL)
+	}
+
+	return normalizedURLS, nil
+}
+
+// isHTML determinate if given resource is an HTML document.
+// The content type is sniffed from the body when the header is missing
+func isHTML(msg *event.NewResourceEvent) bool {
+	contentType := ""
+	for key, value := range msg.Headers {
+		if strings.EqualFold(key, "Content-Type") {
+			contentType = value
+			break
+		}
+	}
+
+	if contentType == "" {
+		contentType = http.DetectContentType([]byte(msg.Body))
+	}
+
+	contentType = strings.ToLower(contentType)
+	return strings.Contains(contentType, "text/html") || strings.Contains(contentType, "application/xhtml")
+}
+
+// extractHTMLURLS returns the absolute URLs of the links of given HTML document
+func extractHTMLURLS(resourceURL *url.URL, doc *goquery.Document) []string {
+	// Relative links are resolved against the <base> if any
+	baseURL := resourceURL
+	if href, exist := doc.Find("base[href]").First().Attr("href"); exist {
+		if u, err := resourceURL.Parse(strings.TrimSpace(href)); err == nil {
+			baseURL = u
+		}
+	}
+
+	var links []string
+	for _, linkSelector := range linkSelectors {
+		attr := linkSelector.attr
+		doc.Find(linkSelector.selector).Each(func(i int, s *goquery.Selection) {
+			links = append(links, s.AttrOr(attr, ""))
+		})
+	}
+
+	// <meta http-equiv="refresh" content="5; url=/next">
+	doc.Find("meta[http-equiv]").Each(func(i int, s *goquery.Selection) {
+		if !strings.EqualFold(s.AttrOr("http-equiv", ""), "refresh") {
+			return
+		}
+
+		if link := parseMetaRefresh(s.AttrOr("content", "")); link != "" {
+			links = append(links, link)
+		}
+	})
+
+	var urls []string
+	for _, link := range links {
+		link = strings.TrimSpace(link)
+		if link == "" {
+			continue
+		}
+
+		u, err := baseURL.Parse(link)
+		if err != nil {
+			continue
+		}
+
+		// Ignore javascript:, mailto:, data:, etc...
+		if u.Scheme != "http" && u.Scheme != "https" {
+			continue
+		}
+
+		urls = append(urls, u.String())
+	}
+
+	return urls
+}
+
+// htmlText returns the text nodes of given HTML document, one per line
+// so that the text of adjacent elements is not concatenated
+func htmlText(doc *goquery.Document) string {
+	var lines []string
+	doc.Find("*").Contents().Each(func(i int, s *goquery.Selection) {
+		if goquery.NodeName(s) == "#text" {
+			lines = append(lines, s.Text())
+		}
+	})
+
+	return strings.Join(lines, "\n")
+}
+
+// parseMetaRefresh returns the URL of given meta refresh content (<delay>; url=<url>), if any
+func parseMetaRefresh(content string) string {
+	parts := strings.SplitN(content, ";", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+
+	value := strings.TrimSpace(parts[1])
+	if strings.HasPrefix(strings.ToLower(value), "url") {
+		value = strings.TrimSpace(value[len("url"):])
+		if !strings.HasPrefix(value, "=") {
+			return ""
+		}
+		value = strings.TrimSpace(value[len("="):])
+	}
+
+	return strings.Trim(value, `'"`)
+}
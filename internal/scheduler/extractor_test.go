@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractURLS_HTML(t *testing.T) {
+	msg := event.NewResourceEvent{
+		URL:     "https://example.onion/forum/index.php",
+		Headers: map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		Body: `<html>
+<head>
+	<meta http-equiv="Refresh" content="5; URL='/forum/next.php'">
+	<link rel="alternate" href="https://mirror.onion/">
+</head>
+<body>
+	<a href="/forum/page2">Next page</a>
+	<a href="thread.php?id=12#comments">Thread</a>
+	<a href="../about">About</a>
+	<a href="/forum/page2">Duplicate</a>
+	<a href="javascript:void(0)">JS</a>
+	<a href="mailto:admin@example.onion">Contact</a>
+	<img src="//images.onion/logo.png">
+	<form action="search.php"></form>
+	Check out https://google.onion
+</body>
+</html>`,
+	}
+
+	urls, err := extractURLS(&msg)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := []string{
+		"https://example.onion/forum/page2",
+		"https://example.onion/forum/thread.php?id=12",
+		"https://example.onion/about",
+		"https://mirror.onion",
+		"https://example.onion/forum/search.php",
+		"https://images.onion/logo.png",
+		"https://example.onion/forum/next.php",
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("wrong URLs: (got: %v, want: %v)", urls, want)
+	}
+}
+
+func TestExtractURLS_Base(t *testing.T) {
+	msg := event.NewResourceEvent{
+		URL:  "https://example.onion/forum/index.php",
+		Body: `<html><head><base href="https://cdn.onion/files/"></head><body><a href="a.html">A</a></body></html>`,
+	}
+
+	urls, err := extractURLS(&msg)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if len(urls) != 1 || urls[0] != "https://cdn.onion/files/a.html" {
+		t.Errorf("wrong URLs: %v", urls)
+	}
+}
+
+func TestExtractURLS_Text(t *testing.T) {
+	msg := event.NewResourceEvent{
+		URL:     "https://example.onion/links.txt",
+		Headers: map[string]string{"content-type": "text/plain"},
+		Body:    "Check out https://google.onion and https://facebook.onion/test.php?id=1 or /relative",
+	}
+
+	urls, err := extractURLS(&msg)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := []string{"https://google.onion", "https://facebook.onion/test.php?id=1"}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("wrong URLs: (got: %v, want: %v)", urls, want)
+	}
+}
+
+func TestExtractURLS_BareOnion(t *testing.T) {
+	// HTML text, the adjacent elements are not concatenated
+	msg := event.NewResourceEvent{
+		URL: "https://" + exampleOnion + "/mirrors.php",
+		Body: `<html><body><ul>
+	<li>` + googleOnion + `</li><li>` + strings.TrimSuffix(facebookOnion, ".onion") + `[.]onion</li>
+	<li><a href="https://` + forumOnion + `/forum.php">https://` + forumOnion + `/forum.php</a></li>
+</ul></body></html>`,
+	}
+
+	urls, err := extractURLS(&msg)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := []string{
+		"https://" + forumOnion + "/forum.php",
+		"http://" + googleOnion,
+		"https://" + googleOnion,
+		"http://" + facebookOnion,
+		"https://" + facebookOnion,
+	}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("wrong URLs: (got: %v, want: %v)", urls, want)
+	}
+
+	// Raw text, the addresses may be split across whitespace
+	msg = event.NewResourceEvent{
+		URL:     "https://" + exampleOnion + "/mirrors.txt",
+		Headers: map[string]string{"Content-Type": "text/plain"},
+		Body:    "Mirror: " + googleOnion[:28] + "\n" + googleOnion[28:] + ", old one: facebookcorewwwi.onion",
+	}
+
+	urls, err = extractURLS(&msg)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want = []string{"http://" + googleOnion, "https://" + googleOnion}
+	if !reflect.DeepEqual(urls, want) {
+		t.Errorf("wrong URLs: (got: %v, want: %v)", urls, want)
+	}
+}
+
+func TestParseMetaRefresh(t *testing.T) {
+	tests := map[string]string{
+		"5":                         "",
+		"0; url=/next":              "/next",
+		"0;URL='https://a.onion/b'": "https://a.onion/b",
+		`10; Url="relative.html"`:   "relative.html",
+		"3; url = /spaces":          "/spaces",
+		"1; /no-prefix":             "/no-prefix",
+	}
+
+	for content, want := range tests {
+		if got := parseMetaRefresh(content); got != want {
+			t.Errorf("wrong URL for %s: (got: %s, want: %s)", content, got, want)
+		}
+	}
+}
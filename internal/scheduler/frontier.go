@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	frontierFlag          = "frontier"
+	frontierIntervalFlag  = "frontier-interval"
+	frontierBatchSizeFlag = "frontier-batch-size"
+
+	// frontierSet is the sorted set of the known URLs (by hash), scored by next crawl time (unix)
+	frontierSet = "due"
+)
+
+// frontierEntry is how a known URL is crawled again, indexed by URL hash
+type frontierEntry struct {
+	URL       string            `json:"url"`
+	Depth     int               `json:"depth"`
+	Seed      string            `json:"seed"`
+	PublicKey ed25519.PublicKey `json:"public-key,omitempty"`
+}
+
+// addToFrontier record the crawled resource to be crawled again once given interval is elapsed
+func (state *State) addToFrontier(evt *event.NewResourceEvent, interval time.Duration) error {
+	if state.frontierCache == nil || interval <= 0 {
+		return nil
+	}
+
+	key, err := urlnorm.Hash(evt.URL)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(frontierEntry{URL: evt.URL, Depth: evt.Depth, Seed: evt.Seed, PublicKey: evt.PublicKey})
+	if err != nil {
+		return err
+	}
+
+	if err := state.frontierCache.SetBytes(key, b, 2*interval); err != nil {
+		return err
+	}
+
+	due := state.clock.Now().Add(interval).Unix()
+	return state.frontierCache.SetScores(frontierSet, map[string]int64{key: due})
+}
+
+// runFrontier publish the due URLs of the frontier at given interval, until stopped
+func (state *State) runFrontier(interval time.Duration) {
+	defer close(state.frontierDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-state.frontierStop:
+			return
+		case <-ticker.C:
+			if err := state.publishDueURLs(); err != nil {
+				log.Err(err).Msg("error while publishing the due URLs")
+			}
+		}
+	}
+}
+
+// publishDueURLs publish the URLs of the frontier whose refresh delay is elapsed.
+// The published URLs are leased for the refresh delay: they are published again if not crawled meanwhile
+func (state *State) publishDueURLs() error {
+	delay, err := state.configClient.GetRefreshDelay()
+	if err != nil {
+		return err
+	}
+
+	lease := leaseDuration(delay)
+	if lease <= 0 {
+		return nil
+	}
+
+	now := state.clock.Now()
+	keys, err := state.frontierCache.LeaseByScore(frontierSet, now.Unix(), now.Add(lease).Unix(), state.frontierBatchSize)
+	if err != nil {
+		return err
+	}
+
+	var scheduled, expired []string
+	for _, key := range keys {
+		b, err := state.frontierCache.GetBytes(key)
+		if err != nil {
+			return err
+		}
+
+		// The entry has expired (the URL was not crawled again for too long): forget the URL,
+		// rather than publishing it without its depth and seed
+		if len(b) == 0 {
+			expired = append(expired, key)
+			continue
+		}
+
+		var entry frontierEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return fmt.Errorf("error while reading frontier entry: %s", err)
+		}
+
+		if err := state.frontierPub.PublishEvent(&event.NewURLEvent{URL: entry.URL, Depth: entry.Depth, Seed: entry.Seed, PublicKey: entry.PublicKey}); err != nil {
+			return fmt.Errorf("error while publishing URL: %s", err)
+		}
+
+		recrawledURLs.Inc()
+		scheduled = append(scheduled, key)
+	}
+
+	if len(expired) > 0 {
+		if err := state.frontierCache.RemoveScores(frontierSet, expired); err != nil {
+			return err
+		}
+		log.Debug().Int("count", len(expired)).Msg("Removed expired URLs from the frontier")
+	}
+
+	if len(scheduled) > 0 {
+		log.Debug().Int("count", len(scheduled)).Msg("Published due URLs")
+
+		// Prevent the URLs to be scheduled again when found meanwhile
+		return state.urlDeduper.Mark(scheduled, lease)
+	}
+
+	return nil
+}
+
+// leaseDuration returns the delay before a published URL of the frontier is published again if not crawled
+func leaseDuration(delay configapi.RefreshDelay) time.Duration {
+	if delay.Adaptive() {
+		return delay.Bound(delay.Delay)
+	}
+
+	return delay.Delay
+}
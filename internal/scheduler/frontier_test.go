@@ -0,0 +1,124 @@
+package scheduler
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/clock_mock"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"github.com/golang/mock/gomock"
+	"testing"
+	"time"
+)
+
+func TestFrontier(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	clockMock := clock_mock.NewMockClock(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	urlCache := cache.NewMemoryCache(t.Name(), "url")
+	s := State{
+		configClient:      configClientMock,
+		urlDeduper:        &cacheDeduper{cache: urlCache},
+		frontierCache:     cache.NewMemoryCache(t.Name(), "frontier"),
+		frontierPub:       pubMock,
+		frontierBatchSize: 10,
+		clock:             clockMock,
+	}
+
+	tn := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	delay := configapi.RefreshDelay{Delay: time.Hour}
+
+	// Crawled resources
+	clockMock.EXPECT().Now().Return(tn).Times(2)
+	if err := s.addToFrontier(&event.NewResourceEvent{URL: "https://example.onion", Depth: 2, Seed: "https://seed.onion"}, time.Hour); err != nil {
+		t.FailNow()
+	}
+	if err := s.addToFrontier(&event.NewResourceEvent{URL: "https://google.onion"}, 2*time.Hour); err != nil {
+		t.FailNow()
+	}
+
+	// Nothing is due yet
+	configClientMock.EXPECT().GetRefreshDelay().Return(delay, nil)
+	clockMock.EXPECT().Now().Return(tn.Add(time.Minute))
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+
+	// The first one is due
+	configClientMock.EXPECT().GetRefreshDelay().Return(delay, nil)
+	clockMock.EXPECT().Now().Return(tn.Add(time.Hour))
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://example.onion", Depth: 2, Seed: "https://seed.onion"}).Return(nil)
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+
+	// Leased: it is not published again until crawled or the lease expire
+	configClientMock.EXPECT().GetRefreshDelay().Return(delay, nil)
+	clockMock.EXPECT().Now().Return(tn.Add(time.Hour + time.Minute))
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+
+	key, _ := urlnorm.Hash("https://example.onion")
+	if count, _ := urlCache.GetInt64(key); count != 1 {
+		t.Errorf("published URL should be marked as scheduled")
+	}
+
+	// Both are due (the lease has expired)
+	configClientMock.EXPECT().GetRefreshDelay().Return(delay, nil)
+	clockMock.EXPECT().Now().Return(tn.Add(2 * time.Hour))
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://example.onion", Depth: 2, Seed: "https://seed.onion"}).Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://google.onion"}).Return(nil)
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+
+	// Not crawled again: the entries expire (removed here), and the URLs are removed from the frontier without being published
+	configClientMock.EXPECT().GetRefreshDelay().Return(delay, nil)
+	clockMock.EXPECT().Now().Return(tn.Add(5 * time.Hour))
+	if err := s.frontierCache.Remove(key); err != nil {
+		t.FailNow()
+	}
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: "https://google.onion"}).Return(nil)
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+
+	configClientMock.EXPECT().GetRefreshDelay().Return(delay, nil)
+	clockMock.EXPECT().Now().Return(tn.Add(10 * time.Hour))
+	googleKey, _ := urlnorm.Hash("https://google.onion")
+	if err := s.frontierCache.Remove(googleKey); err != nil {
+		t.FailNow()
+	}
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+	if keys, _ := s.frontierCache.LeaseByScore(frontierSet, tn.Add(100*time.Hour).Unix(), 0, 10); len(keys) != 0 {
+		t.Errorf("expired URLs should have been removed from the frontier: %v", keys)
+	}
+}
+
+func TestFrontier_NoRefresh(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	s := State{configClient: configClientMock, frontierCache: cache.NewMemoryCache(t.Name(), "frontier")}
+
+	// The resources are never crawled again
+	if err := s.addToFrontier(&event.NewResourceEvent{URL: "https://example.onion"}, 0); err != nil {
+		t.FailNow()
+	}
+
+	configClientMock.EXPECT().GetRefreshDelay().Return(configapi.RefreshDelay{}, nil)
+	if err := s.publishDueURLs(); err != nil {
+		t.FailNow()
+	}
+}
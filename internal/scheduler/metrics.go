@@ -0,0 +1,54 @@
+package scheduler
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	scheduledURLs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "scheduler",
+		Name:      "scheduled_urls_total",
+		Help:      "The number of URLs scheduled for crawling",
+	})
+	skippedURLs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "scheduler",
+		Name:      "skipped_urls_total",
+		Help:      "The number of URLs not scheduled for crawling, per reason",
+	}, []string{"reason"})
+	recrawledURLs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "scheduler",
+		Name:      "recrawled_urls_total",
+		Help:      "The number of known URLs published again once due",
+	})
+	recrawlIntervals = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "scheduler",
+		Name:      "recrawl_interval_seconds",
+		Help:      "The adapted delay before the crawled resources may be crawled again",
+		Buckets:   prometheus.ExponentialBuckets(60, 4, 10),
+	})
+	dedupeFilterItems = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "scheduler",
+		Name:      "dedupe_filter_items",
+		Help:      "The number of scheduled URLs held by the Bloom filter dedupe",
+	})
+	dedupeFilterFillRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "scheduler",
+		Name:      "dedupe_filter_fill_ratio",
+		Help:      "The ratio of bits set of the current generation of the Bloom filter dedupe",
+	})
+)
+
+// schedulingErrors are the reasons for an URL to not be scheduled
+var schedulingErrors = append([]error{
+	errAlreadyScheduled,
+	errBudgetExceeded,
+}, constraint.URLErrors...)
@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"fmt"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"github.com/rs/zerolog/log"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// recrawlEntry is the recrawl state of an URL, indexed by URL hash
+type recrawlEntry struct {
+	// ContentHash is the hash of the URL content at the last crawl
+	ContentHash string `json:"content-hash"`
+	// Interval is the delay before the URL may be crawled again
+	Interval time.Duration `json:"interval"`
+}
+
+// adaptRefreshDelay returns the revisit interval of the crawled resource: shortened if its content
+// has changed since the previous crawl, lengthened otherwise. The resource may be scheduled again
+// once the interval is elapsed. The refresh delay is returned as is if not adaptive
+func (state *State) adaptRefreshDelay(evt *event.NewResourceEvent, delay configapi.RefreshDelay) (time.Duration, error) {
+	if !delay.Adaptive() {
+		return delay.Delay, nil
+	}
+
+	key, err := urlnorm.Hash(evt.URL)
+	if err != nil {
+		return 0, err
+	}
+
+	c := fnv.New64()
+	if _, err := c.Write([]byte(evt.Body)); err != nil {
+		return 0, fmt.Errorf("error while computing content hash: %s", err)
+	}
+	contentHash := strconv.FormatUint(c.Sum64(), 10)
+
+	entry := recrawlEntry{ContentHash: contentHash, Interval: delay.Bound(delay.Delay)}
+
+	b, err := state.recrawlCache.GetBytes(key)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > 0 {
+		var previous recrawlEntry
+		if err := json.Unmarshal(b, &previous); err != nil {
+			return 0, fmt.Errorf("error while reading recrawl entry: %s", err)
+		}
+
+		if previous.ContentHash != contentHash {
+			entry.Interval = delay.Bound(previous.Interval / 2)
+		} else {
+			entry.Interval = delay.Bound(previous.Interval * 2)
+		}
+	}
+
+	log.Debug().
+		Str("url", evt.URL).
+		Stringer("interval", entry.Interval).
+		Msg("Adapted refresh delay")
+	recrawlIntervals.Observe(entry.Interval.Seconds())
+
+	if b, err = json.Marshal(entry); err != nil {
+		return 0, err
+	}
+
+	// Keep the entry long enough to be compared with the next crawl
+	if err := state.recrawlCache.SetBytes(key, b, 2*delay.MaxDelay); err != nil {
+		return 0, err
+	}
+
+	// The resource may be scheduled again once the interval is elapsed
+	if err := state.urlDeduper.Mark([]string{key}, entry.Interval); err != nil {
+		return 0, err
+	}
+
+	return entry.Interval, nil
+}
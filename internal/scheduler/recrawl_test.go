@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"testing"
+	"time"
+)
+
+func TestAdaptRefreshDelay(t *testing.T) {
+	urlCache := cache.NewMemoryCache(t.Name(), "url")
+	s := State{
+		urlDeduper:   &cacheDeduper{cache: urlCache},
+		recrawlCache: cache.NewMemoryCache(t.Name(), "recrawl"),
+	}
+	delay := configapi.RefreshDelay{Delay: 4 * time.Hour, MinDelay: time.Hour, MaxDelay: 16 * time.Hour}
+
+	tests := []struct {
+		body string
+		want time.Duration
+	}{
+		// First crawl: default delay
+		{body: "price: 10$", want: 4 * time.Hour},
+		// Unchanged: lengthened
+		{body: "price: 10$", want: 8 * time.Hour},
+		{body: "price: 10$", want: 16 * time.Hour},
+		{body: "price: 10$", want: 16 * time.Hour},
+		// Changed: shortened
+		{body: "price: 12$", want: 8 * time.Hour},
+		{body: "price: 14$", want: 4 * time.Hour},
+		{body: "price: 16$", want: 2 * time.Hour},
+		{body: "price: 18$", want: time.Hour},
+		{body: "price: 20$", want: time.Hour},
+	}
+
+	key, _ := urlnorm.Hash("https://example.onion")
+	for i, test := range tests {
+		evt := event.NewResourceEvent{URL: "https://example.onion", Body: test.body}
+		interval, err := s.adaptRefreshDelay(&evt, delay)
+		if err != nil {
+			t.Fatalf("error while adapting refresh delay: %s", err)
+		}
+		if interval != test.want {
+			t.Errorf("wrong returned interval at crawl %d: (got: %s, want: %s)", i, interval, test.want)
+		}
+
+		b, err := s.recrawlCache.GetBytes(key)
+		if err != nil {
+			t.FailNow()
+		}
+		var entry recrawlEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			t.FailNow()
+		}
+
+		if entry.Interval != test.want {
+			t.Errorf("wrong interval at crawl %d: (got: %s, want: %s)", i, entry.Interval, test.want)
+		}
+	}
+
+	// The URL is not scheduled again before the interval
+	if count, err := urlCache.GetInt64(key); err != nil || count != 1 {
+		t.Errorf("URL should be marked as scheduled: %d %v", count, err)
+	}
+}
+
+func TestAdaptRefreshDelay_NotAdaptive(t *testing.T) {
+	// No cache access expected
+	s := State{}
+
+	evt := event.NewResourceEvent{URL: "https://example.onion", Body: "price: 10$"}
+	if interval, err := s.adaptRefreshDelay(&evt, configapi.RefreshDelay{Delay: time.Hour}); err != nil || interval != time.Hour {
+		t.Errorf("the refresh delay should be returned as is: %s %v", interval, err)
+	}
+}
@@ -1,36 +1,67 @@
 package scheduler
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
-	"github.com/PuerkitoBio/purell"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	"github.com/darkspot-org/bathyscaphe/internal/clock"
 	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v2"
-	"hash/fnv"
-	"mvdan.cc/xurls/v2"
 	"net/http"
 	"net/url"
-	"strconv"
-	"strings"
+	"time"
 )
 
+// defaultBudgetPeriod is the period of the hostname page budget if not configured
+const defaultBudgetPeriod = 24 * time.Hour
+
 var (
-	errNotOnionHostname    = errors.New("hostname is not .onion")
-	errProtocolNotAllowed  = errors.New("protocol is not allowed")
-	errExtensionNotAllowed = errors.New("extension is not allowed")
-	errHostnameNotAllowed  = errors.New("hostname is not allowed")
-	errAlreadyScheduled    = errors.New("URL is already scheduled")
+	errAlreadyScheduled = errors.New("URL is already scheduled")
+	errBudgetExceeded   = errors.New("hostname page budget is exceeded")
 )
 
 // State represent the application state
 type State struct {
-	configClient configapi.Client
-	urlCache     cache.Cache
+	configClient  configapi.Client
+	urlDeduper    urlDeduper
+	hostnameCache cache.Cache
+	recrawlCache  cache.Cache
+
+	// frontierCache hold the known URLs to crawl again, nil if the frontier is disabled
+	frontierCache     cache.Cache
+	frontierPub       event.Publisher
+	frontierBatchSize int
+	frontierStop      chan struct{}
+	frontierDone      chan struct{}
+	clock             clock.Clock
+}
+
+// schedulingBatch hold the state of the scheduling of the URLs found in a resource
+type schedulingBatch struct {
+	// depth of the URLs to schedule
+	depth int
+	// seed from where the crawling has started
+	seed string
+	// claimed are the URLs not scheduled yet, claimed by this batch, indexed by URL hash
+	claimed map[string]bool
+	// hostnameBudget is the maximum number of pages per hostname and budget period, zero means unlimited
+	hostnameBudget int64
+	// budgetPeriod is the period after which the hostname page budget is reset
+	budgetPeriod time.Duration
+}
+
+// candidateURL is an URL eligible for crawling
+type candidateURL struct {
+	url       string
+	hash      string
+	hostname  string
+	publicKey ed25519.PublicKey
 }
 
 // Name return the process name
@@ -42,9 +73,18 @@ func (state *State) Name() string {
 func (state *State) Description() string {
 	return `
 The scheduling component. It extracts URLs from crawled resources
-and apply a predicate to determinate if the URL is eligible
+(the links of HTML documents, relative ones being resolved, and the
+onion addresses written without scheme) and apply a predicate to determinate if the URL is eligible
 for crawling. If it is, it will publish a event and update the
 scheduling cache.
+The crawling is bounded by a maximum depth (distance from the seed)
+and a per hostname page budget.
+The delay before a resource is crawled again can be adapted to how
+often its content changes, within the configured bounds.
+The scheduled URLs are remembered either in the cache, or in a
+memory-efficient Bloom filter (probabilistic, per instance).
+In frontier mode, the crawled resources are kept and published again
+once their refresh delay is elapsed, even if no page links to them anymore.
 
 This component consumes the 'resource.new' event and produces
 the 'url.new' event.`
@@ -57,23 +97,97 @@ func (state *State) Features() []process.Feature {
 
 // CustomFlags return process custom flags
 func (state *State) CustomFlags() []cli.Flag {
-	return []cli.Flag{}
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  frontierFlag,
+			Usage: "Publish the known URLs again once their refresh delay is elapsed",
+		},
+		&cli.DurationFlag{
+			Name:  frontierIntervalFlag,
+			Usage: "Interval between two lookups of the due URLs of the frontier",
+			Value: time.Minute,
+		},
+		&cli.IntFlag{
+			Name:  frontierBatchSizeFlag,
+			Usage: "Maximum number of due URLs published per lookup",
+			Value: 1000,
+		},
+		&cli.StringFlag{
+			Name:  dedupeFlag,
+			Usage: "How the scheduled URLs are remembered: cache (exact, shared between replicas) or bloom (in-process Bloom filter)",
+			Value: cacheDedupe,
+		},
+		&cli.IntFlag{
+			Name:  bloomCapacityFlag,
+			Usage: "Number of URLs per Bloom filter generation before it grows",
+			Value: 1000000,
+		},
+		&cli.Float64Flag{
+			Name:  bloomFPRateFlag,
+			Usage: "False positive rate of the Bloom filter (URLs wrongly considered as scheduled)",
+			Value: 0.001,
+		},
+		&cli.IntFlag{
+			Name:  bloomGenerationsFlag,
+			Usage: "Number of Bloom filter generations, rotated to forget the URLs after the refresh delay",
+			Value: 4,
+		},
+	}
 }
 
 // Initialize the process
 func (state *State) Initialize(provider process.Provider) error {
-	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RefreshDelayKey}
+	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RefreshDelayKey, configapi.CrawlLimitsKey}
 	configClient, err := provider.ConfigClient(keys)
 	if err != nil {
 		return err
 	}
 	state.configClient = configClient
 
-	urlCache, err := provider.Cache("url")
+	deduper, err := newURLDeduper(provider)
+	if err != nil {
+		return err
+	}
+	state.urlDeduper = deduper
+
+	hostnameCache, err := provider.Cache("hostname")
+	if err != nil {
+		return err
+	}
+	state.hostnameCache = hostnameCache
+
+	recrawlCache, err := provider.Cache("recrawl")
+	if err != nil {
+		return err
+	}
+	state.recrawlCache = recrawlCache
+
+	if !provider.GetBoolValue(frontierFlag) {
+		return nil
+	}
+
+	frontierCache, err := provider.Cache("frontier")
+	if err != nil {
+		return err
+	}
+	state.frontierCache = frontierCache
+	state.frontierBatchSize = provider.GetIntValue(frontierBatchSizeFlag)
+
+	pub, err := provider.Publisher()
 	if err != nil {
 		return err
 	}
-	state.urlCache = urlCache
+	state.frontierPub = pub
+
+	cl, err := provider.Clock()
+	if err != nil {
+		return err
+	}
+	state.clock = cl
+
+	state.frontierStop = make(chan struct{})
+	state.frontierDone = make(chan struct{})
+	go state.runFrontier(provider.GetDurationValue(frontierIntervalFlag))
 
 	return nil
 }
@@ -81,7 +195,12 @@ func (state *State) Initialize(provider process.Provider) error {
 // Subscribers return the process subscribers
 func (state *State) Subscribers() []process.SubscriberDef {
 	return []process.SubscriberDef{
-		{Exchange: event.NewResourceExchange, Queue: "schedulingQueue", Handler: state.handleNewResourceEvent},
+		{
+			Exchange:    event.NewResourceExchange,
+			Queue:       "schedulingQueue",
+			Handler:     state.handleNewResourceEvent,
+			RetryPolicy: &event.RetryPolicy{MaxAttempts: 3, Backoff: 5 * time.Second},
+		},
 	}
 }
 
@@ -90,6 +209,16 @@ func (state *State) HTTPHandler() http.Handler {
 	return nil
 }
 
+// Shutdown stop publishing the due URLs, the dependencies are released by the provider
+func (state *State) Shutdown() error {
+	if state.frontierStop != nil {
+		close(state.frontierStop)
+		<-state.frontierDone
+	}
+
+	return nil
+}
+
 func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg event.RawMessage) error {
 	var evt event.NewResourceEvent
 	if err := subscriber.Read(&msg, &evt); err != nil {
@@ -98,152 +227,159 @@ func (state *State) handleNewResourceEvent(subscriber event.Subscriber, msg even
 
 	log.Trace().Str("url", evt.URL).Msg("Processing new resource")
 
-	urls, err := extractURLS(&evt)
+	delay, err := state.configClient.GetRefreshDelay()
 	if err != nil {
-		return fmt.Errorf("error while extracting URLs")
+		return err
 	}
 
-	// We are working using URL hash to reduce memory consumption.
-	// See: https://github.com/darkspot-org/bathyscaphe/issues/130
-	var urlHashes []string
-	for _, u := range urls {
-		c := fnv.New64()
-		if _, err := c.Write([]byte(u)); err != nil {
-			return fmt.Errorf("error while computing url hash: %s", err)
-		}
+	interval, err := state.adaptRefreshDelay(&evt, delay)
+	if err != nil {
+		return err
+	}
 
-		urlHashes = append(urlHashes, strconv.FormatUint(c.Sum64(), 10))
+	if err := state.addToFrontier(&evt, interval); err != nil {
+		return err
 	}
 
-	// Load values in batch
-	urlCache, err := state.urlCache.GetManyInt64(urlHashes)
+	limits, err := state.configClient.GetCrawlLimits()
 	if err != nil {
 		return err
 	}
 
+	// Make sure we are not going too deep
+	if limits.MaxDepth > 0 && int64(evt.Depth) >= limits.MaxDepth {
+		log.Debug().Str("url", evt.URL).Int("depth", evt.Depth).Msg("Maximum depth reached")
+		return nil
+	}
+
+	urls, err := extractURLS(&evt)
+	if err != nil {
+		return fmt.Errorf("error while extracting URLs")
+	}
+
+	// Validate the URLs first, to only claim the eligible ones
+	var candidates []candidateURL
+	var hashes []string
 	for _, u := range urls {
-		if err := state.processURL(u, subscriber, urlCache); err != nil {
+		candidate, err := state.checkURL(u)
+		if err != nil {
+			skippedURLs.WithLabelValues(process.ErrorKind(err, schedulingErrors)).Inc()
 			log.Err(err).Msg("error while processing URL")
+			continue
 		}
+
+		candidates = append(candidates, *candidate)
+		hashes = append(hashes, candidate.hash)
 	}
 
-	// Update URL cache
-	delay, err := state.configClient.GetRefreshDelay()
-	if err != nil {
-		return err
+	if len(candidates) == 0 {
+		return nil
 	}
 
-	// Update values in batch
-	if err := state.urlCache.SetManyInt64(urlCache, delay.Delay); err != nil {
+	claimed, err := state.urlDeduper.Claim(hashes, claimDuration(delay))
+	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (state *State) processURL(rawURL string, pub event.Publisher, urlCache map[string]int64) error {
-	u, err := url.Parse(rawURL)
-	if err != nil {
-		return fmt.Errorf("error while parsing URL: %s", err)
+	// The resource is the seed if the crawling has not been started by a seed
+	seed := evt.Seed
+	if seed == "" {
+		seed = evt.URL
 	}
 
-	// Make sure URL is valid .onion
-	if !strings.HasSuffix(u.Hostname(), ".onion") {
-		return fmt.Errorf("%s %w", u.Host, errNotOnionHostname)
+	// The budget period should not be unlimited, the hostnames exceeding their budget would never be crawled again
+	budgetPeriod := limits.BudgetPeriod
+	if budgetPeriod <= 0 {
+		budgetPeriod = defaultBudgetPeriod
 	}
 
-	// Make sure protocol is not forbidden
-	if !strings.HasPrefix(u.Scheme, "http") {
-		return fmt.Errorf("%s %w", u, errProtocolNotAllowed)
+	batch := schedulingBatch{
+		depth:          evt.Depth + 1,
+		seed:           seed,
+		claimed:        claimed,
+		hostnameBudget: limits.HostnameBudget,
+		budgetPeriod:   budgetPeriod,
 	}
 
-	// Make sure extension is allowed
-	allowed := false
-	if mimeTypes, err := state.configClient.GetAllowedMimeTypes(); err == nil {
-		for _, mimeType := range mimeTypes {
-			for _, ext := range mimeType.Extensions {
-				if strings.HasSuffix(strings.ToLower(u.Path), "."+ext) {
-					allowed = true
-				}
-			}
+	for _, candidate := range candidates {
+		if err := state.processURL(&candidate, subscriber, &batch); err != nil {
+			skippedURLs.WithLabelValues(process.ErrorKind(err, schedulingErrors)).Inc()
+			log.Err(err).Msg("error while processing URL")
+		} else {
+			scheduledURLs.Inc()
 		}
 	}
 
-	// Handle case no extension present
-	if !allowed {
-		components := strings.Split(u.Path, "/")
-
-		lastIdx := 0
-		if size := len(components); size > 0 {
-			lastIdx = size - 1
-		}
+	return nil
+}
 
-		// generally no extension means text/* content-type
-		if !strings.Contains(components[lastIdx], ".") {
-			allowed = true
-		}
+// checkURL returns the candidate for scheduling of given URL if eligible for crawling
+func (state *State) checkURL(rawURL string) (*candidateURL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing URL: %s", err)
 	}
 
-	if !allowed {
-		return fmt.Errorf("%s %w", u, errExtensionNotAllowed)
+	addr, err := constraint.CheckURLAllowed(state.configClient, rawURL)
+	if err != nil {
+		if errors.Is(err, constraint.ErrHostnameNotAllowed) {
+			log.Debug().Str("url", rawURL).Msg("Skipping forbidden hostname")
+		}
+		return nil, err
 	}
 
-	// Make sure hostname is not forbidden
-	if allowed, err := constraint.CheckHostnameAllowed(state.configClient, rawURL); err != nil {
-		return err
-	} else if !allowed {
-		log.Debug().Str("url", rawURL).Msg("Skipping forbidden hostname")
-		return fmt.Errorf("%s %w", u, errHostnameNotAllowed)
+	hash, err := urlnorm.Hash(rawURL)
+	if err != nil {
+		return nil, err
 	}
 
-	// Compute url hash
-	c := fnv.New64()
-	if _, err := c.Write([]byte(rawURL)); err != nil {
-		return fmt.Errorf("error while computing url hash: %s", err)
-	}
-	urlHash := strconv.FormatUint(c.Sum64(), 10)
+	return &candidateURL{url: rawURL, hash: hash, hostname: u.Hostname(), publicKey: addr.PublicKey}, nil
+}
 
+// processURL schedule given candidate if claimed by the batch and within its hostname page budget
+func (state *State) processURL(candidate *candidateURL, pub event.Publisher, batch *schedulingBatch) error {
 	// Check if URL should be scheduled
-	if urlCache[urlHash] > 0 {
-		return fmt.Errorf("%s %w", u, errAlreadyScheduled)
+	if !batch.claimed[candidate.hash] {
+		return fmt.Errorf("%s %w", candidate.url, errAlreadyScheduled)
 	}
 
-	log.Debug().Stringer("url", u).Msg("URL should be scheduled")
+	// Make sure the hostname page budget is not exceeded
+	if batch.hostnameBudget > 0 {
+		count, err := state.hostnameCache.Incr(candidate.hostname, batch.budgetPeriod)
+		if err != nil {
+			return err
+		}
 
-	urlCache[urlHash]++
+		if count > batch.hostnameBudget {
+			// Release the URL so that it may be scheduled once the budget period is elapsed
+			if err := state.urlDeduper.Release(candidate.hash); err != nil {
+				return err
+			}
 
-	if err := pub.PublishEvent(&event.NewURLEvent{URL: rawURL}); err != nil {
-		return fmt.Errorf("error while publishing URL: %s", err)
+			return fmt.Errorf("%s %w", candidate.hostname, errBudgetExceeded)
+		}
 	}
 
-	return nil
-}
-
-func extractURLS(msg *event.NewResourceEvent) ([]string, error) {
-	// Extract & normalize URLs
-	xu := xurls.Strict()
-	urls := xu.FindAllString(msg.Body, -1)
-
-	var normalizedURLS []string
+	log.Debug().Str("url", candidate.url).Msg("URL should be scheduled")
 
-	for _, u := range urls {
-		normalizedURL, err := normalizeURL(u)
-		if err != nil {
-			continue
+	if err := pub.PublishEvent(&event.NewURLEvent{URL: candidate.url, Depth: batch.depth, Seed: batch.seed, PublicKey: candidate.publicKey}); err != nil {
+		// Release the URL so that it may be scheduled when found again
+		if err := state.urlDeduper.Release(candidate.hash); err != nil {
+			log.Err(err).Str("url", candidate.url).Msg("error while releasing URL")
 		}
 
-		normalizedURLS = append(normalizedURLS, normalizedURL)
+		return fmt.Errorf("error while publishing URL: %s", err)
 	}
 
-	return normalizedURLS, nil
+	return nil
 }
 
-func normalizeURL(u string) (string, error) {
-	normalizedURL, err := purell.NormalizeURLString(u, purell.FlagsUsuallySafeGreedy|
-		purell.FlagRemoveDirectoryIndex|purell.FlagRemoveFragment|purell.FlagRemoveDuplicateSlashes)
-	if err != nil {
-		return "", fmt.Errorf("error while normalizing URL %s: %s", u, err)
+// claimDuration returns the delay before a found URL may be scheduled again. The URLs are claimed for the
+// shortest adapted delay, since their own interval is only known once crawled (it is then marked for it)
+func claimDuration(delay configapi.RefreshDelay) time.Duration {
+	if delay.Adaptive() {
+		return delay.MinDelay
 	}
 
-	return normalizedURL, nil
+	return delay.Delay
 }
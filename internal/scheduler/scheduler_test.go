@@ -1,20 +1,25 @@
 package scheduler
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"github.com/darkspot-org/bathyscaphe/internal/cache"
 	"github.com/darkspot-org/bathyscaphe/internal/cache_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client"
 	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
 	"github.com/darkspot-org/bathyscaphe/internal/event"
 	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/onion"
 	"github.com/darkspot-org/bathyscaphe/internal/process"
 	"github.com/darkspot-org/bathyscaphe/internal/process_mock"
 	"github.com/darkspot-org/bathyscaphe/internal/test"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
 	"github.com/golang/mock/gomock"
-	"hash/fnv"
-	"strconv"
+	"net/url"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestState_Name(t *testing.T) {
@@ -31,13 +36,18 @@ func TestState_Features(t *testing.T) {
 
 func TestState_CustomFlags(t *testing.T) {
 	s := State{}
-	test.CheckProcessCustomFlags(t, &s, nil)
+	test.CheckProcessCustomFlags(t, &s, []string{"frontier", "frontier-interval", "frontier-batch-size",
+		"dedupe", "bloom-capacity", "bloom-fp-rate", "bloom-generations"})
 }
 
 func TestState_Initialize(t *testing.T) {
 	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
+		p.GetStrValue("dedupe").Return("cache")
 		p.Cache("url")
-		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey, client.RefreshDelayKey})
+		p.Cache("hostname")
+		p.Cache("recrawl")
+		p.GetBoolValue("frontier").Return(false)
+		p.ConfigClient([]string{client.AllowedMimeTypesKey, client.ForbiddenHostnamesKey, client.RefreshDelayKey, client.CrawlLimitsKey})
 	})
 }
 
@@ -48,18 +58,16 @@ func TestState_Subscribers(t *testing.T) {
 	})
 }
 
-func TestNormalizeURL(t *testing.T) {
-	url, err := normalizeURL("https://this-is-sparta.de?url=url-query-param#fragment-23")
-	if err != nil {
-		t.FailNow()
-	}
-
-	if url != "https://this-is-sparta.de?url=url-query-param" {
-		t.Fail()
-	}
-}
+// Valid v3 onion addresses
+const (
+	exampleOnion  = "nn44k7tkbfjdskbmasay5fqrf47qhjaadouxuvsmeocsupy6ux6fdgid.onion"
+	googleOnion   = "3ln5dbfc2utpd265lqdp3lmtlgzcq5m3jv7xtvtgrh5cksvnqvddmpid.onion"
+	facebookOnion = "facebookwkhpilnemxj7asaniu7vnjjbiltxjqhye3mhbshg7kx5tfyd.onion"
+	forumOnion    = "tprsq54vsb4asqd6crbz74my2w74pxhg7g6hipftnekg6yiljaa7haid.onion"
+	fbiOnion      = "6s6umuq4462xrgnon5gkbhw55rujgj5inirdfvfd6ksphgwgrkpgnnyd.onion"
+)
 
-func TestProcessURL_NotDotOnion(t *testing.T) {
+func TestCheckURL_NotDotOnion(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
@@ -67,45 +75,60 @@ func TestProcessURL_NotDotOnion(t *testing.T) {
 
 	for _, url := range urls {
 		state := State{}
-		if err := state.processURL(url, nil, nil); !errors.Is(err, errNotOnionHostname) {
+		if _, err := state.checkURL(url); !errors.Is(err, constraint.ErrNotOnionHostname) {
 			t.Fail()
 		}
 	}
 }
 
-func TestProcessURL_ProtocolForbidden(t *testing.T) {
+func TestCheckURL_InvalidOnion(t *testing.T) {
+	tests := map[string]error{
+		"https://example.onion":          onion.ErrInvalidAddress,
+		"https://" + exampleOnion[1:]:    onion.ErrInvalidAddress,
+		"https://facebookcorewwwi.onion": onion.ErrDeprecatedVersion,
+	}
+
+	for url, want := range tests {
+		state := State{}
+		if _, err := state.checkURL(url); !errors.Is(err, want) {
+			t.Errorf("%s: got %v want %v", url, err, want)
+		}
+	}
+}
+
+func TestCheckURL_ProtocolForbidden(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
-	urls := []string{"ftp://example.onion", "irc://example.onion"}
+	urls := []string{"ftp://" + exampleOnion, "irc://" + exampleOnion}
 
 	for _, url := range urls {
 		state := State{}
-		if err := state.processURL(url, nil, nil); !errors.Is(err, errProtocolNotAllowed) {
+		if _, err := state.checkURL(url); !errors.Is(err, constraint.ErrProtocolNotAllowed) {
 			t.Fail()
 		}
 	}
 }
 
-func TestProcessURL_ExtensionForbidden(t *testing.T) {
+func TestCheckURL_ExtensionForbidden(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	configClientMock := client_mock.NewMockClient(mockCtrl)
 
-	urls := []string{"https://example.onion/image.PNG?id=12&test=2", "https://example.onion/favicon.ico"}
+	urls := []string{"https://" + exampleOnion + "/image.PNG?id=12&test=2", "https://" + exampleOnion + "/favicon.ico"}
 
 	for _, url := range urls {
 		configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
 
 		state := State{configClient: configClientMock}
-		if err := state.processURL(url, nil, nil); !errors.Is(err, errExtensionNotAllowed) {
+		if _, err := state.checkURL(url); !errors.Is(err, constraint.ErrExtensionNotAllowed) {
 			t.Fail()
 		}
 	}
 }
 
-func TestProcessURL_HostnameForbidden(t *testing.T) {
+func TestCheckURL_HostnameForbidden(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
@@ -118,20 +141,20 @@ func TestProcessURL_HostnameForbidden(t *testing.T) {
 
 	tests := []testDef{
 		{
-			url:                "https://facebookcorewwwi.onion/login.html?id=12&test=2",
-			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}},
+			url:                "https://" + facebookOnion + "/login.html?id=12&test=2",
+			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: facebookOnion}},
 		},
 		{
-			url:                "https://google.onion:9099",
-			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: "google.onion"}},
+			url:                "https://" + googleOnion + ":9099",
+			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: googleOnion}},
 		},
 		{
-			url:                "http://facebook.onion:443/news/test.php?id=12&username=test",
-			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: "facebook.onion"}},
+			url:                "http://" + facebookOnion + ":443/news/test.php?id=12&username=test",
+			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: facebookOnion}},
 		},
 		{
-			url:                "https://www.facebookcorewwwi.onion/recover/initiate?ars=facebook_login",
-			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: "facebookcorewwwi.onion"}},
+			url:                "https://www." + facebookOnion + "/recover/initiate?ars=facebook_login",
+			forbiddenHostnames: []client.ForbiddenHostname{{Hostname: facebookOnion}},
 		},
 	}
 
@@ -140,13 +163,13 @@ func TestProcessURL_HostnameForbidden(t *testing.T) {
 		configClientMock.EXPECT().GetForbiddenHostnames().Return(tst.forbiddenHostnames, nil)
 
 		state := State{configClient: configClientMock}
-		if err := state.processURL(tst.url, nil, nil); !errors.Is(err, errHostnameNotAllowed) {
+		if _, err := state.checkURL(tst.url); !errors.Is(err, constraint.ErrHostnameNotAllowed) {
 			t.Fail()
 		}
 	}
 }
 
-func TestProcessURL_AlreadyScheduled(t *testing.T) {
+func TestCheckURL(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
@@ -155,9 +178,26 @@ func TestProcessURL_AlreadyScheduled(t *testing.T) {
 	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
 	configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
 
-	urlCache := map[string]int64{"3056224523184958": 1}
+	url := "https://www." + facebookOnion + "/test.php?id=12"
+	hash, _ := urlnorm.Hash(url)
+
 	state := State{configClient: configClientMock}
-	if err := state.processURL("https://facebookcorewwi.onion/test.php?id=12", nil, urlCache); !errors.Is(err, errAlreadyScheduled) {
+	candidate, err := state.checkURL(url)
+	if err != nil {
+		t.FailNow()
+	}
+
+	want := candidateURL{url: url, hash: hash, hostname: "www." + facebookOnion, publicKey: publicKey(t, url)}
+	if !reflect.DeepEqual(*candidate, want) {
+		t.Errorf("wrong candidate: (got: %v, want: %v)", *candidate, want)
+	}
+}
+
+func TestProcessURL_AlreadyScheduled(t *testing.T) {
+	candidate := candidateURL{url: "https://" + facebookOnion + "/test.php?id=12", hash: "3056224523184958"}
+
+	state := State{}
+	if err := state.processURL(&candidate, nil, &schedulingBatch{claimed: map[string]bool{"3056224523184958": false}}); !errors.Is(err, errAlreadyScheduled) {
 		t.Fail()
 	}
 }
@@ -166,35 +206,93 @@ func TestProcessURL(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
-	configClientMock := client_mock.NewMockClient(mockCtrl)
 	pubMock := event_mock.NewMockPublisher(mockCtrl)
 
-	urls := []string{"https://example.onion/index.php", "http://google.onion/admin.secret/login.html",
-		"https://example.onion", "https://www.facebookcorewwwi.onion/recover.now/initiate?ars=facebook_login"}
-
-	// pre fill cache
-	urlCache := map[string]int64{}
-	for _, url := range urls {
-		configClientMock.EXPECT().GetAllowedMimeTypes().Return([]client.MimeType{{Extensions: []string{"html", "php"}}}, nil)
-		configClientMock.EXPECT().GetForbiddenHostnames().Return([]client.ForbiddenHostname{}, nil)
-
-		pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: url}).Return(nil)
+	candidates := []candidateURL{
+		{url: "https://" + exampleOnion + "/index.php", hash: "1", hostname: exampleOnion},
+		{url: "http://" + googleOnion + "/admin.secret/login.html", hash: "2", hostname: googleOnion},
+		{url: "https://" + exampleOnion, hash: "3", hostname: exampleOnion},
+	}
 
-		state := State{configClient: configClientMock}
-		if err := state.processURL(url, pubMock, urlCache); err != nil {
-			t.Fail()
-		}
+	state := State{hostnameCache: cache.NewMemoryCache(t.Name(), "hostname")}
+	batch := schedulingBatch{
+		depth:          2,
+		seed:           "https://seed.onion",
+		claimed:        map[string]bool{"1": true, "2": true, "3": true},
+		hostnameBudget: 10,
+	}
+	for _, candidate := range candidates {
+		pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: candidate.url, Depth: 2, Seed: "https://seed.onion"}).Return(nil)
 
-		// Compute url hash
-		c := fnv.New64()
-		if _, err := c.Write([]byte(url)); err != nil {
+		if err := state.processURL(&candidate, pubMock, &batch); err != nil {
 			t.Error(err)
 		}
-		urlHash := strconv.FormatUint(c.Sum64(), 10)
+	}
 
-		if val, exist := urlCache[urlHash]; !exist || val != 1 {
-			t.Fail()
-		}
+	if count, _ := state.hostnameCache.GetInt64(exampleOnion); count != 2 {
+		t.Errorf("wrong hostname count: %d", count)
+	}
+	if count, _ := state.hostnameCache.GetInt64(googleOnion); count != 1 {
+		t.Errorf("wrong hostname count: %d", count)
+	}
+}
+
+func TestProcessURL_BudgetExceeded(t *testing.T) {
+	urlCache := cache.NewMemoryCache(t.Name(), "url")
+	hostnameCache := cache.NewMemoryCache(t.Name(), "hostname")
+
+	_ = urlCache.SetInt64("12", 1, cache.NoTTL)
+	_ = hostnameCache.SetInt64(forumOnion, 100, cache.NoTTL)
+
+	candidate := candidateURL{url: "https://" + forumOnion + "/thread.php?id=12", hash: "12", hostname: forumOnion}
+	batch := schedulingBatch{
+		claimed:        map[string]bool{"12": true},
+		hostnameBudget: 100,
+	}
+	state := State{urlDeduper: &cacheDeduper{cache: urlCache}, hostnameCache: hostnameCache}
+	if err := state.processURL(&candidate, nil, &batch); !errors.Is(err, errBudgetExceeded) {
+		t.Fail()
+	}
+
+	// The URL is released
+	if val, _ := urlCache.GetInt64("12"); val != 0 {
+		t.Errorf("URL should have been released")
+	}
+}
+
+func TestProcessURL_PublishFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	urlCache := cache.NewMemoryCache(t.Name(), "url")
+	_ = urlCache.SetInt64("12", 1, cache.NoTTL)
+
+	candidate := candidateURL{url: "https://" + forumOnion + "/thread.php?id=12", hash: "12", hostname: forumOnion}
+	batch := schedulingBatch{claimed: map[string]bool{"12": true}}
+
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: candidate.url}).Return(errors.New("event server unavailable"))
+
+	state := State{urlDeduper: &cacheDeduper{cache: urlCache}}
+	if err := state.processURL(&candidate, pubMock, &batch); err == nil {
+		t.Error("publishing error should be returned")
+	}
+
+	// The URL is released, to be scheduled when found again
+	if val, _ := urlCache.GetInt64("12"); val != 0 {
+		t.Errorf("URL should have been released")
+	}
+}
+
+func TestClaimDuration(t *testing.T) {
+	if d := claimDuration(client.RefreshDelay{Delay: time.Hour}); d != time.Hour {
+		t.Errorf("wrong claim duration: %s", d)
+	}
+
+	// The found URLs are claimed for the shortest adapted delay
+	if d := claimDuration(client.RefreshDelay{Delay: 4 * time.Hour, MinDelay: time.Hour, MaxDelay: 16 * time.Hour}); d != time.Hour {
+		t.Errorf("wrong claim duration: %s", d)
 	}
 }
 
@@ -204,26 +302,44 @@ func TestHandleNewResourceEvent(t *testing.T) {
 
 	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
 	urlCacheMock := cache_mock.NewMockCache(mockCtrl)
+	hostnameCacheMock := cache_mock.NewMockCache(mockCtrl)
 	configClientMock := client_mock.NewMockClient(mockCtrl)
 
 	msg := event.RawMessage{}
 	subscriberMock.EXPECT().
 		Read(&msg, &event.NewResourceEvent{}).
 		SetArg(1, event.NewResourceEvent{
-			URL: "https://l.facebookcorewwwi.onion/test.php",
+			URL:     "https://l." + facebookOnion + "/test.php",
+			Headers: map[string]string{"Content-Type": "text/plain"},
+			Depth:   1,
+			Seed:    "https://seed.onion",
 			Body: `
-<a href=\"https://facebook.onion/test.php?id=1\">This is a little test</a>. 
-Check out https://google.onion. This is an image https://example.onion/test.png
-This domain is blacklisted: https://m.fbi.onion/test.php
+<a href=\"https://` + facebookOnion + `/test.php?id=1\">This is a little test</a>. 
+Check out https://` + googleOnion + `. This is an image https://` + exampleOnion + `/test.png
+This domain is blacklisted: https://m.` + fbiOnion + `/test.php
 `,
 		}).
 		Return(nil)
 
+	configClientMock.EXPECT().GetCrawlLimits().Return(client.CrawlLimits{MaxDepth: 5, HostnameBudget: 10}, nil)
+
+	urls := []string{
+		"https://" + facebookOnion + "/test.php?id=1",
+		"https://" + googleOnion,
+		"https://" + exampleOnion + "/test.png",
+		"https://m." + fbiOnion + "/test.php",
+	}
+	var hashes []string
+	for _, u := range urls {
+		hash, _ := urlnorm.Hash(u)
+		hashes = append(hashes, hash)
+	}
+
+	// Only the eligible URLs are claimed
 	urlCacheMock.EXPECT().
-		GetManyInt64([]string{"15038381360563270096", "17173291053643777680", "14332094874591870497", "5985629257333875968"}).
-		Return(map[string]int64{
-			"17173291053643777680": 1,
-		}, nil)
+		SetManyNX(map[string]int64{hashes[0]: 1, hashes[1]: 1}, cache.NoTTL).
+		Return(map[string]bool{hashes[0]: true, hashes[1]: false}, nil)
+	hostnameCacheMock.EXPECT().Incr(facebookOnion, defaultBudgetPeriod).Return(int64(3), nil)
 
 	configClientMock.EXPECT().GetAllowedMimeTypes().
 		Times(4).
@@ -231,21 +347,61 @@ This domain is blacklisted: https://m.fbi.onion/test.php
 	configClientMock.EXPECT().GetForbiddenHostnames().
 		Times(3).
 		Return([]client.ForbiddenHostname{
-			{Hostname: "fbi.onion"},
+			{Hostname: fbiOnion},
 		}, nil)
 	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{Delay: 0}, nil)
 
 	subscriberMock.EXPECT().PublishEvent(&event.NewURLEvent{
-		URL: "https://facebook.onion/test.php?id=1",
+		URL:       urls[0],
+		Depth:     2,
+		Seed:      "https://seed.onion",
+		PublicKey: publicKey(t, urls[0]),
 	})
 
-	urlCacheMock.EXPECT().SetManyInt64(map[string]int64{
-		"17173291053643777680": 1,
-		"15038381360563270096": 1,
-	}, cache.NoTTL).Return(nil)
+	s := State{urlDeduper: &cacheDeduper{cache: urlCacheMock}, hostnameCache: hostnameCacheMock, configClient: configClientMock}
+	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
+		t.Fail()
+	}
+}
+
+func TestHandleNewResourceEvent_MaxDepth(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	subscriberMock := event_mock.NewMockSubscriber(mockCtrl)
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+
+	msg := event.RawMessage{}
+	subscriberMock.EXPECT().
+		Read(&msg, &event.NewResourceEvent{}).
+		SetArg(1, event.NewResourceEvent{
+			URL:   "https://example.onion",
+			Body:  `<a href="https://google.onion">Google</a>`,
+			Depth: 3,
+		}).
+		Return(nil)
 
-	s := State{urlCache: urlCacheMock, configClient: configClientMock}
+	configClientMock.EXPECT().GetRefreshDelay().Return(client.RefreshDelay{}, nil)
+	configClientMock.EXPECT().GetCrawlLimits().Return(client.CrawlLimits{MaxDepth: 3}, nil)
+
+	// Nothing should be scheduled
+	s := State{configClient: configClientMock}
 	if err := s.handleNewResourceEvent(subscriberMock, msg); err != nil {
 		t.Fail()
 	}
 }
+
+// publicKey returns the public key of given URL onion address
+func publicKey(t *testing.T, rawURL string) ed25519.PublicKey {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := onion.Parse(u.Hostname())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return addr.PublicKey
+}
@@ -0,0 +1,90 @@
+package seeder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const seederAPIFlag = "seeder-api"
+
+var errNoSeedFile = errors.New("no seed file given")
+
+// ImportCommand returns the command submitting seed files (plain text, CSV or JSON,
+// depending on their extension) to a running seeder
+func ImportCommand() *cli.Command {
+	return &cli.Command{
+		Name:      "import",
+		Usage:     "Submit the seeds of the given files to the seeder API",
+		ArgsUsage: "FILE...",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  seederAPIFlag,
+				Usage: "URI to the seeder API",
+				Value: "http://localhost:8080",
+			},
+		},
+		Action: importSeeds,
+	}
+}
+
+func importSeeds(c *cli.Context) error {
+	process.ConfigureLogger(c)
+
+	if c.NArg() == 0 {
+		return errNoSeedFile
+	}
+
+	endpoint := strings.TrimSuffix(c.String(seederAPIFlag), "/") + "/seeds"
+
+	for _, path := range c.Args().Slice() {
+		res, err := importSeedFile(http.DefaultClient, endpoint, path)
+		if err != nil {
+			log.Err(err).Str("file", path).Msg("error while importing seeds")
+			return err
+		}
+
+		for seed, reason := range res.Skipped {
+			log.Debug().Str("url", seed).Str("reason", reason).Msg("Skipped seed")
+		}
+
+		log.Info().
+			Str("file", path).
+			Int("published", len(res.Published)).
+			Int("skipped", len(res.Skipped)).
+			Msg("Successfully imported seeds")
+	}
+
+	return nil
+}
+
+func importSeedFile(client *http.Client, endpoint, path string) (*seedsResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := client.Post(endpoint, contentTypeOf(path), f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error while submitting seeds: %s", r.Status)
+	}
+
+	var res seedsResult
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("error while reading response: %s", err)
+	}
+
+	return &res, nil
+}
@@ -0,0 +1,22 @@
+package seeder
+
+import (
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	publishedSeeds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "seeder",
+		Name:      "published_seeds_total",
+		Help:      "The number of seeds published for crawling",
+	})
+	skippedSeeds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: process.MetricsNamespace,
+		Subsystem: "seeder",
+		Name:      "skipped_seeds_total",
+		Help:      "The number of seeds not published for crawling, per reason",
+	}, []string{"reason"})
+)
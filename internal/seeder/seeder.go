@@ -0,0 +1,222 @@
+package seeder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/constraint"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/onion"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v2"
+	"net/http"
+)
+
+// maxBodySize is the maximum size of a seeds list
+const maxBodySize = 32 << 20
+
+var errAlreadyScheduled = errors.New("URL is already scheduled")
+
+// seedingErrors are the reasons for a seed to not be published
+var seedingErrors = append([]error{
+	errAlreadyScheduled,
+}, constraint.URLErrors...)
+
+// State represent the application state
+type State struct {
+	configClient configapi.Client
+	urlCache     cache.Cache
+	pub          event.Publisher
+}
+
+// seedsResult is the outcome of a seeds submission
+type seedsResult struct {
+	// Published are the seeds whose crawling has started
+	Published []string `json:"published"`
+	// Skipped are the seeds not published, with the reason why
+	Skipped map[string]string `json:"skipped"`
+}
+
+// Name return the process name
+func (state *State) Name() string {
+	return "seeder"
+}
+
+// Description return the process description
+func (state *State) Description() string {
+	return `
+The seeding component. It exposes a REST API to start crawling
+from given URLs (the seeds), submitted one by one or in bulk as
+plain text (one URL per line), CSV (URL in first column) or JSON.
+The seeds are validated using the same rules as the scheduler,
+and the URLs already scheduled are skipped.
+
+The seeds are always deduplicated using the cache (url keys), whatever
+the scheduler dedupe backend: with '--dedupe bloom', the seeds are only
+deduplicated between themselves, not with the URLs found by the scheduler.
+
+This component produces the 'url.new' event.`
+}
+
+// Features return the process features
+func (state *State) Features() []process.Feature {
+	return []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature}
+}
+
+// CustomFlags return process custom flags
+func (state *State) CustomFlags() []cli.Flag {
+	return []cli.Flag{}
+}
+
+// Initialize the process
+func (state *State) Initialize(provider process.Provider) error {
+	keys := []string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RefreshDelayKey}
+	configClient, err := provider.ConfigClient(keys)
+	if err != nil {
+		return err
+	}
+	state.configClient = configClient
+
+	urlCache, err := provider.Cache("url")
+	if err != nil {
+		return err
+	}
+	state.urlCache = urlCache
+
+	pub, err := provider.Publisher()
+	if err != nil {
+		return err
+	}
+	state.pub = pub
+
+	return nil
+}
+
+// Subscribers return the process subscribers
+func (state *State) Subscribers() []process.SubscriberDef {
+	return []process.SubscriberDef{}
+}
+
+// HTTPHandler returns the HTTP API the process expose
+func (state *State) HTTPHandler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/seeds", state.addSeeds).Methods(http.MethodPost)
+
+	return r
+}
+
+// Shutdown the process, the dependencies are released by the provider
+func (state *State) Shutdown() error {
+	return nil
+}
+
+func (state *State) addSeeds(w http.ResponseWriter, r *http.Request) {
+	seeds, err := parseSeeds(r.Header.Get("Content-Type"), http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		log.Err(err).Msg("error while reading seeds")
+		if errors.Is(err, errUnsupportedContentType) {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		} else {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		return
+	}
+
+	res, err := state.publishSeeds(seeds)
+	if err != nil {
+		log.Err(err).Msg("error while publishing seeds")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	log.Info().
+		Int("published", len(res.Published)).
+		Int("skipped", len(res.Skipped)).
+		Msg("Seeds submitted")
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// publishSeeds start the crawling from the given seeds, skipping the invalid & already scheduled ones
+func (state *State) publishSeeds(seeds []string) (*seedsResult, error) {
+	res := &seedsResult{Published: []string{}, Skipped: map[string]string{}}
+
+	skip := func(seed string, err error) {
+		skippedSeeds.WithLabelValues(process.ErrorKind(err, seedingErrors)).Inc()
+		res.Skipped[seed] = err.Error()
+	}
+
+	// Validate the seeds first to claim them in batch
+	var submitted, urls, hashes []string
+	var addrs []*onion.Address
+	claims := map[string]int64{}
+	seen := map[string]bool{}
+	for _, seed := range seeds {
+		u, err := urlnorm.Normalize(seed)
+		if err != nil {
+			skip(seed, err)
+			continue
+		}
+
+		// Seeds submitted more than once are published once
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+
+		addr, err := constraint.CheckURLAllowed(state.configClient, u)
+		if err != nil {
+			skip(seed, err)
+			continue
+		}
+
+		hash, err := urlnorm.Hash(u)
+		if err != nil {
+			return nil, err
+		}
+
+		submitted = append(submitted, seed)
+		urls = append(urls, u)
+		addrs = append(addrs, addr)
+		hashes = append(hashes, hash)
+		claims[hash] = 1
+	}
+
+	if len(urls) == 0 {
+		return res, nil
+	}
+
+	delay, err := state.configClient.GetRefreshDelay()
+	if err != nil {
+		return nil, err
+	}
+
+	// Mark the seeds as scheduled the same way the cache deduper of the scheduler does, atomically to not
+	// publish an URL twice. The scheduler doesn't read these keys when using its Bloom filter deduper
+	claimed, err := state.urlCache.SetManyNX(claims, delay.Delay)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, u := range urls {
+		if !claimed[hashes[i]] {
+			skip(submitted[i], fmt.Errorf("%s %w", u, errAlreadyScheduled))
+			continue
+		}
+
+		if err := state.pub.PublishEvent(&event.NewURLEvent{URL: u, Seed: u, PublicKey: addrs[i].PublicKey}); err != nil {
+			return nil, fmt.Errorf("error while publishing seed: %s", err)
+		}
+
+		res.Published = append(res.Published, u)
+		publishedSeeds.Inc()
+	}
+
+	return res, nil
+}
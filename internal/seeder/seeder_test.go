@@ -0,0 +1,288 @@
+package seeder
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"github.com/darkspot-org/bathyscaphe/internal/cache"
+	configapi "github.com/darkspot-org/bathyscaphe/internal/configapi/client"
+	"github.com/darkspot-org/bathyscaphe/internal/configapi/client_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/event"
+	"github.com/darkspot-org/bathyscaphe/internal/event_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/onion"
+	"github.com/darkspot-org/bathyscaphe/internal/process"
+	"github.com/darkspot-org/bathyscaphe/internal/process_mock"
+	"github.com/darkspot-org/bathyscaphe/internal/test"
+	"github.com/darkspot-org/bathyscaphe/internal/urlnorm"
+	"github.com/golang/mock/gomock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Valid v3 onion addresses
+const (
+	exampleOnion   = "nn44k7tkbfjdskbmasay5fqrf47qhjaadouxuvsmeocsupy6ux6fdgid.onion"
+	knownOnion     = "3ln5dbfc2utpd265lqdp3lmtlgzcq5m3jv7xtvtgrh5cksvnqvddmpid.onion"
+	forbiddenOnion = "tprsq54vsb4asqd6crbz74my2w74pxhg7g6hipftnekg6yiljaa7haid.onion"
+)
+
+func TestState_Name(t *testing.T) {
+	s := State{}
+	if s.Name() != "seeder" {
+		t.Fail()
+	}
+}
+
+func TestState_Features(t *testing.T) {
+	s := State{}
+	test.CheckProcessFeatures(t, &s, []process.Feature{process.EventFeature, process.ConfigFeature, process.CacheFeature})
+}
+
+func TestState_CustomFlags(t *testing.T) {
+	s := State{}
+	test.CheckProcessCustomFlags(t, &s, nil)
+}
+
+func TestState_Initialize(t *testing.T) {
+	test.CheckInitialize(t, &State{}, func(p *process_mock.MockProviderMockRecorder) {
+		p.ConfigClient([]string{configapi.AllowedMimeTypesKey, configapi.ForbiddenHostnamesKey, configapi.RefreshDelayKey})
+		p.Cache("url")
+		p.Publisher()
+	})
+}
+
+func TestState_Subscribers(t *testing.T) {
+	s := State{}
+	test.CheckProcessSubscribers(t, &s, nil)
+}
+
+func TestParseSeeds(t *testing.T) {
+	type testDef struct {
+		contentType string
+		body        string
+		seeds       []string
+	}
+
+	tests := []testDef{
+		{
+			contentType: "",
+			body:        "https://a.onion\n\n# comment\n  https://b.onion  \n",
+			seeds:       []string{"https://a.onion", "https://b.onion"},
+		},
+		{
+			contentType: "text/plain; charset=utf-8",
+			body:        "https://a.onion",
+			seeds:       []string{"https://a.onion"},
+		},
+		{
+			contentType: "text/csv",
+			body:        "url,title\nhttps://a.onion,A\n# comment\nhttps://b.onion\n",
+			seeds:       []string{"https://a.onion", "https://b.onion"},
+		},
+		{
+			contentType: "application/json",
+			body:        `["https://a.onion", "https://b.onion"]`,
+			seeds:       []string{"https://a.onion", "https://b.onion"},
+		},
+		{
+			contentType: "application/json",
+			body:        `{"url": "https://a.onion"}`,
+			seeds:       []string{"https://a.onion"},
+		},
+		{
+			contentType: "application/json",
+			body:        `{"url": "https://a.onion", "urls": ["https://b.onion"]}`,
+			seeds:       []string{"https://a.onion", "https://b.onion"},
+		},
+	}
+
+	for _, tst := range tests {
+		seeds, err := parseSeeds(tst.contentType, strings.NewReader(tst.body))
+		if err != nil {
+			t.Errorf("error while parsing %s: %s", tst.contentType, err)
+		}
+
+		if !reflect.DeepEqual(seeds, tst.seeds) {
+			t.Errorf("got %v want %v", seeds, tst.seeds)
+		}
+	}
+
+	if _, err := parseSeeds("application/xml", strings.NewReader("<url/>")); err == nil {
+		t.Error("xml should not be supported")
+	}
+	if _, err := parseSeeds("application/json", strings.NewReader("{")); err == nil {
+		t.Error("invalid JSON should be rejected")
+	}
+}
+
+func TestAddSeeds(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+	urlCache := cache.NewMemoryCache(t.Name(), "url")
+
+	example := "https://" + exampleOnion
+	known := "https://" + knownOnion
+	forbidden := "https://" + forbiddenOnion
+
+	// The already scheduled URLs are skipped
+	knownHash, _ := urlnorm.Hash(known)
+	_ = urlCache.SetInt64(knownHash, 1, cache.NoTTL)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]configapi.MimeType{{Extensions: []string{"html"}}}, nil).AnyTimes()
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{{Hostname: forbiddenOnion}}, nil).AnyTimes()
+	configClientMock.EXPECT().GetRefreshDelay().Return(configapi.RefreshDelay{Delay: time.Hour}, nil)
+
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: example, Seed: example, PublicKey: publicKey(exampleOnion)}).Return(nil)
+
+	body := strings.Join([]string{example + "#fragment", example, known, "https://example.org", "ftp://" + exampleOnion,
+		forbidden, "https://facebookcorewwwi.onion"}, "\n")
+	req := httptest.NewRequest(http.MethodPost, "/seeds", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+
+	s := State{configClient: configClientMock, urlCache: urlCache, pub: pubMock}
+	s.HTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	var res seedsResult
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res.Published, []string{example}) {
+		t.Errorf("unexpected published seeds: %v", res.Published)
+	}
+
+	skipped := map[string]string{
+		known:                            known + " URL is already scheduled",
+		"https://example.org":            "example.org hostname is not .onion",
+		"ftp://" + exampleOnion:          "ftp://" + exampleOnion + " protocol is not allowed",
+		forbidden:                        forbidden + " hostname is not allowed",
+		"https://facebookcorewwwi.onion": "facebookcorewwwi.onion v2 onion addresses are deprecated",
+	}
+	if !reflect.DeepEqual(res.Skipped, skipped) {
+		t.Errorf("unexpected skipped seeds: %v", res.Skipped)
+	}
+
+	// The published seed is marked as scheduled
+	hash, _ := urlnorm.Hash(example)
+	if val, err := urlCache.GetInt64(hash); err != nil || val != 1 {
+		t.Errorf("seed should be marked as scheduled: %d %v", val, err)
+	}
+}
+
+func TestAddSeeds_UnsupportedContentType(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/seeds", strings.NewReader("<url/>"))
+	req.Header.Set("Content-Type", "application/xml")
+	rec := httptest.NewRecorder()
+
+	s := State{}
+	s.addSeeds(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
+
+func TestImportSeedFile(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]configapi.MimeType{}, nil).AnyTimes()
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil).AnyTimes()
+	configClientMock.EXPECT().GetRefreshDelay().Return(configapi.RefreshDelay{}, nil)
+
+	a, b := "https://"+exampleOnion, "https://"+knownOnion
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: a, Seed: a, PublicKey: publicKey(exampleOnion)}).Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: b, Seed: b, PublicKey: publicKey(knownOnion)}).Return(nil)
+
+	s := State{configClient: configClientMock, urlCache: cache.NewMemoryCache(t.Name(), "url"), pub: pubMock}
+	srv := httptest.NewServer(s.HTTPHandler())
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "seeds.json")
+	if err := ioutil.WriteFile(path, []byte(`{"urls": ["`+a+`", "`+b+`"]}`), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := importSeedFile(srv.Client(), srv.URL+"/seeds", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(res.Published, []string{a, b}) || len(res.Skipped) != 0 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
+
+func TestImportCommand(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	configClientMock := client_mock.NewMockClient(mockCtrl)
+	pubMock := event_mock.NewMockPublisher(mockCtrl)
+
+	configClientMock.EXPECT().GetAllowedMimeTypes().Return([]configapi.MimeType{}, nil).AnyTimes()
+	configClientMock.EXPECT().GetForbiddenHostnames().Return([]configapi.ForbiddenHostname{}, nil).AnyTimes()
+	configClientMock.EXPECT().GetRefreshDelay().Return(configapi.RefreshDelay{}, nil).AnyTimes()
+
+	a, b := "https://"+exampleOnion, "https://"+knownOnion
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: a, Seed: a, PublicKey: publicKey(exampleOnion)}).Return(nil)
+	pubMock.EXPECT().PublishEvent(&event.NewURLEvent{URL: b, Seed: b, PublicKey: publicKey(knownOnion)}).Return(nil)
+
+	s := State{configClient: configClientMock, urlCache: cache.NewMemoryCache(t.Name(), "url"), pub: pubMock}
+	srv := httptest.NewServer(s.HTTPHandler())
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	txtPath, csvPath := filepath.Join(dir, "seeds.txt"), filepath.Join(dir, "seeds.csv")
+	if err := ioutil.WriteFile(txtPath, []byte(a+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(csvPath, []byte("url\n"+b+"\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build the app like the bs-seeder binary: the command should not require the process flags
+	app := process.MakeApp(&State{})
+	app.Commands = append(app.Commands, ImportCommand())
+	app.Writer = ioutil.Discard
+
+	if err := app.Run([]string{"bs-seeder", "import", "--seeder-api", srv.URL}); err != errNoSeedFile {
+		t.Errorf("unexpected error without seed file: %v", err)
+	}
+
+	if err := app.Run([]string{"bs-seeder", "import", "--seeder-api", srv.URL, txtPath, csvPath}); err != nil {
+		t.Errorf("error while importing seeds: %s", err)
+	}
+}
+
+func publicKey(hostname string) ed25519.PublicKey {
+	addr, _ := onion.Parse(hostname)
+	return addr.PublicKey
+}
@@ -0,0 +1,139 @@
+package seeder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"strings"
+)
+
+const (
+	textContentType = "text/plain"
+	csvContentType  = "text/csv"
+	jsonContentType = "application/json"
+)
+
+var errUnsupportedContentType = errors.New("content type is not supported")
+
+// seedsRequest is the JSON form of a seeds submission: either an array of URLs,
+// or an object holding a single URL and/or a list of URLs
+type seedsRequest struct {
+	URL  string   `json:"url"`
+	URLs []string `json:"urls"`
+}
+
+// parseSeeds returns the seeds of given list, parsed according to its content type.
+// The list is assumed to be plain text if no content type is given
+func parseSeeds(contentType string, r io.Reader) ([]string, error) {
+	mediaType := textContentType
+	if contentType != "" {
+		t, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, fmt.Errorf("%s %w", contentType, errUnsupportedContentType)
+		}
+		mediaType = t
+	}
+
+	switch mediaType {
+	case textContentType:
+		return parseTextSeeds(r)
+	case csvContentType:
+		return parseCSVSeeds(r)
+	case jsonContentType:
+		return parseJSONSeeds(r)
+	default:
+		return nil, fmt.Errorf("%s %w", mediaType, errUnsupportedContentType)
+	}
+}
+
+// parseTextSeeds parse a list of URLs, one per line, ignoring the empty lines & the comments
+func parseTextSeeds(r io.Reader) ([]string, error) {
+	var seeds []string
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Skip empty lines & comments
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		seeds = append(seeds, line)
+	}
+
+	return seeds, scanner.Err()
+}
+
+// parseCSVSeeds parse a CSV list whose first column is the URL, the header (if any) being named 'url'
+func parseCSVSeeds(r io.Reader) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing CSV: %s", err)
+	}
+
+	var seeds []string
+	for i, record := range records {
+		seed := strings.TrimSpace(record[0])
+
+		if seed == "" || (i == 0 && strings.EqualFold(seed, "url")) {
+			continue
+		}
+
+		seeds = append(seeds, seed)
+	}
+
+	return seeds, nil
+}
+
+// parseJSONSeeds parse a JSON list, see seedsRequest
+func parseJSONSeeds(r io.Reader) ([]string, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		var seeds []string
+		if err := json.Unmarshal(b, &seeds); err != nil {
+			return nil, fmt.Errorf("error while parsing JSON: %s", err)
+		}
+
+		return seeds, nil
+	}
+
+	var req seedsRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, fmt.Errorf("error while parsing JSON: %s", err)
+	}
+
+	seeds := req.URLs
+	if req.URL != "" {
+		seeds = append([]string{req.URL}, seeds...)
+	}
+
+	return seeds, nil
+}
+
+// contentTypeOf returns the content type of a seeds file, given its name
+func contentTypeOf(path string) string {
+	switch {
+	case strings.HasSuffix(strings.ToLower(path), ".csv"):
+		return csvContentType
+	case strings.HasSuffix(strings.ToLower(path), ".json"):
+		return jsonContentType
+	default:
+		return textContentType
+	}
+}
@@ -0,0 +1,32 @@
+package urlnorm
+
+import (
+	"fmt"
+	"github.com/PuerkitoBio/purell"
+	"hash/fnv"
+	"strconv"
+)
+
+// Normalize returns the canonical form of given URL, so that the same resource
+// is always identified by the same URL
+func Normalize(u string) (string, error) {
+	normalizedURL, err := purell.NormalizeURLString(u, purell.FlagsUsuallySafeGreedy|
+		purell.FlagRemoveDirectoryIndex|purell.FlagRemoveFragment|purell.FlagRemoveDuplicateSlashes)
+	if err != nil {
+		return "", fmt.Errorf("error while normalizing URL %s: %s", u, err)
+	}
+
+	return normalizedURL, nil
+}
+
+// Hash returns the hash identifying given URL in the caches.
+// We are working using URL hash to reduce memory consumption.
+// See: https://github.com/darkspot-org/bathyscaphe/issues/130
+func Hash(u string) (string, error) {
+	c := fnv.New64()
+	if _, err := c.Write([]byte(u)); err != nil {
+		return "", fmt.Errorf("error while computing url hash: %s", err)
+	}
+
+	return strconv.FormatUint(c.Sum64(), 10), nil
+}
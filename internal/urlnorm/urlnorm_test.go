@@ -0,0 +1,14 @@
+package urlnorm
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	url, err := Normalize("https://this-is-sparta.de?url=url-query-param#fragment-23")
+	if err != nil {
+		t.FailNow()
+	}
+
+	if url != "https://this-is-sparta.de?url=url-query-param" {
+		t.Fail()
+	}
+}
@@ -16,4 +16,5 @@ kubectl -n bathyscaphe apply -f deployments/k8s/configapi.yaml
 kubectl -n bathyscaphe apply -f deployments/k8s/crawler.yaml
 kubectl -n bathyscaphe apply -f deployments/k8s/scheduler.yaml
 kubectl -n bathyscaphe apply -f deployments/k8s/blacklister.yaml
+kubectl -n bathyscaphe apply -f deployments/k8s/seeder.yaml
 kubectl -n bathyscaphe apply -f deployments/k8s/indexer-es.yaml